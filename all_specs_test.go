@@ -0,0 +1,58 @@
+package pnf_test
+
+import (
+  "encoding/gob"
+  "github.com/orfjackal/gospec/src/gospec"
+  "testing"
+)
+
+type EventA struct {
+  Data int
+}
+
+func init() {
+  gob.Register(EventA{})
+}
+func (e EventA) ApplyFirst(interface{}) {}
+func (e EventA) Apply(g interface{}) {
+  g.(*TestGame).A += e.Data
+}
+func (e EventA) ApplyFinal(interface{}) {}
+
+func init() {
+  gob.Register(&TestGame{})
+}
+
+type TestGame struct {
+  A      int
+  Thinks int
+}
+
+func (g *TestGame) ThinkFirst() {}
+func (g *TestGame) ThinkFinal() {}
+func (g *TestGame) Think() {
+  g.Thinks++
+}
+func (g *TestGame) Copy() interface{} {
+  g2 := *g
+  return &g2
+}
+func (g *TestGame) OverwriteWith(_g2 interface{}) {
+  *g = *_g2.(*TestGame)
+}
+
+func TestAllSpecs(t *testing.T) {
+  r := gospec.NewRunner()
+  r.AddSpec(EngineConfigSpec)
+  r.AddSpec(EngineHostSpec)
+  r.AddSpec(EngineCloseSpec)
+  r.AddSpec(ReplayEngineSpec)
+  r.AddSpec(EngineSpectateSpec)
+  r.AddSpec(EngineDelaySpec)
+  r.AddSpec(EnginePauseSpec)
+  r.AddSpec(EngineCodecSpec)
+  r.AddSpec(EngineBatchSpec)
+  r.AddSpec(EngineSnapshotSpec)
+  r.AddSpec(EngineEventsSpec)
+  gospec.MainGoTest(r, t)
+}
@@ -0,0 +1,99 @@
+package pnf
+
+import (
+  "errors"
+  "fmt"
+  "github.com/runningwild/pnf/core"
+  "strconv"
+  "strings"
+)
+
+const (
+  DefaultFrameMs   = 17
+  DefaultMaxFrames = 50
+  DefaultDelay     = 1
+  DefaultPort      = 20007
+)
+
+// Everything needed to construct an Engine, see NewEngine.
+type config struct {
+  params         core.EngineParams
+  port           int
+  max_slew_ms    int64
+  udp_redundancy int
+  empty_batch    int
+  snapshots      int
+}
+
+// Parses a config string of the form "key=value,key=value".  Keys may also
+// be separated by whitespace.  Recognized keys are:
+//   frame_ms:   duration of a single frame in milliseconds.
+//   max_frames: number of frames kept around for rewinding.
+//   delay:      number of frames to wait before applying local events, must
+//               be less than max_frames.
+//   port:       port used for both udp and tcp.
+//   max_slew:   most ms per second the clock is adjusted by to stay in sync.
+//   udp:        if non-zero bundles are sent over udp, each datagram carrying
+//               up to this many recent bundles, see MakeUdpBundleNetwork.
+//   batch:      if more than 1, runs of up to this many frames on which this
+//               engine has no events are sent as a single message, must be
+//               less than max_frames.  See Communicator.Empty_batch.
+//   snapshot:   if more than 1, only every this many frames keeps a copy of
+//               the game for rewinding.  See Updater.Snapshot_interval.
+// Any key that is not specified takes on its default value.
+func parseConfig(params string) (config, error) {
+  var conf config
+  conf.params.Frame_ms = DefaultFrameMs
+  conf.params.Max_frames = DefaultMaxFrames
+  conf.params.Delay = DefaultDelay
+  conf.port = DefaultPort
+  fields := strings.FieldsFunc(params, func(r rune) bool {
+    return r == ',' || r == ' ' || r == '\t' || r == '\n'
+  })
+  for _, field := range fields {
+    kv := strings.SplitN(field, "=", 2)
+    if len(kv) != 2 {
+      return conf, errors.New(fmt.Sprintf("Malformed config entry %q, expected key=value.", field))
+    }
+    val, err := strconv.ParseInt(kv[1], 10, 64)
+    if err != nil {
+      return conf, errors.New(fmt.Sprintf("Unable to parse value for %q: %v", kv[0], err))
+    }
+    if val < 0 {
+      return conf, errors.New(fmt.Sprintf("Value for %q must not be negative.", kv[0]))
+    }
+    switch kv[0] {
+    case "frame_ms":
+      conf.params.Frame_ms = val
+    case "max_frames":
+      conf.params.Max_frames = int(val)
+    case "delay":
+      conf.params.Delay = core.StateFrame(val)
+    case "port":
+      conf.port = int(val)
+    case "max_slew":
+      conf.max_slew_ms = val
+    case "udp":
+      conf.udp_redundancy = int(val)
+    case "batch":
+      conf.empty_batch = int(val)
+    case "snapshot":
+      conf.snapshots = int(val)
+    default:
+      return conf, errors.New(fmt.Sprintf("Unknown config key %q.", kv[0]))
+    }
+  }
+  if conf.params.Frame_ms <= 0 {
+    return conf, errors.New("frame_ms must be positive.")
+  }
+  if conf.params.Max_frames <= 0 {
+    return conf, errors.New("max_frames must be positive.")
+  }
+  if int(conf.params.Delay) >= conf.params.Max_frames {
+    return conf, errors.New("delay must be less than max_frames.")
+  }
+  if conf.empty_batch >= conf.params.Max_frames {
+    return conf, errors.New("batch must be less than max_frames.")
+  }
+  return conf, nil
+}
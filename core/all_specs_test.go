@@ -64,12 +64,26 @@ func TestAllSpecs(t *testing.T) {
   r.AddSpec(NetworkMockSpec)
   r.AddSpec(NetworkStandardSpec)
   r.AddSpec(NetworkStandardGobbingSpec)
+  r.AddSpec(NetworkStandardConnSpec)
+  r.AddSpec(NetworkStandardFramingSpec)
+  r.AddSpec(NetworkUdpBundleSpec)
   r.AddSpec(EngineUdpTcpSpec)
   r.AddSpec(BundlerSpec)
   r.AddSpec(UpdaterSpec)
   r.AddSpec(CommunicatorSpec)
+  r.AddSpec(CommunicatorJoinSpec)
+  r.AddSpec(CommunicatorBootstrapSpec)
+  r.AddSpec(CommunicatorMigrationSpec)
+  r.AddSpec(CommunicatorMeshSpec)
+  r.AddSpec(CommunicatorTcpMeshSpec)
+  r.AddSpec(CommunicatorBatchSpec)
+  r.AddSpec(CommunicatorSendSpec)
   r.AddSpec(AuditorSpec)
+  r.AddSpec(AuditorClockSpec)
   r.AddSpec(BaseSpec)
+  r.AddSpec(EventBundleSpec)
+  r.AddSpec(CodecSpec)
+  r.AddSpec(ReplaySpec)
   r.AddSpec(EngineSpec)
   gospec.MainGoTest(r, t)
 }
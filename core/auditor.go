@@ -1,11 +1,17 @@
 package core
 
+import (
+  "sort"
+)
+
 // Data from remote connections comes to the Auditor from the Communicator.
 // The Auditor verifies remote information and sends it to the Updater, if any
 // connections are dropped the Auditor will create dummy bundles so that the
 // game can continue without those connections, and will also signal to other
 // engines that no more bundles are expected from those engines.
 type Auditor struct {
+  Params EngineParams
+
   // Bundles come here from the Communicator.  At this point they have not
   // been verified.
   Raw_remote_bundles <-chan FrameBundle
@@ -17,22 +23,605 @@ type Auditor struct {
   // If the Auditor detects that this engine is out of sync with other engines
   // it can tell the Bundler so that it can adjust its clock accordingly.
   Time_delta chan<- int64
+
+  // Every frame broadcast by this engine is reported here by the
+  // Communicator.  This is the Auditor's clock.
+  Local_frames <-chan StateFrame
+
+  // The Communicator reports engines whose connections have died here.
+  Dropped_engines <-chan DroppedEngine
+
+  // EngineDropped events are sent through here to the Bundler so that they
+  // get broadcast to all engines.  Only the host decides when an engine gets
+  // dropped, so an engine that is not hosting can safely leave this as nil.
+  Local_engine_event chan<- EngineEvent
+
+  // If this is set the Auditor doesn't drop anything until something is
+  // received on it, which the Communicator does when this engine takes over
+  // as host.  An engine that joined a host and could take over from it should
+  // set this along with Local_engine_event.
+  Promotions <-chan struct{}
+
+  // The Updater reports engines that sent two different bundles for the same
+  // frame here.  Those engines are dropped, since there is no way to know
+  // which bundle every other engine used.  This can safely be left as nil.
+  Conflicts <-chan BundleConflict
+
+  // Checksums of finalized frames from every engine, including this one,
+  // come here from the Communicator.
+  Checksums <-chan FrameChecksum
+
+  // Whenever a remote engine's checksum doesn't match ours it is reported
+  // here.  If nobody is listening the Desync is dropped rather than holding
+  // up the Auditor.  This can safely be left as nil.
+  Desyncs chan<- Desync
+
+  // Number of frames this engine can advance without receiving anything from
+  // a remote engine before that engine is dropped.  If this is zero it
+  // defaults to half of Params.Max_frames.
+  Timeout_frames StateFrame
+
+  // The most that the clock will be adjusted by, in ms per second, when
+  // trying to stay in sync with other engines.  If this is zero it defaults
+  // to DefaultMaxSlewMs.
+  Max_slew_ms int64
+
+  // How far ahead of us each remote engine is, in frames, smoothed over
+  // several bundles.
+  offsets map[EngineId]float64
+
+  // How many ms we are allowed to adjust the clock by right now, this grows
+  // as time passes so that the clock is never adjusted by more than
+  // Max_slew_ms per second.
+  slew_budget float64
+
+  // Clock adjustments that haven't been sent to the Bundler yet.
+  pending_delta int64
+
+  // EngineDropped events that haven't been sent to the Bundler yet.  The
+  // Bundler might be waiting on the Updater, which might be waiting on us, so
+  // we can't just block until it takes them.
+  pending_events []EngineEvent
+
+  // Most recent frame broadcast by this engine.
+  local_frame StateFrame
+
+  // Which frames we've received from each remote engine.
+  received map[EngineId]*receivedFrames
+
+  // All engines that have been dropped, either by us or by the host.
+  dropped map[EngineId]*droppedEngine
+
+  // True if we're the one that decides when engines get dropped.
+  hosting bool
+
+  // Checksums for frames that we haven't finished checking yet, and the
+  // oldest frame that we still care about checksums for.
+  checksums      map[StateFrame]*frameChecksums
+  checksum_floor StateFrame
+
+  // Latency() sends requests to the routine along this channel.
+  latency_requests chan chan float64
+
+  // The Auditor shuts down when Raw_remote_bundles is closed, or when
+  // Shutdown is called.  done is closed once it has finished.
+  shutdown chan struct{}
+  done     chan struct{}
+}
+
+// Reported by the Auditor when remote engines disagree with this engine about
+// the state of the Game on a finalized frame.
+type Desync struct {
+  Frame StateFrame
+
+  // Engines whose checksum for Frame doesn't match ours, in ascending order.
+  Engines []EngineId
+}
+
+const (
+  DefaultMaxSlewMs = 50
+
+  // How much weight a single bundle has when measuring how far ahead of us
+  // a remote engine is.
+  offsetSmoothing = 0.125
+)
+
+// Tracks the frames received from a single engine.  Bundles can arrive out of
+// order, but we only pass them along to the Updater in order so that if the
+// engine gets dropped everyone can agree on exactly which of its bundles were
+// used.
+type receivedFrames struct {
+  // Every bundle from first up to and including contiguous has been sent to
+  // the Updater.
+  first      StateFrame
+  contiguous StateFrame
+
+  // Bundles from before first that have been sent to the Updater.  They
+  // arrived late, since the engine had already sent first.
+  late map[StateFrame]bool
+
+  // Bundles that arrived before a bundle for an earlier frame.
+  held map[StateFrame]AllEvents
+
+  // Events of the bundles that have been sent to the Updater, so that
+  // duplicates can be checked against them.  Only the most recent
+  // Params.Max_frames frames are kept.
+  sent map[StateFrame]AllEvents
+
+  // Most recent frame we've received from this engine.
+  newest StateFrame
+
+  // What our local frame was the last time we received anything from this
+  // engine.
+  heard StateFrame
+}
+
+// Returns true if we've already received the bundle for frame.
+func (r *receivedFrames) has(frame StateFrame) bool {
+  if frame >= r.first && frame <= r.contiguous {
+    return true
+  }
+  if _, ok := r.held[frame]; ok {
+    return true
+  }
+  return r.late[frame]
+}
+
+// Returns the events we received from this engine for frame, if we still have
+// them.
+func (r *receivedFrames) events(frame StateFrame) (AllEvents, bool) {
+  if events, ok := r.held[frame]; ok {
+    return events, true
+  }
+  events, ok := r.sent[frame]
+  return events, ok
+}
+
+type frameChecksums struct {
+  local     uint64
+  has_local bool
+
+  // Checksums from remote engines are only held on to until we have our
+  // own to compare them to.
+  remote map[EngineId]uint64
+}
+
+type droppedEngine struct {
+  // Events from this engine on frames after last are discarded.
+  last StateFrame
+
+  // Most recent frame for which we've synthesized an empty bundle.
+  synthesized StateFrame
+
+  // We synthesize empty bundles up to and including this frame.
+  until StateFrame
 }
 
 func (a *Auditor) Start() {
+  if a.Timeout_frames == 0 {
+    a.Timeout_frames = StateFrame(a.Params.Max_frames / 2)
+  }
+  if a.Max_slew_ms == 0 {
+    a.Max_slew_ms = DefaultMaxSlewMs
+  }
+  a.received = make(map[EngineId]*receivedFrames)
+  a.dropped = make(map[EngineId]*droppedEngine)
+  a.hosting = a.Local_engine_event != nil && a.Promotions == nil
+  a.offsets = make(map[EngineId]float64)
+  a.checksums = make(map[StateFrame]*frameChecksums)
+  a.latency_requests = make(chan chan float64)
+  a.shutdown = make(chan struct{})
+  a.done = make(chan struct{})
   go a.routine()
 }
 
-// TODO: Currently this is just a pass-through auditor, the following things
-// must be implemented for a robust engine:
-// - Detect dropped players, probably need to be notified by the Communicator,
-//   and generate dummy events and a PlayerLeft engine event.
-// - Detect when we're not synchronized and adjust clocks accordingly.
+// Closes Remote_bundles and returns once the Auditor has stopped.  If the
+// Communicator is still running this doesn't return until it closes
+// Raw_remote_bundles.
+func (a *Auditor) Shutdown() {
+  select {
+  case a.shutdown <- struct{}{}:
+  case <-a.done:
+  }
+  <-a.done
+}
+
+// Returns how many frames behind our own clock bundles from the furthest
+// behind remote engine arrive, smoothed over several bundles.  This is how far
+// back the Updater typically has to go when a remote bundle arrives, so it's
+// about what Params.Delay should be.  Returns 0 once the Auditor has stopped.
+func (a *Auditor) Latency() float64 {
+  response := make(chan float64)
+  select {
+  case a.latency_requests <- response:
+    return <-response
+  case <-a.done:
+    return 0
+  }
+}
+
+func (a *Auditor) latency() float64 {
+  var latency float64
+  for _, offset := range a.offsets {
+    if -offset > latency {
+      latency = -offset
+    }
+  }
+  return latency
+}
+
+// Once we've stopped we don't send anything else anywhere, but we keep taking
+// whatever the Communicator sends us until it is done with us.
+func (a *Auditor) stop() {
+  close(a.Remote_bundles)
+  for {
+    select {
+    case _, ok := <-a.Raw_remote_bundles:
+      if !ok {
+        close(a.done)
+        return
+      }
+    case <-a.Local_frames:
+    case <-a.Dropped_engines:
+    case <-a.Conflicts:
+    case <-a.Checksums:
+    case <-a.Promotions:
+    case response := <-a.latency_requests:
+      response <- 0
+    }
+  }
+}
+
 func (a *Auditor) routine() {
   for {
+    var time_delta chan<- int64
+    if a.pending_delta != 0 {
+      time_delta = a.Time_delta
+    }
+    var local_engine_event chan<- EngineEvent
+    var pending_event EngineEvent
+    if len(a.pending_events) > 0 {
+      local_engine_event = a.Local_engine_event
+      pending_event = a.pending_events[0]
+    }
     select {
-    case raw_remote := <-a.Raw_remote_bundles:
-      a.Remote_bundles <- raw_remote
+    case time_delta <- a.pending_delta:
+      a.pending_delta = 0
+
+    case local_engine_event <- pending_event:
+      a.pending_events = a.pending_events[1:]
+
+    case raw_remote, ok := <-a.Raw_remote_bundles:
+      if !ok {
+        close(a.Remote_bundles)
+        close(a.done)
+        return
+      }
+      a.handleRemoteBundle(raw_remote)
+
+    case frame := <-a.Local_frames:
+      if frame <= a.local_frame {
+        break
+      }
+      elapsed := frame - a.local_frame
+      a.local_frame = frame
+      a.checkTimeouts()
+      a.synthesizeAll(a.local_frame)
+      a.adjustClock(elapsed)
+
+    case dropped := <-a.Dropped_engines:
+      if a.hosting {
+        a.drop(dropped.Id)
+      }
+
+    case conflict := <-a.Conflicts:
+      if a.hosting {
+        a.drop(conflict.Id)
+      }
+
+    case <-a.Promotions:
+      a.hosting = a.Local_engine_event != nil
+
+    case checksum := <-a.Checksums:
+      a.handleChecksum(checksum)
+
+    case response := <-a.latency_requests:
+      response <- a.latency()
+
+    case <-a.shutdown:
+      a.stop()
+      return
+    }
+  }
+}
+
+func (a *Auditor) handleRemoteBundle(remote FrameBundle) {
+  // Bundles may contain events from several engines, but we handle each
+  // engine separately.
+  for id, events := range remote.Bundle {
+    if d, ok := a.dropped[id]; ok {
+      // Anything this engine sent after the last frame that it was dropped on
+      // is ignored so that all engines agree on its events.
+      if remote.Frame <= d.last {
+        a.send(id, remote.Frame, events)
+      }
+      continue
+    }
+    r, ok := a.received[id]
+    if !ok {
+      r = &receivedFrames{
+        first:      remote.Frame,
+        contiguous: remote.Frame - 1,
+        late:       make(map[StateFrame]bool),
+        held:       make(map[StateFrame]AllEvents),
+        sent:       make(map[StateFrame]AllEvents),
+        newest:     remote.Frame,
+      }
+      a.received[id] = r
+    }
+    r.heard = a.local_frame
+    if r.has(remote.Frame) {
+      // Engines resend their recent bundles when the host changes, so we can
+      // get the same one more than once.  If it's different then there's no
+      // way to know which one every other engine used, so the engine has to
+      // go.
+      if old, ok := r.events(remote.Frame); ok && !old.identical(events) && a.hosting {
+        a.drop(id)
+      }
+      continue
+    }
+    // Only the newest bundles tell us anything about the remote engine's
+    // clock, older ones were just delayed.  Until we've broadcast a frame we
+    // don't know what our own clock says.
+    if remote.Frame >= r.newest && a.local_frame > 0 {
+      r.newest = remote.Frame
+      lead := float64(remote.Frame - a.local_frame)
+      if offset, ok := a.offsets[id]; ok {
+        a.offsets[id] = offset + (lead-offset)*offsetSmoothing
+      } else {
+        a.offsets[id] = lead
+      }
+    }
+    if remote.Frame < r.first {
+      r.late[remote.Frame] = true
+      r.sent[remote.Frame] = events
+      a.send(id, remote.Frame, events)
+      continue
+    }
+    r.held[remote.Frame] = events
+    for {
+      events, ok := r.held[r.contiguous+1]
+      if !ok {
+        break
+      }
+      delete(r.held, r.contiguous+1)
+      r.contiguous++
+      r.sent[r.contiguous] = events
+      delete(r.sent, r.contiguous-StateFrame(a.Params.Max_frames))
+      a.send(id, r.contiguous, events)
+      if _, ok := a.dropped[id]; ok {
+        // The engine left, so anything it sent later is ignored.
+        break
+      }
+    }
+  }
+}
+
+// EngineDropped events are only handled once they've been passed along, so
+// that an engine that leaves on its own has had every one of its earlier
+// bundles passed along too.
+func (a *Auditor) send(id EngineId, frame StateFrame, events AllEvents) {
+  a.Remote_bundles <- FrameBundle{
+    Frame:  frame,
+    Bundle: EventBundle{id: events},
+  }
+  for _, event := range events.Engine {
+    if dropped, ok := event.(EngineDropped); ok {
+      a.handleDropped(id, frame, dropped)
+    }
+  }
+}
+
+// If another engine dropped an engine then all we need to do is fill in the
+// frames between the last frame it was dropped on and the frame on which it
+// was dropped.  If the engine dropped itself then there is nothing to fill
+// in.
+func (a *Auditor) handleDropped(from EngineId, frame StateFrame, dropped EngineDropped) {
+  if dropped.Id == a.Params.Id {
+    return
+  }
+  if _, ok := a.dropped[dropped.Id]; ok {
+    return
+  }
+  last := dropped.Last_frame
+  if dropped.Id == from {
+    last = frame
+  }
+  delete(a.received, dropped.Id)
+  delete(a.offsets, dropped.Id)
+  a.dropped[dropped.Id] = &droppedEngine{
+    last:        last,
+    synthesized: a.oldestUsefulFrame(last, frame),
+    until:       frame - 1,
+  }
+  a.synthesize(dropped.Id, frame-1)
+}
+
+// Drops any engines that we haven't heard from in too long.
+func (a *Auditor) checkTimeouts() {
+  if !a.hosting {
+    return
+  }
+  var timed_out []EngineId
+  for id, r := range a.received {
+    // An engine that's catching up might be far behind us, but as long as we
+    // keep hearing from it it isn't gone.
+    last := r.contiguous
+    if r.heard > last {
+      last = r.heard
     }
+    if a.local_frame-last > a.Timeout_frames {
+      timed_out = append(timed_out, id)
+    }
+  }
+  for _, id := range timed_out {
+    a.drop(id)
+  }
+}
+
+// Drops an engine and tells every other engine about it.  Only the host
+// should ever call this.
+func (a *Auditor) drop(id EngineId) {
+  if _, ok := a.dropped[id]; ok || id == a.Params.Id {
+    return
+  }
+  // If we've never heard from this engine we have to assume that it hasn't
+  // sent any events that could still matter.  Anything it sent that we are
+  // still holding on to is discarded.
+  last := a.local_frame - StateFrame(a.Params.Max_frames) - 1
+  if r, ok := a.received[id]; ok {
+    last = r.contiguous
+  }
+  delete(a.received, id)
+  delete(a.offsets, id)
+
+  // We don't know exactly which frame the Bundler will put the EngineDropped
+  // event on, so we keep synthesizing bundles until it must have been
+  // applied.
+  a.dropped[id] = &droppedEngine{
+    last:        last,
+    synthesized: a.oldestUsefulFrame(last, a.local_frame),
+    until:       a.local_frame + StateFrame(a.Params.Max_frames),
+  }
+  a.pending_events = append(a.pending_events, EngineDropped{Id: id, Last_frame: last})
+  a.synthesize(id, a.local_frame)
+}
+
+// Frames older than this are already outside of the Updater's window, so
+// there is no point synthesizing bundles for them.
+func (a *Auditor) oldestUsefulFrame(last, current StateFrame) StateFrame {
+  oldest := current - StateFrame(a.Params.Max_frames) - 1
+  if last > oldest {
+    return last
+  }
+  return oldest
+}
+
+func (a *Auditor) synthesizeAll(frame StateFrame) {
+  for id := range a.dropped {
+    a.synthesize(id, frame)
+  }
+}
+
+// Sends empty bundles for a dropped engine for every frame up to frame that
+// we haven't already sent one for.
+func (a *Auditor) synthesize(id EngineId, frame StateFrame) {
+  d := a.dropped[id]
+  if frame > d.until {
+    frame = d.until
+  }
+  for ; d.synthesized < frame; d.synthesized++ {
+    a.send(id, d.synthesized+1, AllEvents{})
+  }
+}
+
+// Nudges our clock towards the average clock of all remote engines.  This
+// is called whenever our clock advances by elapsed frames.
+func (a *Auditor) adjustClock(elapsed StateFrame) {
+  if a.Time_delta == nil || a.Params.Frame_ms == 0 {
+    return
+  }
+  frame_ms := float64(a.Params.Frame_ms)
+  a.slew_budget += float64(elapsed) * frame_ms * float64(a.Max_slew_ms) / 1000
+  if a.slew_budget > float64(a.Max_slew_ms) {
+    a.slew_budget = float64(a.Max_slew_ms)
+  }
+  if len(a.offsets) == 0 {
+    return
+  }
+  var total float64
+  for _, offset := range a.offsets {
+    total += offset
+  }
+  offset_ms := total / float64(len(a.offsets)) * frame_ms
+
+  // Bundles always take some time to get here, so being within a frame of
+  // everyone else is as good as we can tell.  Past that we only correct half
+  // of the difference, since everyone else is correcting towards us too.
+  if offset_ms <= frame_ms && offset_ms >= -frame_ms {
+    return
+  }
+  correction := offset_ms / 2
+  if correction > a.slew_budget {
+    correction = a.slew_budget
+  }
+  if correction < -a.slew_budget {
+    correction = -a.slew_budget
+  }
+  delta := int64(correction)
+  if delta == 0 {
+    return
+  }
+  if delta < 0 {
+    a.slew_budget += float64(delta)
+  } else {
+    a.slew_budget -= float64(delta)
+  }
+  a.pending_delta += delta
+
+  // Our clock is about to change, so all of the remote engines are that much
+  // closer to us.
+  for id := range a.offsets {
+    a.offsets[id] -= float64(delta) / frame_ms
+  }
+}
+
+func (a *Auditor) handleChecksum(checksum FrameChecksum) {
+  if checksum.Frame < a.checksum_floor {
+    return
+  }
+  fc, ok := a.checksums[checksum.Frame]
+  if !ok {
+    fc = &frameChecksums{remote: make(map[EngineId]uint64)}
+    a.checksums[checksum.Frame] = fc
+  }
+  if checksum.Id != a.Params.Id {
+    if !fc.has_local {
+      fc.remote[checksum.Id] = checksum.Checksum
+    } else if checksum.Checksum != fc.local {
+      a.reportDesync(checksum.Frame, []EngineId{checksum.Id})
+    }
+    return
+  }
+
+  fc.local = checksum.Checksum
+  fc.has_local = true
+  var engines []EngineId
+  for id, remote := range fc.remote {
+    if remote != fc.local {
+      engines = append(engines, id)
+    }
+  }
+  fc.remote = nil
+  sort.Sort(engineIdSlice(engines))
+  a.reportDesync(checksum.Frame, engines)
+
+  // Any engine still in the game will have sent its checksum for a frame
+  // long before we're this far past it.
+  a.checksum_floor = checksum.Frame - StateFrame(a.Params.Max_frames)
+  for frame := range a.checksums {
+    if frame < a.checksum_floor {
+      delete(a.checksums, frame)
+    }
+  }
+}
+
+func (a *Auditor) reportDesync(frame StateFrame, engines []EngineId) {
+  if len(engines) == 0 || a.Desyncs == nil {
+    return
+  }
+  select {
+  case a.Desyncs <- Desync{Frame: frame, Engines: engines}:
+  default:
   }
 }
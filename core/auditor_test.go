@@ -4,11 +4,363 @@ import (
   "github.com/orfjackal/gospec/src/gospec"
   . "github.com/orfjackal/gospec/src/gospec"
   "github.com/runningwild/core"
+  "time"
 )
 
+// Returns the frame and engine id of every bundle currently waiting on
+// bundles, each bundle must have exactly one engine in it.
+func drainBundles(bundles <-chan core.FrameBundle) (frames []core.StateFrame, ids []core.EngineId) {
+  for {
+    select {
+    case bundle := <-bundles:
+      for id := range bundle.Bundle {
+        frames = append(frames, bundle.Frame)
+        ids = append(ids, id)
+      }
+    default:
+      return
+    }
+  }
+}
+
+// Returns the next n events on events, or however many of them show up within
+// a second.
+func receiveEvents(events <-chan core.EngineEvent, n int) []core.EngineEvent {
+  var received []core.EngineEvent
+  timeout := time.After(time.Second)
+  for len(received) < n {
+    select {
+    case event := <-events:
+      received = append(received, event)
+    case <-timeout:
+      return received
+    }
+  }
+  return received
+}
+
 func AuditorSpec(c gospec.Context) {
   c.Specify("Auditor stuff.", func() {
     a := new(core.Auditor)
     c.Expect(a, Not(Equals), (*core.Auditor)(nil))
   })
+
+  var params core.EngineParams
+  params.Id = 1
+  params.Frame_ms = 5
+  params.Max_frames = 10
+  raw_remote_bundles := make(chan core.FrameBundle)
+  remote_bundles := make(chan core.FrameBundle, 100)
+  local_frames := make(chan core.StateFrame)
+  var auditor core.Auditor
+  auditor.Params = params
+  auditor.Raw_remote_bundles = raw_remote_bundles
+  auditor.Remote_bundles = remote_bundles
+  auditor.Local_frames = local_frames
+
+  c.Specify("Auditor passes bundles along in order for each engine.", func() {
+    auditor.Start()
+    for _, frame := range []core.StateFrame{1, 3, 2, 4} {
+      raw_remote_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{2: core.AllEvents{}},
+      }
+    }
+    // Make sure the last bundle has been processed.
+    local_frames <- 1
+    frames, _ := drainBundles(remote_bundles)
+    c.Expect(frames, Equals, []core.StateFrame{1, 2, 3, 4})
+  })
+
+  c.Specify("Host Auditor drops engines that stop sending bundles.", func() {
+    local_engine_event := make(chan core.EngineEvent, 10)
+    auditor.Local_engine_event = local_engine_event
+    auditor.Timeout_frames = 3
+    auditor.Start()
+    for frame := core.StateFrame(1); frame <= 3; frame++ {
+      raw_remote_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{2: core.AllEvents{Game: []core.Event{EventA{1}}}},
+      }
+    }
+    for frame := core.StateFrame(1); frame <= 6; frame++ {
+      local_frames <- frame
+    }
+    c.Expect(len(local_engine_event), Equals, 0)
+    local_frames <- 7
+    local_frames <- 8
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  5,
+      Bundle: core.EventBundle{2: core.AllEvents{Game: []core.Event{EventA{1}}}},
+    }
+    local_frames <- 8
+    dropped := receiveEvents(local_engine_event, 1)
+    c.Assume(len(dropped), Equals, 1)
+    c.Expect(dropped[0], Equals, core.EngineEvent(core.EngineDropped{Id: 2, Last_frame: 3}))
+
+    var frames []core.StateFrame
+    var events []int
+    for len(remote_bundles) > 0 {
+      bundle := <-remote_bundles
+      frames = append(frames, bundle.Frame)
+      events = append(events, len(bundle.Bundle[2].Game))
+    }
+    c.Expect(frames, Equals, []core.StateFrame{1, 2, 3, 4, 5, 6, 7, 8})
+    c.Expect(events, Equals, []int{1, 1, 1, 0, 0, 0, 0, 0})
+  })
+
+  c.Specify("Host Auditor keeps going while the Bundler isn't taking its events.", func() {
+    local_engine_event := make(chan core.EngineEvent)
+    auditor.Local_engine_event = local_engine_event
+    auditor.Timeout_frames = 3
+    auditor.Start()
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  1,
+      Bundle: core.EventBundle{2: core.AllEvents{}},
+    }
+    for frame := core.StateFrame(1); frame <= 10; frame++ {
+      local_frames <- frame
+    }
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{3: core.AllEvents{}},
+    }
+    c.Expect(auditor.Latency() >= 0, Equals, true)
+    dropped := receiveEvents(local_engine_event, 1)
+    c.Assume(len(dropped), Equals, 1)
+    c.Expect(dropped[0], Equals, core.EngineEvent(core.EngineDropped{Id: 2, Last_frame: 1}))
+  })
+
+  c.Specify("Client Auditor fills in frames for engines dropped by the host.", func() {
+    auditor.Start()
+    for frame := core.StateFrame(1); frame <= 4; frame++ {
+      raw_remote_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{3: core.AllEvents{}},
+      }
+    }
+    raw_remote_bundles <- core.FrameBundle{
+      Frame: 8,
+      Bundle: core.EventBundle{
+        2: core.AllEvents{
+          Engine: []core.EngineEvent{core.EngineDropped{Id: 3, Last_frame: 4}},
+        },
+      },
+    }
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  6,
+      Bundle: core.EventBundle{3: core.AllEvents{}},
+    }
+    local_frames <- 1
+    frames, ids := drainBundles(remote_bundles)
+    c.Expect(frames, Equals, []core.StateFrame{1, 2, 3, 4, 8, 5, 6, 7})
+    c.Expect(ids, Equals, []core.EngineId{3, 3, 3, 3, 2, 3, 3, 3})
+  })
+
+  c.Specify("Auditor stops waiting on engines that leave on their own.", func() {
+    local_engine_event := make(chan core.EngineEvent, 10)
+    dropped_engines := make(chan core.DroppedEngine)
+    auditor.Local_engine_event = local_engine_event
+    auditor.Dropped_engines = dropped_engines
+    auditor.Start()
+    for _, frame := range []core.StateFrame{1, 2, 4} {
+      raw_remote_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{3: core.AllEvents{}},
+      }
+    }
+    raw_remote_bundles <- core.FrameBundle{
+      Frame: 3,
+      Bundle: core.EventBundle{
+        3: core.AllEvents{
+          Engine: []core.EngineEvent{core.EngineDropped{Id: 3}},
+        },
+      },
+    }
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  5,
+      Bundle: core.EventBundle{3: core.AllEvents{}},
+    }
+    // Its conn dying afterwards doesn't matter, it's already gone.
+    dropped_engines <- core.DroppedEngine{Id: 3}
+    for frame := core.StateFrame(1); frame <= 10; frame++ {
+      local_frames <- frame
+    }
+    frames, ids := drainBundles(remote_bundles)
+    c.Expect(frames, Equals, []core.StateFrame{1, 2, 3})
+    c.Expect(ids, Equals, []core.EngineId{3, 3, 3})
+    c.Expect(len(local_engine_event), Equals, 0)
+  })
+
+  c.Specify("Auditor only passes each bundle along once.", func() {
+    auditor.Start()
+    for _, frame := range []core.StateFrame{2, 3, 1, 2, 3, 1, 4} {
+      raw_remote_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{2: core.AllEvents{}},
+      }
+    }
+    local_frames <- 1
+    frames, _ := drainBundles(remote_bundles)
+    c.Expect(frames, Equals, []core.StateFrame{2, 3, 1, 4})
+  })
+
+  c.Specify("Client Auditor only drops engines once it has taken over as host.", func() {
+    local_engine_event := make(chan core.EngineEvent, 10)
+    dropped_engines := make(chan core.DroppedEngine)
+    promotions := make(chan struct{})
+    auditor.Local_engine_event = local_engine_event
+    auditor.Dropped_engines = dropped_engines
+    auditor.Promotions = promotions
+    auditor.Timeout_frames = 3
+    auditor.Start()
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  1,
+      Bundle: core.EventBundle{3: core.AllEvents{}},
+    }
+    dropped_engines <- core.DroppedEngine{Id: 2}
+    for frame := core.StateFrame(1); frame <= 10; frame++ {
+      local_frames <- frame
+    }
+    c.Expect(len(local_engine_event), Equals, 0)
+
+    promotions <- struct{}{}
+    dropped_engines <- core.DroppedEngine{Id: 2}
+    local_frames <- 11
+    dropped := receiveEvents(local_engine_event, 2)
+    c.Assume(len(dropped), Equals, 2)
+    c.Expect(dropped[0].(core.EngineDropped).Id, Equals, core.EngineId(2))
+    c.Expect(dropped[1], Equals, core.EngineEvent(core.EngineDropped{Id: 3, Last_frame: 1}))
+  })
+
+  c.Specify("Host Auditor drops engines that send conflicting bundles.", func() {
+    local_engine_event := make(chan core.EngineEvent, 10)
+    conflicts := make(chan core.BundleConflict)
+    auditor.Local_engine_event = local_engine_event
+    auditor.Conflicts = conflicts
+    auditor.Start()
+    for frame := core.StateFrame(1); frame <= 3; frame++ {
+      raw_remote_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{2: core.AllEvents{}},
+      }
+    }
+    conflicts <- core.BundleConflict{Id: 2, Frame: 2}
+    local_frames <- 1
+    dropped := receiveEvents(local_engine_event, 1)
+    c.Assume(len(dropped), Equals, 1)
+    c.Expect(dropped[0], Equals, core.EngineEvent(core.EngineDropped{Id: 2, Last_frame: 3}))
+  })
+
+  c.Specify("Host Auditor drops engines that send two different bundles for the same frame.", func() {
+    local_engine_event := make(chan core.EngineEvent, 10)
+    auditor.Local_engine_event = local_engine_event
+    auditor.Start()
+    for _, frame := range []core.StateFrame{1, 2, 1, 3, 2} {
+      raw_remote_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{2: core.AllEvents{Game: []core.Event{EventA{int(frame)}}}},
+      }
+    }
+    local_frames <- 1
+    c.Expect(len(local_engine_event), Equals, 0)
+
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{2: core.AllEvents{Game: []core.Event{EventA{5}}}},
+    }
+    local_frames <- 2
+    dropped := receiveEvents(local_engine_event, 1)
+    c.Assume(len(dropped), Equals, 1)
+    c.Expect(dropped[0], Equals, core.EngineEvent(core.EngineDropped{Id: 2, Last_frame: 3}))
+  })
+
+  c.Specify("Auditor stops once Raw_remote_bundles is closed.", func() {
+    auditor.Start()
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  1,
+      Bundle: core.EventBundle{2: core.AllEvents{}},
+    }
+    close(raw_remote_bundles)
+    auditor.Shutdown()
+    _, ok := <-remote_bundles
+    c.Expect(ok, Equals, true)
+    _, ok = <-remote_bundles
+    c.Expect(ok, Equals, false)
+  })
+
+  c.Specify("Auditor reports engines whose checksums don't match ours.", func() {
+    checksums := make(chan core.FrameChecksum)
+    desyncs := make(chan core.Desync, 10)
+    auditor.Checksums = checksums
+    auditor.Desyncs = desyncs
+    auditor.Start()
+    checksums <- core.FrameChecksum{Id: 2, Frame: 5, Checksum: 1}
+    checksums <- core.FrameChecksum{Id: 3, Frame: 5, Checksum: 2}
+    checksums <- core.FrameChecksum{Id: 1, Frame: 5, Checksum: 1}
+    checksums <- core.FrameChecksum{Id: 4, Frame: 5, Checksum: 3}
+    checksums <- core.FrameChecksum{Id: 2, Frame: 5, Checksum: 1}
+    checksums <- core.FrameChecksum{Id: 3, Frame: 6, Checksum: 2}
+
+    // Make sure the last checksum has been processed.
+    local_frames <- 1
+    c.Assume(len(desyncs), Equals, 2)
+    c.Expect(<-desyncs, Equals, core.Desync{Frame: 5, Engines: []core.EngineId{3}})
+    c.Expect(<-desyncs, Equals, core.Desync{Frame: 5, Engines: []core.EngineId{4}})
+  })
+}
+
+// Runs an Auditor for the specified number of frames while a remote engine
+// sends bundles lead frames ahead of us, returns the total of all of the
+// clock adjustments it made.
+func runClockSync(params core.EngineParams, frames int, lead core.StateFrame) int64 {
+  raw_remote_bundles := make(chan core.FrameBundle)
+  remote_bundles := make(chan core.FrameBundle, frames+1)
+  local_frames := make(chan core.StateFrame)
+  time_delta := make(chan int64, frames+1)
+  var auditor core.Auditor
+  auditor.Params = params
+  auditor.Raw_remote_bundles = raw_remote_bundles
+  auditor.Remote_bundles = remote_bundles
+  auditor.Local_frames = local_frames
+  auditor.Time_delta = time_delta
+  auditor.Max_slew_ms = 100
+  auditor.Start()
+  for frame := core.StateFrame(1); frame <= core.StateFrame(frames); frame++ {
+    raw_remote_bundles <- core.FrameBundle{
+      Frame:  frame + lead,
+      Bundle: core.EventBundle{2: core.AllEvents{}},
+    }
+    local_frames <- frame
+  }
+  // Make sure the last frame has been processed.
+  local_frames <- core.StateFrame(frames)
+  var total int64
+  for len(time_delta) > 0 {
+    total += <-time_delta
+  }
+  return total
+}
+
+func AuditorClockSpec(c gospec.Context) {
+  var params core.EngineParams
+  params.Id = 1
+  params.Frame_ms = 5
+  params.Max_frames = 100
+  c.Specify("Auditor speeds up the clock when remote engines are ahead.", func() {
+    total := runClockSync(params, 40, 4)
+    c.Expect(total > 0, Equals, true)
+
+    // Max slew is 100ms per second, and we ran for 40 * 5ms.
+    c.Expect(total <= 20, Equals, true)
+  })
+  c.Specify("Auditor slows down the clock when remote engines are behind.", func() {
+    total := runClockSync(params, 40, -4)
+    c.Expect(total < 0, Equals, true)
+    c.Expect(total >= -20, Equals, true)
+  })
+  c.Specify("Auditor leaves the clock alone when in sync.", func() {
+    total := runClockSync(params, 40, 0)
+    c.Expect(total, Equals, int64(0))
+  })
 }
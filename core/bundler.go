@@ -21,29 +21,112 @@ type Bundler struct {
   Time_delta <-chan int64
 
   // Bundles of events generated locally.  These are packaged up and sent to
-  // the updater when they are ready.
+  // the updater when they are ready.  Events are bundled for the frame that is
+  // Params.Delay frames after the current one, so there are no bundles for
+  // the first Params.Delay frames.
   Local_bundles chan<- FrameBundle
 
+  // Whenever the delay changes the Updater sends the new delay here.  This can
+  // safely be left as nil.
+  Delays <-chan StateFrame
+
+  // The Updater reports every EnginePaused and EngineResumed it sees here, so
+  // that every Bundler stops sending bundles after the same frame.  This can
+  // safely be left as nil.
+  Pause_changes <-chan PauseChange
+
+  // The Updater sends the last frame that it has room for here whenever it
+  // changes.  Rather than send a bundle past it the Bundler stalls until there
+  // is room, just like it does while the game is paused.  This can safely be
+  // left as nil.
+  Frame_limits <-chan StateFrame
+
   Current_ms int64
 
   shutdown chan struct{}
+  done     chan struct{}
 }
 
 func (b *Bundler) Start() {
   b.shutdown = make(chan struct{})
+  b.done = make(chan struct{})
   go b.routine()
 }
 
 func (b *Bundler) routine() {
   b.Ticker.Start()
   current_frame := StateFrame(b.Current_ms / b.Params.Frame_ms)
+  delay := b.Params.Delay
+
+  // The most recent frame that we've sent a bundle for.  If the delay goes
+  // down we can't send anything until we're past it again.
+  last_frame := StateFrame(-1)
+
+  // While the game is paused we don't send bundles for any frame after
+  // stop_after, once we get there we are stopped until the game resumes.
+  // stop_after is -1 if the game isn't paused.  Pauses and resumes from
+  // before the most recent one we know about are ignored.
+  stop_after := StateFrame(-1)
+  stopped := false
+  pause_frame := StateFrame(-1)
+  resume_frame := StateFrame(-1)
+
+  // We don't send bundles for any frame after limit, -1 if there is no limit.
+  // stalled is true while we're waiting for it to go up.
+  limit := StateFrame(-1)
+  stalled := false
+
   var current_events []Event
   var current_engine_events []EngineEvent
+  send := func(frame StateFrame) {
+    for i, event := range current_engine_events {
+      if paused, ok := event.(EnginePaused); ok {
+        // Nobody can have sent bundles more than Max_frames past this frame,
+        // so everyone can stop there.
+        paused.Last_frame = frame + StateFrame(b.Params.Max_frames)
+        current_engine_events[i] = paused
+      }
+    }
+    last_frame = frame
+    b.Local_bundles <- FrameBundle{
+      Frame: frame,
+      Bundle: EventBundle{
+        b.Params.Id: AllEvents{
+          Game:   current_events,
+          Engine: current_engine_events,
+        },
+      },
+    }
+    current_events = nil
+    current_engine_events = nil
+  }
+
+  // Starts sending bundles again from the frame after the last one we sent.
+  resume := func() {
+    stop_after = -1
+    if !stopped {
+      return
+    }
+    stopped = false
+    current_frame = last_frame + 1 - delay
+    b.Current_ms = int64(current_frame) * b.Params.Frame_ms
+  }
+
   for {
     select {
     case <-b.shutdown:
-      // TODO: Drain channels and free stuff up?
+      // Events that came in after the last bundle go out on the frame they
+      // would have gone out on anyway, otherwise nobody would ever see them.
+      if len(current_events) > 0 || len(current_engine_events) > 0 {
+        frame := current_frame + delay
+        if frame <= last_frame {
+          frame = last_frame + 1
+        }
+        send(frame)
+      }
       close(b.Local_bundles)
+      b.Ticker.Stop()
+      close(b.done)
       return
 
     case event := <-b.Local_event:
@@ -54,30 +137,73 @@ func (b *Bundler) routine() {
       // is this important
       // b.engine_event_frame <- current_frame
       current_engine_events = append(current_engine_events, engine_event)
+      if _, ok := engine_event.(EngineResumed); ok && stopped {
+        // Everyone else is waiting on us, so this goes out right away.
+        resume()
+        resume_frame = last_frame + 1
+        send(last_frame + 1)
+        current_frame++
+        b.Current_ms = int64(current_frame) * b.Params.Frame_ms
+      }
 
     case <-b.Ticker.Chan():
+      if stopped || stalled {
+        break
+      }
       b.Current_ms++
       next_frame := StateFrame(b.Current_ms / b.Params.Frame_ms)
       for ; current_frame < next_frame; current_frame++ {
-        b.Local_bundles <- FrameBundle{
-          Frame: current_frame,
-          Bundle: EventBundle{
-            b.Params.Id: AllEvents{
-              Game:   current_events,
-              Engine: current_engine_events,
-            },
-          },
+        frame := current_frame + delay
+        if frame <= last_frame {
+          // Anything we have waits for the next frame that we haven't already
+          // sent a bundle for.
+          continue
+        }
+        if stop_after >= 0 && frame > stop_after {
+          stopped = true
+          break
+        }
+        if limit >= 0 && frame > limit {
+          // Our clock stays on this frame until the Updater has room for it.
+          stalled = true
+          b.Current_ms = int64(current_frame) * b.Params.Frame_ms
+          break
         }
-        current_events = nil
-        current_engine_events = nil
+        send(frame)
       }
 
     case delta := <-b.Time_delta:
       b.Current_ms += delta
+
+    case delay = <-b.Delays:
+
+    case limit = <-b.Frame_limits:
+      if stalled && current_frame+delay <= limit {
+        stalled = false
+      }
+
+    case change := <-b.Pause_changes:
+      if change.Paused && change.Frame > resume_frame {
+        pause_frame = change.Frame
+        stop_after = change.Last_frame
+        if last_frame > stop_after {
+          // We're already past where we should have stopped, the best we can
+          // do is stop now.
+          stop_after = last_frame
+        }
+      }
+      if !change.Paused && change.Frame > pause_frame {
+        resume_frame = change.Frame
+        resume()
+      }
     }
   }
 }
 
+// Sends a final bundle if there are any events that haven't been bundled yet,
+// then closes Local_bundles and stops the Ticker.  Returns once the Bundler
+// is completely stopped.
 func (b *Bundler) Shutdown() {
   b.shutdown <- struct{}{}
+  <-b.done
 }
@@ -42,7 +42,8 @@ func BundlerSpec(c gospec.Context) {
     }()
     var frame core.StateFrame = 0
     for bundle := range bundles {
-      c.Expect(bundle.Frame, Equals, frame)
+      // Everything goes out Delay frames after it happened.
+      c.Expect(bundle.Frame, Equals, frame+params.Delay)
       events, ok := bundle.Bundle[params.Id]
       c.Assume(ok, Equals, true)
       c.Expect(len(events.Engine), Equals, 0)
@@ -73,4 +74,148 @@ func BundlerSpec(c gospec.Context) {
       frame++
     }
   })
+  c.Specify("Bundler sends unbundled events when it shuts down.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Frame_ms = 5
+    params.Max_frames = 25
+    bundles := make(chan core.FrameBundle)
+    local_event := make(chan core.Event)
+    local_engine_event := make(chan core.EngineEvent)
+    var bundler core.Bundler
+    bundler.Params = params
+    bundler.Local_bundles = bundles
+    bundler.Local_event = local_event
+    bundler.Local_engine_event = local_engine_event
+    ticker := &core.FakeTicker{}
+    ticker.Start()
+    bundler.Ticker = ticker
+    bundler.Start()
+    go func() {
+      ticker.Inc(5)
+      local_event <- EventA{1}
+      local_engine_event <- core.EngineDropped{Id: params.Id}
+      bundler.Shutdown()
+    }()
+    var got []core.FrameBundle
+    for bundle := range bundles {
+      got = append(got, bundle)
+    }
+    c.Assume(len(got), Equals, 2)
+    c.Expect(got[1].Frame, Equals, core.StateFrame(1))
+    c.Expect(len(got[1].Bundle[params.Id].Game), Equals, 1)
+    c.Expect(len(got[1].Bundle[params.Id].Engine), Equals, 1)
+  })
+
+  c.Specify("Bundler follows changes to the delay.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Delay = 2
+    params.Frame_ms = 5
+    params.Max_frames = 25
+    bundles := make(chan core.FrameBundle)
+    local_event := make(chan core.Event)
+    delays := make(chan core.StateFrame)
+    var bundler core.Bundler
+    bundler.Params = params
+    bundler.Local_bundles = bundles
+    bundler.Local_event = local_event
+    bundler.Delays = delays
+    ticker := &core.FakeTicker{}
+    ticker.Start()
+    bundler.Ticker = ticker
+    bundler.Start()
+    go func() {
+      ticker.Inc(5)
+      delays <- 4
+      ticker.Inc(5)
+      delays <- 1
+      local_event <- EventA{1}
+      ticker.Inc(20)
+      bundler.Shutdown()
+    }()
+    var got []core.FrameBundle
+    for bundle := range bundles {
+      got = append(got, bundle)
+    }
+    // Once the delay goes down nothing goes out until we're past the frames
+    // that we've already sent bundles for.
+    c.Assume(len(got), Equals, 3)
+    c.Expect(got[0].Frame, Equals, core.StateFrame(2))
+    c.Expect(got[1].Frame, Equals, core.StateFrame(5))
+    c.Expect(got[2].Frame, Equals, core.StateFrame(6))
+    c.Expect(len(got[2].Bundle[params.Id].Game), Equals, 1)
+  })
+
+  c.Specify("Bundler stops while the game is paused.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Frame_ms = 5
+    params.Max_frames = 3
+    bundles := make(chan core.FrameBundle)
+    local_engine_event := make(chan core.EngineEvent)
+    pause_changes := make(chan core.PauseChange)
+    var bundler core.Bundler
+    bundler.Params = params
+    bundler.Local_bundles = bundles
+    bundler.Local_engine_event = local_engine_event
+    bundler.Pause_changes = pause_changes
+    ticker := &core.FakeTicker{}
+    ticker.Start()
+    bundler.Ticker = ticker
+    bundler.Start()
+    go func() {
+      local_engine_event <- core.EnginePaused{}
+      ticker.Inc(5)
+      pause_changes <- core.PauseChange{Frame: 0, Paused: true, Last_frame: 3}
+      ticker.Inc(50)
+      local_engine_event <- core.EngineResumed{}
+      ticker.Inc(5)
+      bundler.Shutdown()
+    }()
+    var got []core.FrameBundle
+    for bundle := range bundles {
+      got = append(got, bundle)
+    }
+    c.Assume(len(got), Equals, 6)
+    for i := range got {
+      c.Expect(got[i].Frame, Equals, core.StateFrame(i))
+    }
+    c.Assume(len(got[0].Bundle[params.Id].Engine), Equals, 1)
+    c.Expect(got[0].Bundle[params.Id].Engine[0], Equals, core.EngineEvent(core.EnginePaused{Last_frame: 3}))
+    c.Assume(len(got[4].Bundle[params.Id].Engine), Equals, 1)
+    c.Expect(got[4].Bundle[params.Id].Engine[0], Equals, core.EngineEvent(core.EngineResumed{}))
+  })
+
+  c.Specify("Bundler stalls rather than go past the frame limit.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Frame_ms = 5
+    params.Max_frames = 3
+    bundles := make(chan core.FrameBundle)
+    frame_limits := make(chan core.StateFrame)
+    var bundler core.Bundler
+    bundler.Params = params
+    bundler.Local_bundles = bundles
+    bundler.Frame_limits = frame_limits
+    ticker := &core.FakeTicker{}
+    ticker.Start()
+    bundler.Ticker = ticker
+    bundler.Start()
+    go func() {
+      frame_limits <- 3
+      ticker.Inc(50)
+      frame_limits <- 6
+      ticker.Inc(50)
+      bundler.Shutdown()
+    }()
+    var got []core.FrameBundle
+    for bundle := range bundles {
+      got = append(got, bundle)
+    }
+    c.Assume(len(got), Equals, 7)
+    for i := range got {
+      c.Expect(got[i].Frame, Equals, core.StateFrame(i))
+    }
+  })
 }
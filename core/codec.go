@@ -0,0 +1,543 @@
+package core
+
+import (
+  "bytes"
+  "encoding"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "math"
+  "reflect"
+  "sort"
+)
+
+// A Codec turns FrameBundles into bytes and back again, it is what a Network
+// that implements CodecNetwork uses to send bundles.  Every engine in a game
+// must use the same kind of Codec, set up the same way.
+type Codec interface {
+  EncodeBundle(bundle FrameBundle) ([]byte, error)
+  DecodeBundle(data []byte) (FrameBundle, error)
+}
+
+// Encodes bundles as self-contained gobs, which means every Event has to be
+// registered with gob.Register.  This is what Networks use if they aren't
+// given a Codec.
+type GobCodec struct{}
+
+func (GobCodec) EncodeBundle(bundle FrameBundle) ([]byte, error) {
+  return QuickGobEncode(bundle)
+}
+
+func (GobCodec) DecodeBundle(data []byte) (FrameBundle, error) {
+  var bundle FrameBundle
+  err := QuickGobDecode(&bundle, data)
+  return bundle, err
+}
+
+// Tags below this are reserved for the EngineEvents in this package.
+const FirstEventTag = 16
+
+var (
+  ErrCodecMalformed = errors.New("Encoded bundle is malformed.")
+)
+
+// Slices of zero-sized elements, like []struct{}, take up no space no matter
+// how long they are, so their length can't be checked against the data that's
+// left.  They are limited to this many elements instead.
+const maxZeroSizeElements = 1 << 16
+
+var (
+  binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+  binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// Encodes bundles compactly, without any of the type information that gob
+// sends along.  Instead every type of Event has to be registered with a
+// numeric tag, and every engine in a game has to register the same types with
+// the same tags.  The EngineEvents in this package are registered already.
+//
+// An encoded bundle looks like:
+//   varint:  frame
+//   uvarint: number of engines
+// followed by each engine, in order of ascending id:
+//   varint:  engine id
+//   uvarint: number of Events, followed by each Event
+//   uvarint: number of EngineEvents, followed by each EngineEvent
+// Each event is its uvarint tag followed by its value, a tag of 0 is a nil
+// event.  Values are encoded according to their kind:
+//   bools:               1 byte
+//   signed integers:     varint
+//   unsigned integers:   uvarint
+//   floats:              4 or 8 bytes, big-endian
+//   strings:             uvarint length followed by the bytes
+//   slices:              uvarint length followed by each element
+//   arrays:              each element
+//   maps:                uvarint length followed by each key and value,
+//                        sorted by the encoded keys so that equal maps
+//                        always encode the same way
+//   structs:             each exported field in order, like gob unexported
+//                        fields are skipped
+//   pointers:            1 byte, 0 if nil, otherwise 1 followed by the value
+// Any type whose pointer implements both encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler is instead encoded as a uvarint length followed
+// by whatever MarshalBinary returns.  Other kinds, such as interfaces, can't
+// be encoded.  Like gob, empty slices and maps decode as nil.
+type BinaryCodec struct {
+  tags  map[reflect.Type]uint64
+  types map[uint64]reflect.Type
+}
+
+func NewBinaryCodec() *BinaryCodec {
+  bc := &BinaryCodec{
+    tags:  make(map[reflect.Type]uint64),
+    types: make(map[uint64]reflect.Type),
+  }
+  bc.register(1, EngineJoined{})
+  bc.register(2, EngineDropped{})
+  bc.register(3, EngineDelayChanged{})
+  bc.register(4, EnginePaused{})
+  bc.register(5, EngineResumed{})
+  return bc
+}
+
+// Registers the type of event with tag, which must be at least
+// FirstEventTag.  Events are decoded as exactly the type that was registered,
+// so if event is a pointer then so is everything decoded with its tag.  All
+// types must be registered before the codec is used.
+func (bc *BinaryCodec) Register(tag uint16, event Event) error {
+  if tag < FirstEventTag {
+    return errors.New(fmt.Sprintf("Event tags must be at least %d, not %d.", FirstEventTag, tag))
+  }
+  if event == nil {
+    return errors.New("Cannot register a nil event.")
+  }
+  return bc.register(uint64(tag), event)
+}
+
+func (bc *BinaryCodec) register(tag uint64, value interface{}) error {
+  t := reflect.TypeOf(value)
+  if other, ok := bc.types[tag]; ok {
+    return errors.New(fmt.Sprintf("Tag %d is already used by %v.", tag, other))
+  }
+  if other, ok := bc.tags[t]; ok {
+    return errors.New(fmt.Sprintf("%v is already registered with tag %d.", t, other))
+  }
+  bc.tags[t] = tag
+  bc.types[tag] = t
+  return nil
+}
+
+func (bc *BinaryCodec) EncodeBundle(bundle FrameBundle) ([]byte, error) {
+  buf := binary.AppendVarint(nil, int64(bundle.Frame))
+  buf = binary.AppendUvarint(buf, uint64(len(bundle.Bundle)))
+  var err error
+  for _, id := range bundle.Bundle.sortedIds() {
+    events := bundle.Bundle[id]
+    buf = binary.AppendVarint(buf, int64(id))
+    buf = binary.AppendUvarint(buf, uint64(len(events.Game)))
+    for _, event := range events.Game {
+      buf, err = bc.appendEvent(buf, event)
+      if err != nil {
+        return nil, err
+      }
+    }
+    buf = binary.AppendUvarint(buf, uint64(len(events.Engine)))
+    for _, event := range events.Engine {
+      buf, err = bc.appendEvent(buf, event)
+      if err != nil {
+        return nil, err
+      }
+    }
+  }
+  return buf, nil
+}
+
+func (bc *BinaryCodec) DecodeBundle(data []byte) (FrameBundle, error) {
+  var bundle FrameBundle
+  r := binaryReader{data: data}
+  bundle.Frame = StateFrame(r.varint())
+  engines := r.count()
+  if r.err != nil {
+    return FrameBundle{}, r.err
+  }
+  if engines > 0 {
+    bundle.Bundle = make(EventBundle)
+  }
+  for i := uint64(0); i < engines; i++ {
+    id := EngineId(r.varint())
+    var events AllEvents
+    events.Game = make([]Event, int(r.count()))
+    for j := range events.Game {
+      value := bc.readEvent(&r)
+      if value == nil {
+        continue
+      }
+      event, ok := value.(Event)
+      if !ok {
+        return FrameBundle{}, errors.New(fmt.Sprintf("%T is not an Event.", value))
+      }
+      events.Game[j] = event
+    }
+    events.Engine = make([]EngineEvent, int(r.count()))
+    for j := range events.Engine {
+      value := bc.readEvent(&r)
+      if value == nil {
+        continue
+      }
+      event, ok := value.(EngineEvent)
+      if !ok {
+        return FrameBundle{}, errors.New(fmt.Sprintf("%T is not an EngineEvent.", value))
+      }
+      events.Engine[j] = event
+    }
+    if r.err != nil {
+      return FrameBundle{}, r.err
+    }
+    bundle.Bundle[id] = events
+  }
+  if len(r.data) > 0 {
+    return FrameBundle{}, ErrCodecMalformed
+  }
+  return bundle, nil
+}
+
+func (bc *BinaryCodec) appendEvent(buf []byte, event interface{}) ([]byte, error) {
+  if event == nil {
+    return binary.AppendUvarint(buf, 0), nil
+  }
+  v := reflect.ValueOf(event)
+  tag, ok := bc.tags[v.Type()]
+  if !ok {
+    return nil, errors.New(fmt.Sprintf("%v has not been registered with the codec.", v.Type()))
+  }
+  buf = binary.AppendUvarint(buf, tag)
+  if v.Kind() == reflect.Ptr {
+    if v.IsNil() {
+      return nil, errors.New(fmt.Sprintf("Cannot encode a nil %v.", v.Type()))
+    }
+    v = v.Elem()
+  }
+  return appendValue(buf, v)
+}
+
+// Returns nil if the event is nil or if there was an error, in which case
+// r.err is set.
+func (bc *BinaryCodec) readEvent(r *binaryReader) interface{} {
+  tag := r.uvarint()
+  if r.err != nil || tag == 0 {
+    return nil
+  }
+  t, ok := bc.types[tag]
+  if !ok {
+    r.fail(errors.New(fmt.Sprintf("Unknown event tag %d.", tag)))
+    return nil
+  }
+  if t.Kind() == reflect.Ptr {
+    v := reflect.New(t.Elem())
+    r.value(v.Elem())
+    return v.Interface()
+  }
+  v := reflect.New(t).Elem()
+  r.value(v)
+  return v.Interface()
+}
+
+func usesBinaryMarshaler(t reflect.Type) bool {
+  p := reflect.PtrTo(t)
+  return p.Implements(binaryMarshalerType) && p.Implements(binaryUnmarshalerType)
+}
+
+func appendValue(buf []byte, v reflect.Value) ([]byte, error) {
+  if usesBinaryMarshaler(v.Type()) {
+    if !v.CanAddr() {
+      p := reflect.New(v.Type())
+      p.Elem().Set(v)
+      v = p.Elem()
+    }
+    data, err := v.Addr().Interface().(encoding.BinaryMarshaler).MarshalBinary()
+    if err != nil {
+      return nil, err
+    }
+    buf = binary.AppendUvarint(buf, uint64(len(data)))
+    return append(buf, data...), nil
+  }
+  var err error
+  switch v.Kind() {
+  case reflect.Bool:
+    if v.Bool() {
+      return append(buf, 1), nil
+    }
+    return append(buf, 0), nil
+
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return binary.AppendVarint(buf, v.Int()), nil
+
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+    return binary.AppendUvarint(buf, v.Uint()), nil
+
+  case reflect.Float32:
+    return binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+
+  case reflect.Float64:
+    return binary.BigEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+
+  case reflect.String:
+    buf = binary.AppendUvarint(buf, uint64(v.Len()))
+    return append(buf, v.String()...), nil
+
+  case reflect.Slice:
+    if v.Type().Elem().Size() == 0 && v.Len() > maxZeroSizeElements {
+      return nil, errors.New(fmt.Sprintf("Cannot encode more than %d elements of type %v.", maxZeroSizeElements, v.Type().Elem()))
+    }
+    buf = binary.AppendUvarint(buf, uint64(v.Len()))
+    if v.Type().Elem().Kind() == reflect.Uint8 && !usesBinaryMarshaler(v.Type().Elem()) {
+      return append(buf, v.Bytes()...), nil
+    }
+    fallthrough
+
+  case reflect.Array:
+    for i := 0; i < v.Len(); i++ {
+      buf, err = appendValue(buf, v.Index(i))
+      if err != nil {
+        return nil, err
+      }
+    }
+    return buf, nil
+
+  case reflect.Map:
+    buf = binary.AppendUvarint(buf, uint64(v.Len()))
+    // Maps iterate in a random order, so the entries are sorted by their
+    // encoded keys, otherwise equal bundles wouldn't have equal encodings.
+    var entries [][]byte
+    iter := v.MapRange()
+    for iter.Next() {
+      entry, err := appendValue(nil, iter.Key())
+      if err != nil {
+        return nil, err
+      }
+      entry, err = appendValue(entry, iter.Value())
+      if err != nil {
+        return nil, err
+      }
+      entries = append(entries, entry)
+    }
+    // Keys are distinct, and no encoded key is a prefix of another, so
+    // comparing whole entries orders them by their keys.
+    sort.Slice(entries, func(i, j int) bool {
+      return bytes.Compare(entries[i], entries[j]) < 0
+    })
+    for _, entry := range entries {
+      buf = append(buf, entry...)
+    }
+    return buf, nil
+
+  case reflect.Struct:
+    t := v.Type()
+    for i := 0; i < v.NumField(); i++ {
+      if t.Field(i).PkgPath != "" {
+        continue
+      }
+      buf, err = appendValue(buf, v.Field(i))
+      if err != nil {
+        return nil, err
+      }
+    }
+    return buf, nil
+
+  case reflect.Ptr:
+    if v.IsNil() {
+      return append(buf, 0), nil
+    }
+    return appendValue(append(buf, 1), v.Elem())
+  }
+  return nil, errors.New(fmt.Sprintf("Cannot encode values of type %v.", v.Type()))
+}
+
+// Reads values encoded by appendValue.  Once anything goes wrong err is set
+// and everything after that reads as zero.
+type binaryReader struct {
+  data []byte
+  err  error
+}
+
+func (r *binaryReader) fail(err error) {
+  if r.err == nil {
+    r.err = err
+  }
+  r.data = nil
+}
+
+func (r *binaryReader) uvarint() uint64 {
+  if r.err != nil {
+    return 0
+  }
+  x, n := binary.Uvarint(r.data)
+  if n <= 0 {
+    r.fail(ErrCodecMalformed)
+    return 0
+  }
+  r.data = r.data[n:]
+  return x
+}
+
+func (r *binaryReader) varint() int64 {
+  if r.err != nil {
+    return 0
+  }
+  x, n := binary.Varint(r.data)
+  if n <= 0 {
+    r.fail(ErrCodecMalformed)
+    return 0
+  }
+  r.data = r.data[n:]
+  return x
+}
+
+// Reads a length that is about to be used to make something.  Every element
+// takes at least a byte, other than zero-sized ones which don't need any
+// memory, so anything longer than what's left is malformed.  This way a bad
+// length can't make us allocate a huge amount of memory.
+func (r *binaryReader) count() uint64 {
+  n := r.uvarint()
+  if n > uint64(len(r.data)) {
+    r.fail(ErrCodecMalformed)
+    return 0
+  }
+  return n
+}
+
+func (r *binaryReader) bytes(n int) []byte {
+  if r.err != nil {
+    return nil
+  }
+  if n > len(r.data) {
+    r.fail(ErrCodecMalformed)
+    return nil
+  }
+  b := r.data[0:n]
+  r.data = r.data[n:]
+  return b
+}
+
+// Reads a value into v, which must be settable.
+func (r *binaryReader) value(v reflect.Value) {
+  if r.err != nil {
+    return
+  }
+  if usesBinaryMarshaler(v.Type()) {
+    data := r.bytes(int(r.count()))
+    if r.err != nil {
+      return
+    }
+    err := v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+    if err != nil {
+      r.fail(err)
+    }
+    return
+  }
+  switch v.Kind() {
+  case reflect.Bool:
+    b := r.bytes(1)
+    if r.err == nil {
+      v.SetBool(b[0] != 0)
+    }
+
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    x := r.varint()
+    if v.OverflowInt(x) {
+      r.fail(ErrCodecMalformed)
+      return
+    }
+    v.SetInt(x)
+
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+    x := r.uvarint()
+    if v.OverflowUint(x) {
+      r.fail(ErrCodecMalformed)
+      return
+    }
+    v.SetUint(x)
+
+  case reflect.Float32:
+    b := r.bytes(4)
+    if r.err == nil {
+      v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))))
+    }
+
+  case reflect.Float64:
+    b := r.bytes(8)
+    if r.err == nil {
+      v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+    }
+
+  case reflect.String:
+    v.SetString(string(r.bytes(int(r.count()))))
+
+  case reflect.Slice:
+    var n int
+    if v.Type().Elem().Size() == 0 {
+      count := r.uvarint()
+      if count > maxZeroSizeElements {
+        r.fail(ErrCodecMalformed)
+        return
+      }
+      n = int(count)
+    } else {
+      n = int(r.count())
+    }
+    if r.err != nil || n <= 0 {
+      return
+    }
+    if v.Type().Elem().Kind() == reflect.Uint8 && !usesBinaryMarshaler(v.Type().Elem()) {
+      b := r.bytes(n)
+      s := reflect.MakeSlice(v.Type(), n, n)
+      reflect.Copy(s, reflect.ValueOf(b))
+      v.Set(s)
+      return
+    }
+    v.Set(reflect.MakeSlice(v.Type(), n, n))
+    for i := 0; i < n; i++ {
+      r.value(v.Index(i))
+    }
+
+  case reflect.Array:
+    for i := 0; i < v.Len(); i++ {
+      r.value(v.Index(i))
+    }
+
+  case reflect.Map:
+    n := int(r.count())
+    if r.err != nil || n == 0 {
+      return
+    }
+    v.Set(reflect.MakeMapWithSize(v.Type(), n))
+    for i := 0; i < n && r.err == nil; i++ {
+      key := reflect.New(v.Type().Key()).Elem()
+      r.value(key)
+      val := reflect.New(v.Type().Elem()).Elem()
+      r.value(val)
+      v.SetMapIndex(key, val)
+    }
+
+  case reflect.Struct:
+    t := v.Type()
+    for i := 0; i < v.NumField(); i++ {
+      if t.Field(i).PkgPath != "" {
+        continue
+      }
+      r.value(v.Field(i))
+    }
+
+  case reflect.Ptr:
+    b := r.bytes(1)
+    if r.err != nil || b[0] == 0 {
+      return
+    }
+    p := reflect.New(v.Type().Elem())
+    r.value(p.Elem())
+    v.Set(p)
+
+  default:
+    r.fail(errors.New(fmt.Sprintf("Cannot decode values of type %v.", v.Type())))
+  }
+}
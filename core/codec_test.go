@@ -0,0 +1,223 @@
+package core_test
+
+import (
+  "encoding/gob"
+  "fmt"
+  "github.com/orfjackal/gospec/src/gospec"
+  . "github.com/orfjackal/gospec/src/gospec"
+  "github.com/runningwild/core"
+)
+
+type codecPoint struct {
+  X, Y float32
+}
+
+// Exercises most of the kinds that BinaryCodec can encode.
+type EventC struct {
+  Id     int64
+  Count  uint8
+  Ok     bool
+  Scale  float64
+  Name   string
+  Path   []codecPoint
+  Raw    []byte
+  Corner [2]codecPoint
+  Owners map[string]int
+  Target *codecPoint
+  hidden int
+}
+
+// Its elements take up no space, however many of them there are.
+type EventZ struct {
+  Marks []struct{}
+}
+
+func init() {
+  gob.Register(&EventC{})
+}
+func (e *EventC) ApplyFirst(interface{}) {}
+func (e *EventC) Apply(interface{})      {}
+func (e *EventC) ApplyFinal(interface{}) {}
+func (e EventZ) ApplyFirst(interface{})  {}
+func (e EventZ) Apply(interface{})       {}
+func (e EventZ) ApplyFinal(interface{})  {}
+
+func newBinaryCodec(c gospec.Context) *core.BinaryCodec {
+  codec := core.NewBinaryCodec()
+  c.Assume(codec.Register(core.FirstEventTag, EventA{}), Equals, error(nil))
+  c.Assume(codec.Register(core.FirstEventTag+1, EventB{}), Equals, error(nil))
+  c.Assume(codec.Register(core.FirstEventTag+2, &EventC{}), Equals, error(nil))
+  return codec
+}
+
+func CodecSpec(c gospec.Context) {
+  event_c := &EventC{
+    Id:     -12345678901,
+    Count:  200,
+    Ok:     true,
+    Scale:  0.25,
+    Name:   "monkeys",
+    Path:   []codecPoint{{1, 2}, {3, 4}},
+    Raw:    []byte{0, 1, 2},
+    Corner: [2]codecPoint{{5, 6}, {7, 8}},
+    Owners: map[string]int{"a": 1, "b": -2},
+    Target: &codecPoint{9, 10},
+    hidden: 11,
+  }
+  bundle := core.FrameBundle{
+    Frame: 300,
+    Bundle: core.EventBundle{
+      3: core.AllEvents{
+        Game:   []core.Event{EventA{5}, EventB{"foo"}, event_c},
+        Engine: []core.EngineEvent{core.EngineJoined{Id: 4}, core.EngineResumed{}},
+      },
+      1<<40 + 7: core.AllEvents{
+        Engine: []core.EngineEvent{core.EngineDropped{Id: 3, Last_frame: 299}},
+      },
+    },
+  }
+
+  for _, codec := range []core.Codec{core.GobCodec{}, newBinaryCodec(c)} {
+    c.Specify(fmt.Sprintf("Bundles survive being encoded and decoded by %T.", codec), func() {
+      data, err := codec.EncodeBundle(bundle)
+      c.Assume(err, Equals, error(nil))
+      decoded, err := codec.DecodeBundle(data)
+      c.Assume(err, Equals, error(nil))
+      c.Expect(decoded.Frame, Equals, bundle.Frame)
+      c.Assume(len(decoded.Bundle), Equals, 2)
+      events := decoded.Bundle[3]
+      c.Assume(len(events.Game), Equals, 3)
+      c.Expect(events.Game[0], Equals, core.Event(EventA{5}))
+      c.Expect(events.Game[1], Equals, core.Event(EventB{"foo"}))
+      got, ok := events.Game[2].(*EventC)
+      c.Assume(ok, Equals, true)
+      want := *event_c
+      want.hidden = 0
+      c.Expect(*got, Equals, want)
+      c.Expect(events.Engine, Equals, []core.EngineEvent{core.EngineJoined{Id: 4}, core.EngineResumed{}})
+      c.Expect(decoded.Bundle[1<<40+7].Engine, Equals, []core.EngineEvent{core.EngineDropped{Id: 3, Last_frame: 299}})
+    })
+  }
+
+  c.Specify("BinaryCodec is smaller than gob.", func() {
+    gob_data, err := core.GobCodec{}.EncodeBundle(bundle)
+    c.Assume(err, Equals, error(nil))
+    binary_data, err := newBinaryCodec(c).EncodeBundle(bundle)
+    c.Assume(err, Equals, error(nil))
+    c.Expect(len(binary_data) < len(gob_data)/2, Equals, true)
+  })
+
+  c.Specify("BinaryCodec decodes empty bundles and nil events.", func() {
+    codec := newBinaryCodec(c)
+    empty := core.FrameBundle{Frame: -4}
+    data, err := codec.EncodeBundle(empty)
+    c.Assume(err, Equals, error(nil))
+    decoded, err := codec.DecodeBundle(data)
+    c.Assume(err, Equals, error(nil))
+    c.Expect(decoded.Frame, Equals, core.StateFrame(-4))
+    c.Expect(len(decoded.Bundle), Equals, 0)
+
+    data, err = codec.EncodeBundle(core.FrameBundle{
+      Bundle: core.EventBundle{1: core.AllEvents{Game: []core.Event{nil}}},
+    })
+    c.Assume(err, Equals, error(nil))
+    decoded, err = codec.DecodeBundle(data)
+    c.Assume(err, Equals, error(nil))
+    c.Expect(decoded.Bundle[1].Game, Equals, []core.Event{nil})
+  })
+
+  c.Specify("BinaryCodec won't encode events that weren't registered.", func() {
+    codec := core.NewBinaryCodec()
+    _, err := codec.EncodeBundle(bundle)
+    c.Expect(err, Not(Equals), error(nil))
+  })
+
+  c.Specify("BinaryCodec won't reuse tags or types.", func() {
+    codec := newBinaryCodec(c)
+    c.Expect(codec.Register(core.FirstEventTag, &EventA{}), Not(Equals), error(nil))
+    c.Expect(codec.Register(core.FirstEventTag+10, EventA{}), Not(Equals), error(nil))
+    c.Expect(codec.Register(core.FirstEventTag-1, &EventA{}), Not(Equals), error(nil))
+    c.Expect(codec.Register(core.FirstEventTag+10, &EventA{}), Equals, error(nil))
+  })
+
+  c.Specify("BinaryCodec rejects malformed data.", func() {
+    codec := newBinaryCodec(c)
+    data, err := codec.EncodeBundle(bundle)
+    c.Assume(err, Equals, error(nil))
+    for i := 0; i < len(data); i++ {
+      _, err := codec.DecodeBundle(data[0:i])
+      c.Expect(err, Not(Equals), error(nil))
+    }
+    _, err = codec.DecodeBundle(append(data, 0))
+    c.Expect(err, Equals, core.ErrCodecMalformed)
+
+    // An absurd number of engines.
+    _, err = codec.DecodeBundle([]byte{0, 0xff, 0xff, 0xff, 0xff, 0x0f})
+    c.Expect(err, Equals, core.ErrCodecMalformed)
+
+    // A tag that nothing was registered with.
+    _, err = codec.DecodeBundle([]byte{0, 1, 2, 1, 100, 0})
+    c.Expect(err, Not(Equals), error(nil))
+  })
+
+  c.Specify("BinaryCodec encodes equal maps the same way.", func() {
+    codec := newBinaryCodec(c)
+    owners := make(map[string]int)
+    for i := 0; i < 50; i++ {
+      owners[fmt.Sprintf("owner%d", i)] = i
+    }
+    encode := func() []byte {
+      data, err := codec.EncodeBundle(core.FrameBundle{
+        Bundle: core.EventBundle{1: core.AllEvents{Game: []core.Event{&EventC{Owners: owners}}}},
+      })
+      c.Assume(err, Equals, error(nil))
+      return data
+    }
+    first := encode()
+    for i := 0; i < 10; i++ {
+      c.Expect(string(encode()), Equals, string(first))
+    }
+  })
+
+  c.Specify("BinaryCodec limits slices of zero-sized elements.", func() {
+    codec := newBinaryCodec(c)
+    c.Assume(codec.Register(core.FirstEventTag+3, EventZ{}), Equals, error(nil))
+    data, err := codec.EncodeBundle(core.FrameBundle{
+      Bundle: core.EventBundle{1: core.AllEvents{Game: []core.Event{EventZ{make([]struct{}, 3)}}}},
+    })
+    c.Assume(err, Equals, error(nil))
+    decoded, err := codec.DecodeBundle(data)
+    c.Assume(err, Equals, error(nil))
+    c.Expect(decoded.Bundle[1].Game, Equals, []core.Event{EventZ{make([]struct{}, 3)}})
+
+    _, err = codec.EncodeBundle(core.FrameBundle{
+      Bundle: core.EventBundle{1: core.AllEvents{Game: []core.Event{EventZ{make([]struct{}, 1<<20)}}}},
+    })
+    c.Expect(err, Not(Equals), error(nil))
+
+    // One engine with one EventZ that claims to have 2^62 marks.
+    tag := byte(core.FirstEventTag + 3)
+    _, err = codec.DecodeBundle([]byte{0, 1, 2, 1, tag, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x40, 0})
+    c.Expect(err, Equals, core.ErrCodecMalformed)
+  })
+
+  c.Specify("Mock conns send bundles with their host's codec.", func() {
+    var net core.NetworkMock
+    hm1 := core.NewHostMock(&net)
+    hm2 := core.NewHostMock(&net)
+    hm1.(core.CodecNetwork).SetCodec(newBinaryCodec(c))
+    hm2.(core.CodecNetwork).SetCodec(newBinaryCodec(c))
+    hm1.Host(func([]byte) ([]byte, error) { return nil, nil }, func([]byte) error { return nil })
+    rhs, _ := hm2.Ping(nil)
+    c.Assume(len(rhs), Equals, 1)
+    conn, err := hm2.Join(rhs[0], nil)
+    c.Assume(err, Equals, error(nil))
+    conn2 := <-hm1.NewConns()
+    go conn.SendFrameBundle(bundle)
+    decoded := <-conn2.RecvFrameBundle()
+    c.Expect(decoded.Frame, Equals, bundle.Frame)
+    c.Expect(len(decoded.Bundle[3].Game), Equals, 3)
+    conn.Close()
+    conn2.Close()
+  })
+}
@@ -2,7 +2,10 @@ package core
 
 import (
   // "encoding/binary"
+  "context"
+  "errors"
   "sync"
+  "time"
 )
 
 type RemoteFrameBundle struct {
@@ -10,19 +13,192 @@ type RemoteFrameBundle struct {
   conn   Conn
 }
 
+// Sent from the Communicator to the Auditor when the connection to an engine
+// dies, and from the Updater when an engine sends a bundle further ahead than
+// it could have.
+type DroppedEngine struct {
+  Id EngineId
+
+  // Why the connection died, as reported by Conn.Err(), or ErrBundleTooFar.
+  Err error
+}
+
+type remoteMessage struct {
+  msg  connMessage
+  conn Conn
+}
+
+// Once an engine has finished bootstrapping everything sent with SendData is
+// a connMessage.  Exactly one field is set.
+type connMessage struct {
+  Checksum *FrameChecksum
+
+  // Sent to the host by an engine that wants a fresh BootstrapFrame.
+  Resync_request bool
+
+  // Sent by the host in response to a Resync_request.
+  Bootstrap *BootstrapFrame
+
+  // Sent by the host to an engine once it has joined, so that it can connect
+  // straight to every other engine in the game.
+  Peers []peerAddress
+
+  // Sent by an engine to everyone it's connected to once it has taken over
+  // as host.
+  New_host bool
+
+  // Sent to the host by an engine whenever the set of engines that it's
+  // connected straight to changes.
+  Links *peerLinks
+
+  // Sent in place of a run of bundles that have no events in them, see
+  // Communicator.Empty_batch.
+  Empty *emptyFrames
+}
+
+// Engine Id had no events on any frame from First through Last.  Whoever gets
+// this treats it exactly like it got an empty bundle from Id for each of those
+// frames.
+type emptyFrames struct {
+  Id    EngineId
+  First StateFrame
+  Last  StateFrame
+}
+
+// Returns the bundles that empty stands in for, newest first.  The Auditor
+// only uses the newest bundle from each engine to keep our clock in sync, so
+// this way all of the older ones that were held back don't make the engine
+// look like it's behind.
+func (empty emptyFrames) bundles() []FrameBundle {
+  var bundles []FrameBundle
+  for frame := empty.Last; frame >= empty.First; frame-- {
+    bundles = append(bundles, FrameBundle{
+      Frame:  frame,
+      Bundle: EventBundle{empty.Id: AllEvents{}},
+    })
+  }
+  return bundles
+}
+
+// Every engine that an engine is connected straight to.  The host doesn't
+// pass along bundles from any of them to it.
+type peerLinks struct {
+  Ids []EngineId
+}
+
+// Where to find an engine that is already in the game, see PeerNetwork.
+type peerAddress struct {
+  Id   EngineId
+  Addr string
+}
+
+// Sent from dialPeer to the Communicator once it has connected to another
+// engine in the game.
+type peerConn struct {
+  conn Conn
+  id   EngineId
+}
+
+// Sent from a connRoutine to the Communicator when its conn dies.
+type deadConn struct {
+  conn Conn
+  err  error
+}
+
+// Conns are closed with these when they send something that they shouldn't
+// have, and then dropped like any other dead conn.  Spectators aren't in the
+// game to be dropped, so they are reported through Join_failed instead.
+var (
+  ErrSpectatorEvents = errors.New("Spectator sent events.")
+  ErrEmptyMalformed  = errors.New("Received a malformed run of empty bundles.")
+)
+
+// Conns that fall too far behind on what we're sending them are closed with
+// this, and then dropped like any other dead conn.
+var ErrSendQueueFull = errors.New("Too much waiting to be sent on a conn.")
+
+const DefaultSendQueue = 1024
+
+// Sent from the Communicator when an engine that was being bootstrapped never
+// made it into the game.
+type FailedJoin struct {
+  // The id that the engine would have been given, or the id of the engine
+  // that we couldn't connect straight to.
+  Id EngineId
+
+  // ErrBootstrapTimeout, ErrJoinAbandoned, or whatever killed the conn.
+  Err error
+}
+
+var (
+  ErrBootstrapTimeout = errors.New("Timed out bootstrapping a new engine.")
+  ErrJoinAbandoned    = errors.New("Joining engine gave up before it was bootstrapped.")
+)
+
+const DefaultBootstrapTimeout = 30 * time.Second
+
+type bootstrapState int
+
+const (
+  // We've sent the initial data and are waiting on the BootstrapFrame for
+  // start from the Updater.
+  bootstrapWaitingForFrame bootstrapState = iota
+
+  // We've sent the BootstrapFrame and are waiting on the engine to confirm
+  // that it got it.
+  bootstrapWaitingForConfirmation
+)
+
+// Sent from a bootstrapRoutine to the Communicator once its conn has
+// confirmed that it is ready to join the game.
+type bootstrapped struct {
+  conn      Conn
+  id        EngineId
+  spectator bool
+
+  // If this is set conn isn't joining, it's from an engine that's already in
+  // the game, and id is that engine's id.  target is the engine that it was
+  // trying to connect to, which should be us.
+  peer   bool
+  target EngineId
+}
+
 type bootstrap struct {
   conn Conn
+  id   EngineId
+
+  state bootstrapState
+
+  // If the engine hasn't joined by now it is dropped.  Resyncs don't expire.
+  deadline time.Time
 
   // The frame for which this conn should start its engine, i.e. the first
   // frame for which we sent this conn a completed frame.
   start StateFrame
+
+  // True if the engine on the other end of conn is already in the game and
+  // just wants a fresh copy of it.
+  resync bool
 }
 
 // The Communicator has the following tasks:
 // - It sends all local FrameBundles to all remote hosts.
 // - It collects all remote FrameBundles and sends them to tha auditor.
 // - It accepts new connections and bootstraps them into the game.
+// - If Net is a PeerNetwork it connects to every other engine in the game, so
+//   that bundles go straight between engines rather than through the host,
+//   and so that one of them can take over as host if the host goes away.
+//   The host still passes bundles along to engines that aren't connected
+//   straight to the engine that sent them.
+// - If Empty_batch is set, runs of local bundles with no events in them are
+//   sent as a single message, which is turned back into the same bundles
+//   before anything else sees them.
 type Communicator struct {
+  // Only Params.Id, Params.Frame_ms and Params.Max_frames are used.  An engine
+  // that joins a host should set Id to the one that Join returns before
+  // calling Start.
+  Params EngineParams
+
   Net Network
 
   // Bundles from the Updater come through here and get broadcast to all
@@ -40,19 +216,145 @@ type Communicator struct {
   // Used to send EngineEvents to the Bundler.
   Local_engine_event chan<- EngineEvent
 
+  // Every frame broadcast from this engine is also sent here, so that the
+  // Auditor knows what frame we're on.
+  Local_frames chan<- StateFrame
+
+  // When a connection dies the id of the engine on the other end of it is
+  // sent here so that the Auditor can drop it.  Only the host knows the ids
+  // of the engines it is connected to, so only the host sends anything here.
+  Dropped_engines chan<- DroppedEngine
+
+  // Checksums of frames finalized by this engine come from the Updater
+  // through here and get broadcast to all remote hosts.
+  Local_checksums <-chan FrameChecksum
+
+  // All checksums, local and remote, are sent to the Auditor through here.
+  Checksums chan<- FrameChecksum
+
+  // The Updater asks for a fresh BootstrapFrame from the host through here,
+  // and the BootstrapFrame is sent back through Resync_frames.  A host can
+  // safely leave these as nil.
+  Resync_requests <-chan struct{}
+  Resync_frames   chan<- BootstrapFrame
+
+  // How long JoinContext waits on the host for each stage of the handshake.
+  // If this is zero it defaults to DefaultJoinStageTimeout.
+  Join_stage_timeout time.Duration
+
+  // How long a new engine has to finish bootstrapping before the host gives up
+  // on it.  If this is zero it defaults to DefaultBootstrapTimeout.
+  Bootstrap_timeout time.Duration
+
+  // Called whenever an engine fails to finish bootstrapping, either because it
+  // took too long, it gave up, or its conn died.  It's also called whenever we
+  // can't connect straight to another engine in the game, in which case
+  // everything to and from that engine goes through the host, and whenever a
+  // spectator is closed with ErrSpectatorEvents.  Calls are made
+  // from their own goroutine, but the Communicator doesn't finish shutting
+  // down until they return.  This can safely be left as nil.
+  Join_failed func(FailedJoin)
+
+  // When the host goes away the engine with the lowest id among those still
+  // connected to each other takes over.  If that's this engine then something
+  // is sent here so that the Auditor starts dropping engines like a host
+  // does, and then the old host is sent to Dropped_engines.  Promoted is
+  // called from its own goroutine after that.  Both can safely be left as
+  // nil.
+  Promotions chan<- struct{}
+  Promoted   func()
+
+  // If this is more than 1 then local bundles with no events in them are held
+  // back, and each run of them is sent as a single message once it is this
+  // many frames long, once a bundle with events in it comes along, or once
+  // the first bundle in it has been held for this many frames.  Other engines
+  // can't finalize a frame until they have our bundle for it, so this should
+  // be small compared to Params.Max_frames.  Every engine understands these
+  // messages whether or not it sends them itself.
+  Empty_batch int
+
+  // How much can be waiting to be sent on each conn.  A conn that is this far
+  // behind gets closed with ErrSendQueueFull rather than holding everything up.
+  // If this is zero it defaults to DefaultSendQueue.
+  Send_queue int
+
   // This is necessary for starting up a client engine.  A host can safely
   // leave this as nil.
   host_conn Conn
 
+  // Id of the engine we think is hosting, which might be this one.
+  host_id EngineId
+
+  // True from when our host goes away until another engine tells us that it
+  // has taken over, and why the host went away.
+  host_lost bool
+  host_err  error
+
+  // Conns to the other engines in the game that aren't our host.  Our
+  // bundles are sent straight to them, but nothing else is sent on these
+  // unless one of them takes over as host, or we do.
+  peers map[Conn]EngineId
+
+  // The engines that each conn has told us it is connected straight to.  If
+  // we're the host we don't pass along bundles from those engines to it.
+  links map[Conn]map[EngineId]bool
+
+  // dialPeer sends its conn here once it has connected to another engine.
+  new_peers chan peerConn
+
+  // Local bundles from the last Params.Max_frames frames.  When the host
+  // changes these are sent to the new host in case the old one didn't pass
+  // them along to everyone.
+  recent []FrameBundle
+
+  // Remote bundles from the last Params.Max_frames frames of each engine.
+  // These are used to spot bundles that arrive more than once, since they
+  // can come both straight from the engine that sent them and from the host,
+  // and so that the host can send them again to an engine whose conn to the
+  // sender died.
+  remote_recent map[EngineId][]FrameBundle
+
+  // The run of empty local bundles being held back, see Empty_batch, and
+  // when it has to be sent by.  empty is nil if nothing is being held back.
+  empty       *emptyFrames
+  empty_flush <-chan time.Time
+
   // Bundles from remote hosts all come through here.
   remote_fan_in chan RemoteFrameBundle
 
+  // connMessages from remote hosts all come through here.
+  remote_messages chan remoteMessage
+
   // All Conns, bootstrapped and not-yet-boostrapped
   conns []Conn
 
   // All bootstrapping conns
   bootstraps []bootstrap
 
+  // Conns to engines that are only watching the game, and the ids they were
+  // given.  They get everything that everyone else does, but anything they
+  // send other than a resync request is ignored, except for bundles which get
+  // them closed with ErrSpectatorEvents.
+  spectators map[Conn]EngineId
+
+  // True if we joined the host as a spectator, in which case we never send
+  // anything to it except for resync requests.
+  spectating bool
+
+  // Ids of the engines on the other end of each conn, if we know them.
+  conn_ids map[Conn]EngineId
+
+  // connRoutine sends its conn here when the conn dies.
+  dead_conns chan deadConn
+
+  // Conns that we closed because of something that went wrong, and what it
+  // was.  This is reported for them instead of ErrConnClosed once their
+  // connRoutine sends them to dead_conns.
+  close_errs map[Conn]error
+
+  // bootstrapRoutine sends its conn here once the conn is ready to join.
+  bootstrapped_conns chan bootstrapped
+
   // Earliest StateFrame for which we have seen no events from an engines.
   // This will be the frame on which we start any new connections.
   horizon StateFrame
@@ -60,12 +362,51 @@ type Communicator struct {
   // Easy way to accurately count live connections.
   active_conns sync.WaitGroup
 
+  // Everything sent on a conn goes through its queue here, and is sent from a
+  // goroutine of its own in the order it was queued, see send.
+  send_queues map[Conn]chan func()
+
+  // Remote bundles, our own frames and checksums that the Auditor hasn't
+  // taken yet, in the order they have to get to it.
+  raw_remote   []FrameBundle
+  local_frames []StateFrame
+  checksums    []FrameChecksum
+
+  // Anything else sent to another component is sent from its own goroutine so
+  // that the Communicator never blocks.  This tracks all of those goroutines,
+  // and those sending from the send_queues, so that we can wait for them when
+  // shutting down.
+  pending sync.WaitGroup
+
+  // The Communicator shuts down when Broadcast_bundles is closed, or when
+  // Shutdown is called.  done is closed once it has finished.
   shutdown chan struct{}
+  done     chan struct{}
+
+  // Closed as soon as the Communicator starts shutting down, so that
+  // anything waiting to hand it something can give up.
+  quit chan struct{}
 }
 
 func (c *Communicator) Start() {
   c.remote_fan_in = make(chan RemoteFrameBundle)
+  c.remote_messages = make(chan remoteMessage)
+  c.conn_ids = make(map[Conn]EngineId)
+  c.spectators = make(map[Conn]EngineId)
+  c.dead_conns = make(chan deadConn)
+  c.close_errs = make(map[Conn]error)
+  c.bootstrapped_conns = make(chan bootstrapped)
+  c.peers = make(map[Conn]EngineId)
+  c.links = make(map[Conn]map[EngineId]bool)
+  c.remote_recent = make(map[EngineId][]FrameBundle)
+  c.new_peers = make(chan peerConn)
+  c.send_queues = make(map[Conn]chan func())
   c.shutdown = make(chan struct{})
+  c.done = make(chan struct{})
+  c.quit = make(chan struct{})
+  if c.host_conn == nil {
+    c.host_id = c.Params.Id
+  }
   if c.host_conn != nil {
     c.conns = append(c.conns, c.host_conn)
     c.active_conns.Add(1)
@@ -74,55 +415,192 @@ func (c *Communicator) Start() {
   go c.routine()
 }
 
+// Version of the bootstrap handshake, the host sends this first thing so that
+// the client can tell if it understands the rest.
+const BootstrapVersion = 3
+
+const DefaultJoinStageTimeout = 10 * time.Second
+
+// Reported by JoinContext when the handshake with the host fails.  Anything
+// else it reports comes from the conn or the context.
+var (
+  ErrJoinRejected = errors.New("Host rejected the join.")
+  ErrJoinTimeout  = errors.New("Timed out waiting on the host.")
+  ErrJoinVersion  = errors.New("Host uses a different version of the bootstrap handshake.")
+  ErrJoinDecode   = errors.New("Unable to decode data from the host.")
+)
+
+// Same as JoinContext, but without a context.  The handshake can still time
+// out.
+func (c *Communicator) Join(conn Conn) (*BootstrapFrame, EngineId, error) {
+  return c.JoinContext(context.Background(), conn)
+}
+
+// Same as SpectateContext, but without a context.
+func (c *Communicator) Spectate(conn Conn) (*BootstrapFrame, EngineId, error) {
+  return c.SpectateContext(context.Background(), conn)
+}
+
+// Like JoinContext, except that the host never adds this engine to the game,
+// so nobody waits on it and any events it sends are ignored.  The engine
+// still gets every frame, so it can watch the game.  The Updater should have
+// Spectating set.
+func (c *Communicator) SpectateContext(ctx context.Context, conn Conn) (*BootstrapFrame, EngineId, error) {
+  return c.join(ctx, conn, true)
+}
+
 // For engines attempting to connect to a host engine, once the connection has
 // been established this function will handle the initial bootstrap.  If
 // successful the BootstrapFrame that is returned should be passed to
-// Updater.Bootstrap() and all other components can be Start()ed.
-func (c *Communicator) Join(conn Conn) (*BootstrapFrame, EngineId, error) {
-  // TODO: Should have a timeout on here, maybe 10 seconds?
-  data := <-conn.RecvData()
-  var initial bootstrapInitialData
-  err := QuickGobDecode(&initial, data)
-  if err != nil {
+// Updater.Bootstrap() and all other components can be Start()ed.  Gives up if
+// ctx is done or if any stage of the handshake takes longer than
+// Join_stage_timeout, in which case the host is told that we're not coming
+// and conn is closed.
+func (c *Communicator) JoinContext(ctx context.Context, conn Conn) (*BootstrapFrame, EngineId, error) {
+  return c.join(ctx, conn, false)
+}
+
+func (c *Communicator) join(ctx context.Context, conn Conn, spectate bool) (*BootstrapFrame, EngineId, error) {
+  timeout := c.Join_stage_timeout
+  if timeout == 0 {
+    timeout = DefaultJoinStageTimeout
+  }
+  giveUp := func(err error) (*BootstrapFrame, EngineId, error) {
+    data, enc_err := QuickGobEncode(bootstrapReply{Ready: false})
+    if enc_err == nil {
+      conn.SendData(data)
+    }
     conn.Close()
     return nil, 0, err
   }
+  connErr := func() error {
+    err := conn.Err()
+    if err == nil {
+      err = ErrConnClosed
+    }
+    return err
+  }
+
+  var initial bootstrapInitialData
+  select {
+  case data, ok := <-conn.RecvData():
+    if !ok {
+      return giveUp(connErr())
+    }
+    if QuickGobDecode(&initial, data) != nil {
+      return giveUp(ErrJoinDecode)
+    }
+  case <-time.After(timeout):
+    return giveUp(ErrJoinTimeout)
+  case <-ctx.Done():
+    return giveUp(ctx.Err())
+  }
+  if initial.Version != BootstrapVersion {
+    return giveUp(ErrJoinVersion)
+  }
+  if initial.Rejected {
+    conn.Close()
+    return nil, 0, ErrJoinRejected
+  }
+
   var remote_bundles []FrameBundle
+  stage_timeout := time.After(timeout)
   for {
     select {
-    case bundle := <-conn.RecvFrameBundle():
+    case bundle, ok := <-conn.RecvFrameBundle():
+      if !ok {
+        return giveUp(connErr())
+      }
       if bundle.Frame > initial.Horizon {
         remote_bundles = append(remote_bundles, bundle)
       }
 
-    case data := <-conn.RecvData():
+    case <-stage_timeout:
+      return giveUp(ErrJoinTimeout)
+
+    case <-ctx.Done():
+      return giveUp(ctx.Err())
+
+    case data, ok := <-conn.RecvData():
+      if !ok {
+        return giveUp(connErr())
+      }
       var boot BootstrapFrame
-      err = QuickGobDecode(&boot, data)
-      if err != nil {
-        conn.Close()
-        return nil, 0, err
+      if QuickGobDecode(&boot, data) != nil {
+        return giveUp(ErrJoinDecode)
       }
-      data, err := QuickGobEncode(true)
+      data, err := QuickGobEncode(bootstrapReply{Ready: true, Spectator: spectate})
       if err != nil {
-        conn.Close()
-        return nil, 0, err
+        return giveUp(err)
       }
       conn.SendData(data)
-
-      go func() {
-        for _, bundle := range remote_bundles {
-          c.Raw_remote_bundles <- bundle
-        }
-      }()
+      c.spectating = spectate
+      c.raw_remote = append(c.raw_remote, remote_bundles...)
       c.host_conn = conn
+      c.host_id = initial.Host
       return &boot, initial.Id, nil
     }
   }
   panic("Unreachable")
 }
 
+// Closes every conn and returns once the Communicator has stopped.  If the
+// Updater is still running this doesn't return until it closes
+// Broadcast_bundles.
 func (c *Communicator) Shutdown() {
-  c.shutdown <- struct{}{}
+  select {
+  case c.shutdown <- struct{}{}:
+  case <-c.done:
+  }
+  <-c.done
+}
+
+// Runs f in its own goroutine, see pending.
+func (c *Communicator) async(f func()) {
+  c.pending.Add(1)
+  go func() {
+    defer c.pending.Done()
+    f()
+  }()
+}
+
+// Queues f to be run after everything else queued for conn, f should only send
+// things on conn.  Nothing more is queued for a conn once we've closed it, and
+// if conn's queue is full it gets closed with ErrSendQueueFull.
+func (c *Communicator) send(conn Conn, f func()) {
+  if _, ok := c.close_errs[conn]; ok {
+    return
+  }
+  queue, ok := c.send_queues[conn]
+  if !ok {
+    size := c.Send_queue
+    if size == 0 {
+      size = DefaultSendQueue
+    }
+    queue = make(chan func(), size)
+    c.send_queues[conn] = queue
+    c.pending.Add(1)
+    go func() {
+      defer c.pending.Done()
+      for f := range queue {
+        f()
+      }
+    }()
+  }
+  select {
+  case queue <- f:
+  default:
+    c.closeConn(conn, ErrSendQueueFull)
+  }
+}
+
+// Lets the goroutine sending on conn finish once it has sent everything that
+// was queued for it.
+func (c *Communicator) stopSending(conn Conn) {
+  if queue, ok := c.send_queues[conn]; ok {
+    close(queue)
+    delete(c.send_queues, conn)
+  }
 }
 func (c *Communicator) NumConns() int {
   return len(c.conns)
@@ -133,61 +611,710 @@ func (c *Communicator) NumConns() int {
 // StateFrame and Id   ->
 // BootstrapFrame      ->
 //                            <- Confirmation
-// Apply EngineJoined
+// Apply EngineJoined, unless the client is a spectator
 //                            Listen for the appropriate EngineJoined event
 //                Bootstrapping complete
 // 
+// If the client doesn't confirm before Bootstrap_timeout the Communicator
+// closes the conn, which ends this routine.
+//
+// Engines that are already in the game and are connecting straight to us
+// confirm with their own id as soon as they get the StateFrame and Id, and
+// don't need a BootstrapFrame.
 func (c *Communicator) bootstrapRoutine(conn Conn, id EngineId) {
   data, ok := <-conn.RecvData()
   if !ok {
-    // TODO: Log this error
-    // TODO: If anything in this function fails the conn still needs to be
-    // removed from the boostrapping conns list.
-    conn.Close()
+    err := conn.Err()
+    if err == nil {
+      conn.Close()
+      err = ErrConnClosed
+    }
+    c.dead_conns <- deadConn{conn, err}
+    c.active_conns.Done()
     return
   }
-  var ready bool
-  err := QuickGobDecode(&ready, data)
-  if err != nil || !ready {
-    // TODO: LOG this error
+  var reply bootstrapReply
+  if QuickGobDecode(&reply, data) != nil || !reply.Ready {
+    // The client gave up, so it gets forgotten about just like any other dead
+    // conn.
     conn.Close()
+    c.dead_conns <- deadConn{conn, ErrJoinAbandoned}
+    c.active_conns.Done()
+    return
+  }
+  if reply.Peer != 0 {
+    c.bootstrapped_conns <- bootstrapped{
+      conn:   conn,
+      id:     reply.Peer,
+      peer:   true,
+      target: reply.Target,
+    }
   } else {
-    // TODO: Make an engine event that joins conn to the game
-    c.Local_engine_event <- EngineJoined{id}
-    go c.connRoutine(conn)
+    c.bootstrapped_conns <- bootstrapped{conn: conn, id: id, spectator: reply.Spectator}
   }
+  c.connRoutine(conn)
 }
 
+// Runs until the conn has delivered everything it received before it died.
 func (c *Communicator) connRoutine(conn Conn) {
-  alive := true
-  for alive {
+  data_chan := conn.RecvData()
+  bundle_chan := conn.RecvFrameBundle()
+  for data_chan != nil || bundle_chan != nil {
     select {
-    case _, ok := <-conn.RecvData():
-      alive = alive && ok
+    case data, ok := <-data_chan:
+      if !ok {
+        data_chan = nil
+        break
+      }
+      var msg connMessage
+      err := QuickGobDecode(&msg, data)
+      if err != nil {
+        // TODO: LOG this error
+        break
+      }
+      c.remote_messages <- remoteMessage{msg, conn}
 
-    case bundle, ok := <-conn.RecvFrameBundle():
-      alive = alive && ok
+    case bundle, ok := <-bundle_chan:
+      if !ok {
+        bundle_chan = nil
+        break
+      }
       c.remote_fan_in <- RemoteFrameBundle{bundle, conn}
     }
   }
+  err := conn.Err()
+  if err == nil {
+    // The conn stopped delivering data without reporting why, so the best we
+    // can do is make sure it is closed.
+    conn.Close()
+    err = ErrConnClosed
+  }
+  c.dead_conns <- deadConn{conn, err}
   c.active_conns.Done()
-  // TODO: conn died, probably want to do something here.
 }
 
 type bootstrapInitialData struct {
+  // Always BootstrapVersion.
+  Version int
+
+  // If this is set then nothing else is sent, and the conn is closed.
+  Rejected bool
+
   Horizon StateFrame
   Id      EngineId
+
+  // Id of the engine sending this.
+  Host EngineId
+}
+
+// Sent by the client once it has its BootstrapFrame, or when it gives up.
+type bootstrapReply struct {
+  // False if the client isn't coming after all.
+  Ready bool
+
+  // True if the client only wants to watch.
+  Spectator bool
+
+  // Set along with Ready by an engine that's already in the game and is
+  // connecting straight to Target rather than joining, see dialPeer.  Peer is
+  // the id of the engine sending this.
+  Peer   EngineId
+  Target EngineId
+}
+
+// Returns true if conn is still waiting on its BootstrapFrame, in which case
+// it shouldn't be sent any connMessages.
+func (c *Communicator) isBootstrapping(conn Conn) bool {
+  for _, boot := range c.bootstraps {
+    if boot.conn == conn && boot.state == bootstrapWaitingForFrame {
+      return true
+    }
+  }
+  return false
+}
+
+// Removes conn from bootstraps, and returns what it was, if it was there.
+func (c *Communicator) removeBootstrap(conn Conn) (bootstrap, bool) {
+  for i := range c.bootstraps {
+    if c.bootstraps[i].conn == conn {
+      boot := c.bootstraps[i]
+      c.bootstraps[i] = c.bootstraps[len(c.bootstraps)-1]
+      c.bootstraps = c.bootstraps[0 : len(c.bootstraps)-1]
+      return boot, true
+    }
+  }
+  return bootstrap{}, false
+}
+
+// Forgets about conn entirely.  Returns the id of the engine on the other end
+// of it, if we knew it.
+func (c *Communicator) removeConn(conn Conn) (EngineId, bool) {
+  for i := range c.conns {
+    if c.conns[i] == conn {
+      c.conns[i] = c.conns[len(c.conns)-1]
+      c.conns = c.conns[0 : len(c.conns)-1]
+      break
+    }
+  }
+  id, ok := c.conn_ids[conn]
+  delete(c.conn_ids, conn)
+  delete(c.links, conn)
+  return id, ok
+}
+
+// Closes conn because of err, which is reported for it once its connRoutine
+// notices.
+func (c *Communicator) closeConn(conn Conn, err error) {
+  c.close_errs[conn] = err
+  c.async(func() { conn.Close() })
+}
+
+func (c *Communicator) joinFailed(id EngineId, err error) {
+  if c.Join_failed == nil {
+    return
+  }
+  c.async(func() {
+    c.Join_failed(FailedJoin{Id: id, Err: err})
+  })
+}
+
+// Drops every new engine that has been bootstrapping for too long.  Their
+// bootstrapRoutines end once their conns are closed.
+func (c *Communicator) expireBootstraps(now time.Time) {
+  for i := 0; i < len(c.bootstraps); i++ {
+    boot := c.bootstraps[i]
+    if boot.resync || now.Before(boot.deadline) {
+      continue
+    }
+    c.abandonBootstrap(boot, ErrBootstrapTimeout)
+    i--
+  }
+}
+
+// Forgets about boot and closes its conn.  Closing the conn ends its
+// bootstrapRoutine or connRoutine, which is what releases it from
+// active_conns, but since it's already been forgotten nobody else will report
+// it.  An engine that was only resyncing is already in the game, so it gets
+// dropped instead.
+func (c *Communicator) abandonBootstrap(boot bootstrap, err error) {
+  c.removeBootstrap(boot.conn)
+  id, ok := c.removeConn(boot.conn)
+  c.async(func() { boot.conn.Close() })
+  if !boot.resync {
+    c.joinFailed(boot.id, err)
+    return
+  }
+  if ok && c.Dropped_engines != nil {
+    c.async(func() {
+      c.Dropped_engines <- DroppedEngine{Id: id, Err: err}
+    })
+  }
+}
+
+// True if we're the host, or were started as one.
+func (c *Communicator) hosting() bool {
+  return c.host_conn == nil && !c.host_lost
+}
+
+// Tells an engine that has just joined where to find every other engine in
+// the game, other than us, so that it can connect straight to them.
+func (c *Communicator) sendPeers(conn Conn) error {
+  pn, ok := c.Net.(PeerNetwork)
+  if !ok {
+    return nil
+  }
+  var peers []peerAddress
+  for other, id := range c.conn_ids {
+    if other == conn || c.isBootstrapping(other) {
+      continue
+    }
+    addr, err := pn.PeerAddr(other)
+    if err == ErrPeerNotListening {
+      // It can only be reached through us.
+      continue
+    }
+    if err != nil {
+      return err
+    }
+    peers = append(peers, peerAddress{Id: id, Addr: addr})
+  }
+  if len(peers) == 0 {
+    return nil
+  }
+  data, err := QuickGobEncode(connMessage{Peers: peers})
+  if err != nil {
+    return err
+  }
+  c.send(conn, func() { conn.SendData(data) })
+  return nil
+}
+
+// Connects straight to another engine in the game, see bootstrapRoutine for
+// the other end.  Nothing is checked here, if we reach the wrong engine it
+// closes the conn.
+func (c *Communicator) dialPeer(peer peerAddress) error {
+  remote, err := c.Net.(PeerNetwork).PeerHost(peer.Addr)
+  if err != nil {
+    return err
+  }
+  conn, err := c.Net.Join(remote, PeerJoinData)
+  if err != nil {
+    return err
+  }
+  data, err := QuickGobEncode(bootstrapReply{Ready: true, Peer: c.Params.Id, Target: peer.Id})
+  if err != nil {
+    conn.Close()
+    return err
+  }
+  conn.SendData(data)
+  select {
+  case c.new_peers <- peerConn{conn, peer.Id}:
+  case <-c.quit:
+    conn.Close()
+  }
+  return nil
+}
+
+// Starts listening to a conn to another engine in the game.  If we're the
+// host then it's just like any other engine connected to us.
+func (c *Communicator) addPeer(conn Conn, id EngineId) {
+  if c.hosting() {
+    c.conns = append(c.conns, conn)
+    c.conn_ids[conn] = id
+    return
+  }
+  c.peers[conn] = id
+  c.sendLinks()
+
+  // Anything we sent before now only went through the host, which might not
+  // have known to pass it along to this peer.
+  c.resendRecent([]Conn{conn})
+}
+
+// Tells the host which engines we're connected straight to.
+func (c *Communicator) sendLinks() {
+  if c.host_conn == nil {
+    return
+  }
+  var links peerLinks
+  for _, id := range c.peers {
+    links.Ids = append(links.Ids, id)
+  }
+  data, err := QuickGobEncode(connMessage{Links: &links})
+  if err != nil {
+    // Otherwise the host would go on thinking that we're connected straight
+    // to engines that we aren't, and never pass their bundles along to us.
+    c.closeConn(c.host_conn, err)
+    return
+  }
+  host := c.host_conn
+  c.send(host, func() { host.SendData(data) })
+}
+
+// Records that conn now only gets bundles from us for engines not in ids.
+// Any engine that it was connected straight to and isn't anymore gets its
+// recent bundles sent to conn, since some of them might have been lost along
+// with the direct conn.
+func (c *Communicator) setLinks(conn Conn, ids []EngineId) {
+  links := make(map[EngineId]bool)
+  for _, id := range ids {
+    links[id] = true
+  }
+  for id := range c.links[conn] {
+    if links[id] {
+      continue
+    }
+    bundles := c.remote_recent[id]
+    c.send(conn, func() {
+      for _, bundle := range bundles {
+        conn.SendFrameBundle(bundle)
+      }
+    })
+  }
+  c.links[conn] = links
+}
+
+// Remembers a remote bundle, returns false if we've already seen it.  A
+// bundle that is different from the one we already saw for the same frame
+// isn't remembered, but still returns true so that the Auditor can deal with
+// the engine that sent it.
+func (c *Communicator) noteRemoteBundle(bundle FrameBundle) bool {
+  fresh := false
+  for id, events := range bundle.Bundle {
+    recent := c.remote_recent[id]
+    seen := false
+    newest := bundle.Frame
+    for _, old := range recent {
+      if old.Frame == bundle.Frame {
+        seen = true
+        if !old.Bundle[id].identical(events) {
+          fresh = true
+        }
+      }
+      if old.Frame > newest {
+        newest = old.Frame
+      }
+    }
+    if seen {
+      continue
+    }
+    fresh = true
+    recent = append(recent, bundle)
+    for len(recent) > 0 && int(newest-recent[0].Frame) >= c.Params.Max_frames {
+      recent = recent[1:]
+    }
+    c.remote_recent[id] = recent
+  }
+  return fresh
+}
+
+// Passes along to the Auditor, in order, each of bundles that we haven't seen
+// before, or that conflicts with one we have.
+func (c *Communicator) receiveBundles(bundles []FrameBundle) {
+  var fresh []FrameBundle
+  for _, bundle := range bundles {
+    if bundle.Frame > c.horizon {
+      c.horizon = bundle.Frame
+    }
+    if c.noteRemoteBundle(bundle) {
+      fresh = append(fresh, bundle)
+    }
+  }
+  if c.Raw_remote_bundles != nil {
+    c.raw_remote = append(c.raw_remote, fresh...)
+  }
+}
+
+// Returns the conns that something from a remote engine that came in on from
+// should be passed along to.  Anything from a peer has already been sent to
+// whoever needs it.
+func (c *Communicator) relayTargets(from Conn) []Conn {
+  if _, ok := c.peers[from]; ok {
+    return nil
+  }
+  var conns []Conn
+  for _, conn := range c.conns {
+    if conn != from && !c.linked(conn, from) {
+      conns = append(conns, conn)
+    }
+  }
+  return conns
+}
+
+// Returns true if bundle is being held back as part of a run of empty local
+// bundles, see Empty_batch.  Whatever was already being held back is sent
+// first if bundle doesn't belong with it.
+func (c *Communicator) holdEmpty(bundle FrameBundle) bool {
+  if c.Empty_batch <= 1 {
+    return false
+  }
+  events, ok := bundle.Bundle[c.Params.Id]
+  empty := ok && len(bundle.Bundle) == 1 && len(events.Game) == 0 && len(events.Engine) == 0
+  if c.empty != nil && (!empty || bundle.Frame != c.empty.Last+1) {
+    c.flushEmpty()
+  }
+  if !empty {
+    return false
+  }
+  if c.empty == nil {
+    c.empty = &emptyFrames{Id: c.Params.Id, First: bundle.Frame, Last: bundle.Frame}
+    hold := time.Duration(int64(c.Empty_batch)*c.Params.Frame_ms) * time.Millisecond
+    c.empty_flush = time.After(hold)
+  } else {
+    c.empty.Last = bundle.Frame
+  }
+  if int(c.empty.Last-c.empty.First)+1 >= c.Empty_batch {
+    c.flushEmpty()
+  }
+  return true
+}
+
+// Sends the run of empty local bundles that is being held back, if there is
+// one, to everyone that would have gotten the bundles.
+func (c *Communicator) flushEmpty() {
+  if c.empty == nil {
+    return
+  }
+  empty := *c.empty
+  c.empty = nil
+  c.empty_flush = nil
+  conns := append([]Conn(nil), c.conns...)
+  for conn := range c.peers {
+    conns = append(conns, conn)
+  }
+  c.sendEmpty(conns, empty)
+}
+
+// Sends empty to each of conns.  Conns that are still bootstrapping can't take
+// messages yet, so they get the bundles that it stands for instead, as does
+// everyone if it can't be encoded.
+func (c *Communicator) sendEmpty(conns []Conn, empty emptyFrames) {
+  data, err := QuickGobEncode(connMessage{Empty: &empty})
+  for _, conn := range conns {
+    conn := conn
+    if err != nil || c.isBootstrapping(conn) {
+      bundles := empty.bundles()
+      c.send(conn, func() {
+        for i := len(bundles) - 1; i >= 0; i-- {
+          conn.SendFrameBundle(bundles[i])
+        }
+      })
+      continue
+    }
+    c.send(conn, func() { conn.SendData(data) })
+  }
+}
+
+// Returns true if the engine on the other end of to is connected straight to
+// the engine on the other end of from.
+func (c *Communicator) linked(to, from Conn) bool {
+  id, ok := c.conn_ids[from]
+  return ok && c.links[to][id]
+}
+
+// Called when the conn to our host dies.  Unless we're only watching, the
+// engine with the lowest id out of us and everyone we're still connected to
+// takes over as host.
+func (c *Communicator) hostLost(err error) {
+  c.removeConn(c.host_conn)
+  c.host_conn = nil
+  c.host_lost = true
+  c.host_err = err
+  if !c.spectating {
+    c.electHost()
+  }
+}
+
+// If we've lost our host and there's nobody left that should take over before
+// us, we take over.  Otherwise we wait for whoever should to tell us that it
+// has.  This is run again whenever a peer goes away.
+func (c *Communicator) electHost() {
+  for _, id := range c.peers {
+    if id < c.Params.Id {
+      return
+    }
+  }
+  c.promote()
+}
+
+// Takes over as host.  Every peer becomes an engine connected to us, and the
+// Auditor drops the old host.
+func (c *Communicator) promote() {
+  old_host := c.host_id
+  dropped := DroppedEngine{Id: old_host, Err: c.host_err}
+  c.host_lost = false
+  c.host_err = nil
+  c.host_id = c.Params.Id
+  var conns []Conn
+  for conn, id := range c.peers {
+    c.conns = append(c.conns, conn)
+    c.conn_ids[conn] = id
+    conns = append(conns, conn)
+  }
+  c.peers = make(map[Conn]EngineId)
+  data, err := QuickGobEncode(connMessage{New_host: true})
+  if err == nil {
+    for _, conn := range conns {
+      conn := conn
+      c.send(conn, func() { conn.SendData(data) })
+    }
+  }
+  c.resendRecent(conns)
+  c.async(func() {
+    if c.Promotions != nil {
+      c.Promotions <- struct{}{}
+    }
+    if c.Dropped_engines != nil {
+      c.Dropped_engines <- dropped
+    }
+  })
+  if c.Promoted != nil {
+    c.async(c.Promoted)
+  }
+}
+
+// Makes the engine on the other end of conn our host, since it says it has
+// taken over.  If we still had a conn to the old host we drop it.
+func (c *Communicator) follow(conn Conn) {
+  if c.host_conn != nil {
+    old := c.host_conn
+    c.removeConn(old)
+    c.async(func() { old.Close() })
+  }
+  c.host_conn = conn
+  c.host_id = c.peers[conn]
+  c.host_lost = false
+  c.host_err = nil
+  delete(c.peers, conn)
+  c.conns = append(c.conns, conn)
+  c.sendLinks()
+  c.resendRecent([]Conn{conn})
+}
+
+// Sends our recent bundles to conns, since the old host might not have sent
+// them to everyone before it went away.  Anyone that already had them ignores
+// them.
+func (c *Communicator) resendRecent(conns []Conn) {
+  bundles := c.recent
+  for _, conn := range conns {
+    conn := conn
+    c.send(conn, func() {
+      for _, bundle := range bundles {
+        conn.SendFrameBundle(bundle)
+      }
+    })
+  }
+}
+
+// Sends msg to every conn that has finished bootstrapping except for skip.
+func (c *Communicator) broadcastMessage(msg connMessage, skip Conn) {
+  data, err := QuickGobEncode(msg)
+  if err != nil {
+    // TODO: LOG this error
+    return
+  }
+  for _, conn := range c.conns {
+    if conn != skip && !c.isBootstrapping(conn) {
+      conn := conn
+      c.send(conn, func() { conn.SendData(data) })
+    }
+  }
+}
+
+func (c *Communicator) handleMessage(msg connMessage, conn Conn) {
+  switch {
+  case msg.Checksum != nil:
+    if _, ok := c.spectators[conn]; ok {
+      break
+    }
+    c.broadcastMessage(msg, conn)
+    if c.Checksums != nil {
+      c.checksums = append(c.checksums, *msg.Checksum)
+    }
+
+  case msg.Resync_request:
+    // The engine gets a copy of the first frame that it can't have sent any
+    // bundles for yet, just like when it first joined.  Until then it doesn't
+    // get any other messages.
+    if !c.hosting() || c.isBootstrapping(conn) {
+      break
+    }
+    c.bootstraps = append(c.bootstraps, bootstrap{
+      conn:   conn,
+      start:  c.horizon + 1,
+      resync: true,
+    })
+
+  case msg.Bootstrap != nil:
+    if conn != c.host_conn || c.Resync_frames == nil {
+      break
+    }
+    c.async(func() {
+      c.Resync_frames <- *msg.Bootstrap
+    })
+
+  case msg.Peers != nil:
+    if conn != c.host_conn || c.spectating {
+      break
+    }
+    if _, ok := c.Net.(PeerNetwork); !ok {
+      break
+    }
+    for _, peer := range msg.Peers {
+      peer := peer
+      c.async(func() {
+        err := c.dialPeer(peer)
+        if err != nil && c.Join_failed != nil {
+          c.Join_failed(FailedJoin{Id: peer.Id, Err: err})
+        }
+      })
+    }
+
+  case msg.New_host:
+    if _, ok := c.peers[conn]; !ok || c.hosting() {
+      break
+    }
+    c.follow(conn)
+
+  case msg.Links != nil:
+    if _, ok := c.spectators[conn]; ok || !c.hosting() {
+      break
+    }
+    c.setLinks(conn, msg.Links.Ids)
+
+  case msg.Empty != nil:
+    if _, ok := c.spectators[conn]; ok {
+      c.closeConn(conn, ErrSpectatorEvents)
+      break
+    }
+    if msg.Empty.Last < msg.Empty.First || int(msg.Empty.Last-msg.Empty.First) >= c.Params.Max_frames {
+      // Nobody holds back this many frames.
+      c.closeConn(conn, ErrEmptyMalformed)
+      break
+    }
+    c.receiveBundles(msg.Empty.bundles())
+    c.sendEmpty(c.relayTargets(conn), *msg.Empty)
+  }
 }
 
 func (c *Communicator) routine() {
+  timeout := c.Bootstrap_timeout
+  if timeout == 0 {
+    timeout = DefaultBootstrapTimeout
+  }
+  expiry := time.NewTicker(timeout / 10)
+  defer expiry.Stop()
   for {
+    var raw_remote_bundles chan<- FrameBundle
+    var raw_remote FrameBundle
+    if len(c.raw_remote) > 0 {
+      raw_remote_bundles = c.Raw_remote_bundles
+      raw_remote = c.raw_remote[0]
+    }
+    var local_frames chan<- StateFrame
+    var local_frame StateFrame
+    if len(c.local_frames) > 0 {
+      local_frames = c.Local_frames
+      local_frame = c.local_frames[0]
+    }
+    var checksums chan<- FrameChecksum
+    var checksum FrameChecksum
+    if len(c.checksums) > 0 {
+      checksums = c.Checksums
+      checksum = c.checksums[0]
+    }
     select {
+    case raw_remote_bundles <- raw_remote:
+      c.raw_remote = c.raw_remote[1:]
+
+    case local_frames <- local_frame:
+      c.local_frames = c.local_frames[1:]
+
+    case checksums <- checksum:
+      c.checksums = c.checksums[1:]
+
     case conn := <-c.Net.NewConns():
+      if c.Bootstrap_frames == nil && c.hosting() {
+        // We never get any completed frames, so there's nothing we could
+        // bootstrap them with.
+        data, err := QuickGobEncode(bootstrapInitialData{
+          Version:  BootstrapVersion,
+          Rejected: true,
+        })
+        if err == nil {
+          conn.SendData(data)
+        }
+        c.async(func() { conn.Close() })
+        break
+      }
+
       // We send them the stateframe they're starting on and the id they will
       // be assigned when they join the game.
       initial := bootstrapInitialData{
-        c.horizon + 1,
-        EngineId(RandomId()),
+        Version: BootstrapVersion,
+        Horizon: c.horizon + 1,
+        Id:      EngineId(RandomId()),
+        Host:    c.Params.Id,
       }
       data, err := QuickGobEncode(initial)
       if err != nil {
@@ -196,70 +1323,300 @@ func (c *Communicator) routine() {
       }
       conn.SendData(data)
       c.conns = append(c.conns, conn)
+      c.conn_ids[conn] = initial.Id
       boot := bootstrap{
-        conn:  conn,
-        start: c.horizon + 1,
+        conn:     conn,
+        id:       initial.Id,
+        state:    bootstrapWaitingForFrame,
+        deadline: time.Now().Add(timeout),
+        start:    c.horizon + 1,
       }
       c.bootstraps = append(c.bootstraps, boot)
       c.active_conns.Add(1)
       go c.bootstrapRoutine(conn, initial.Id)
 
-    case bundle := <-c.Broadcast_bundles:
+    case bundle, ok := <-c.Broadcast_bundles:
+      if !ok {
+        c.flushEmpty()
+        c.stop(false)
+        return
+      }
+      if c.spectating {
+        // Our bundles aren't part of the game, but the Auditor still needs to
+        // know what frame we're on.
+        if c.Local_frames != nil {
+          c.local_frames = append(c.local_frames, bundle.Frame)
+        }
+        break
+      }
       if bundle.Frame > c.horizon {
         c.horizon = bundle.Frame
       }
-      for _, conn := range c.conns {
-        go conn.SendFrameBundle(bundle)
+      c.recent = append(c.recent, bundle)
+      for len(c.recent) > 0 && int(bundle.Frame-c.recent[0].Frame) >= c.Params.Max_frames {
+        c.recent = c.recent[1:]
+      }
+      if !c.holdEmpty(bundle) {
+        for _, conn := range c.conns {
+          conn := conn
+          c.send(conn, func() { conn.SendFrameBundle(bundle) })
+        }
+        for conn := range c.peers {
+          conn := conn
+          c.send(conn, func() { conn.SendFrameBundle(bundle) })
+        }
+      }
+      if c.Local_frames != nil {
+        c.local_frames = append(c.local_frames, bundle.Frame)
       }
 
     case remote_bundle := <-c.remote_fan_in:
-      if remote_bundle.bundle.Frame > c.horizon {
-        c.horizon = remote_bundle.bundle.Frame
-      }
-      go func() {
-        c.Raw_remote_bundles <- remote_bundle.bundle
-      }()
-      for _, conn := range c.conns {
-        if conn != remote_bundle.conn {
-          go conn.SendFrameBundle(remote_bundle.bundle)
+      if _, ok := c.spectators[remote_bundle.conn]; ok {
+        c.closeConn(remote_bundle.conn, ErrSpectatorEvents)
+        break
+      }
+      c.receiveBundles([]FrameBundle{remote_bundle.bundle})
+      // Duplicates are still passed along, engines only send bundles again
+      // when they think someone might not have gotten them.
+      for _, conn := range c.relayTargets(remote_bundle.conn) {
+        conn := conn
+        c.send(conn, func() { conn.SendFrameBundle(remote_bundle.bundle) })
+      }
+
+    case checksum := <-c.Local_checksums:
+      if !c.spectating {
+        c.broadcastMessage(connMessage{Checksum: &checksum}, nil)
+      }
+      if c.Checksums != nil {
+        c.checksums = append(c.checksums, checksum)
+      }
+
+    case remote := <-c.remote_messages:
+      c.handleMessage(remote.msg, remote.conn)
+
+    case <-c.Resync_requests:
+      // host_conn can change as soon as we return to the select, so the send
+      // has to use the conn we have now.
+      host := c.host_conn
+      if host == nil {
+        break
+      }
+      data, err := QuickGobEncode(connMessage{Resync_request: true})
+      if err != nil {
+        // TODO: LOG this error
+        break
+      }
+      c.send(host, func() { host.SendData(data) })
+
+    case dead := <-c.dead_conns:
+      if err, ok := c.close_errs[dead.conn]; ok {
+        delete(c.close_errs, dead.conn)
+        dead.err = err
+      }
+      c.stopSending(dead.conn)
+      if dead.conn == c.host_conn {
+        c.hostLost(dead.err)
+        break
+      }
+      if _, ok := c.peers[dead.conn]; ok {
+        delete(c.peers, dead.conn)
+        if c.host_lost && !c.spectating {
+          c.electHost()
         }
+        c.sendLinks()
+        break
+      }
+      id, ok := c.removeConn(dead.conn)
+      if spectator, ok := c.spectators[dead.conn]; ok {
+        delete(c.spectators, dead.conn)
+        if dead.err == ErrSpectatorEvents {
+          c.joinFailed(spectator, dead.err)
+        }
+      }
+      boot, booting := c.removeBootstrap(dead.conn)
+      if booting && !boot.resync {
+        // It never joined the game, so there's nothing to drop.
+        c.joinFailed(boot.id, dead.err)
+        ok = false
+      }
+      if ok && c.Dropped_engines != nil {
+        c.async(func() {
+          c.Dropped_engines <- DroppedEngine{Id: id, Err: dead.err}
+        })
       }
 
     case boostrap_frame := <-c.Bootstrap_frames:
-      for _, boot := range c.bootstraps {
-        if boostrap_frame.Frame == boot.start {
-          data, err := QuickGobEncode(boostrap_frame)
-          if err != nil {
-            panic(err.Error())
-            // TODO: LOG error
-            boot.conn.Close()
-            continue
-          }
-          boot.conn.SendData(data)
+      for i := 0; i < len(c.bootstraps); i++ {
+        boot := c.bootstraps[i]
+        if boostrap_frame.Frame != boot.start {
+          continue
+        }
+        var data []byte
+        var err error
+        if boot.resync {
+          data, err = QuickGobEncode(connMessage{Bootstrap: &boostrap_frame})
+        } else {
+          data, err = QuickGobEncode(boostrap_frame)
         }
+        if err != nil {
+          c.abandonBootstrap(boot, err)
+          i--
+          continue
+        }
+        conn := boot.conn
+        c.send(conn, func() { conn.SendData(data) })
       }
-      // Now remove these bootstrap conns from our list since we've sent them
-      // everything they need.
+      // Resyncs are done now that we've sent them everything they need, new
+      // engines still have to confirm that they're joining.
       for i := 0; i < len(c.bootstraps); i++ {
-        if boostrap_frame.Frame == c.bootstraps[i].start {
+        if boostrap_frame.Frame != c.bootstraps[i].start {
+          continue
+        }
+        if c.bootstraps[i].resync {
           c.bootstraps[i] = c.bootstraps[len(c.bootstraps)-1]
           c.bootstraps = c.bootstraps[0 : len(c.bootstraps)-1]
+          i--
+        } else {
+          c.bootstraps[i].state = bootstrapWaitingForConfirmation
         }
       }
 
-    case <-c.shutdown:
-      for _, conn := range c.conns {
-        conn.Close()
+    case boot := <-c.bootstrapped_conns:
+      if _, ok := c.removeBootstrap(boot.conn); !ok {
+        // It already expired, so its conn has been closed and it's not going
+        // to join.
+        break
       }
-      // Clean out remote_fan_in so that our conn routines can terminate.
-      go func() {
-        for _ = range c.remote_fan_in {
+      if boot.peer {
+        c.removeConn(boot.conn)
+        if boot.target != c.Params.Id {
+          // It was looking for some other engine.
+          c.async(func() { boot.conn.Close() })
+          break
         }
-      }()
-      c.active_conns.Wait()
-      close(c.remote_fan_in)
-      close(c.Raw_remote_bundles)
+        c.addPeer(boot.conn, boot.id)
+        break
+      }
+      if !c.hosting() {
+        // Only the host can add engines to the game.
+        c.removeConn(boot.conn)
+        c.async(func() { boot.conn.Close() })
+        break
+      }
+      if boot.spectator {
+        // Spectators never join the game, so there's nobody to drop if they
+        // leave.
+        c.spectators[boot.conn] = boot.id
+        delete(c.conn_ids, boot.conn)
+        break
+      }
+      c.async(func() {
+        c.Local_engine_event <- EngineJoined{boot.id}
+      })
+      if err := c.sendPeers(boot.conn); err != nil {
+        // It can't connect to everyone else, so if we go away it won't be
+        // able to agree with them on who takes over.
+        c.closeConn(boot.conn, err)
+      }
+
+    case peer := <-c.new_peers:
+      c.active_conns.Add(1)
+      go c.connRoutine(peer.conn)
+      c.addPeer(peer.conn, peer.id)
+
+    case now := <-expiry.C:
+      c.expireBootstraps(now)
+
+    case <-c.empty_flush:
+      c.flushEmpty()
+
+    case <-c.shutdown:
+      c.stop(true)
       return
     }
   }
 }
+
+// Closes every conn and waits for everything started by the Communicator to
+// finish before closing Raw_remote_bundles.  If the Updater is still running
+// everything it sends is discarded until it closes Broadcast_bundles.
+func (c *Communicator) stop(updater_running bool) {
+  close(c.quit)
+  // Clean out remote_fan_in, remote_messages, dead_conns and
+  // bootstrapped_conns so that our conn routines can terminate.
+  var drains sync.WaitGroup
+  drains.Add(4)
+  go func() {
+    defer drains.Done()
+    for _ = range c.remote_fan_in {
+    }
+  }()
+  go func() {
+    defer drains.Done()
+    for _ = range c.remote_messages {
+    }
+  }()
+  go func() {
+    defer drains.Done()
+    for _ = range c.dead_conns {
+    }
+  }()
+  go func() {
+    defer drains.Done()
+    for _ = range c.bootstrapped_conns {
+    }
+  }()
+  if updater_running {
+    drains.Add(1)
+    go func() {
+      defer drains.Done()
+      for {
+        select {
+        case _, ok := <-c.Broadcast_bundles:
+          if !ok {
+            return
+          }
+        case <-c.Bootstrap_frames:
+        case <-c.Local_checksums:
+        case <-c.Resync_requests:
+        }
+      }
+    }()
+  }
+
+  // Whatever the Auditor hasn't taken yet still gets to it, in order.
+  raw_remote, local_frames, checksums := c.raw_remote, c.local_frames, c.checksums
+  c.async(func() {
+    for _, bundle := range raw_remote {
+      c.Raw_remote_bundles <- bundle
+    }
+    for _, frame := range local_frames {
+      c.Local_frames <- frame
+    }
+    for _, checksum := range checksums {
+      c.Checksums <- checksum
+    }
+  })
+
+  // Everything already sent to a conn should make it out before the conn is
+  // closed.
+  for conn := range c.send_queues {
+    c.stopSending(conn)
+  }
+  c.pending.Wait()
+  for _, conn := range c.conns {
+    conn.Close()
+  }
+  for conn := range c.peers {
+    conn.Close()
+  }
+  c.active_conns.Wait()
+  c.pending.Wait()
+  close(c.remote_fan_in)
+  close(c.remote_messages)
+  close(c.dead_conns)
+  close(c.bootstrapped_conns)
+  drains.Wait()
+  close(c.Raw_remote_bundles)
+  close(c.done)
+}
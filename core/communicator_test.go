@@ -1,9 +1,15 @@
 package core_test
 
 import (
+  "bytes"
+  "context"
+  "fmt"
   "github.com/orfjackal/gospec/src/gospec"
   . "github.com/orfjackal/gospec/src/gospec"
   "github.com/runningwild/core"
+  "sync"
+  "sync/atomic"
+  "time"
 )
 
 func CommunicatorSpec(c gospec.Context) {
@@ -50,3 +56,1075 @@ func CommunicatorSpec(c gospec.Context) {
     // NEXT: Fill in appropriate fields, and then try to bootstrap something
   })
 }
+
+// A Conn that the test plays the other end of directly.  Closing it closes
+// data and bundles, so nothing can be sent on them afterwards.
+type testConn struct {
+  data    chan []byte
+  bundles chan core.FrameBundle
+
+  // Everything sent with SendData ends up here.
+  sent chan []byte
+
+  done      chan struct{}
+  done_once sync.Once
+}
+
+func makeTestConn() *testConn {
+  return &testConn{
+    data:    make(chan []byte, 10),
+    bundles: make(chan core.FrameBundle, 10),
+    sent:    make(chan []byte, 10),
+    done:    make(chan struct{}),
+  }
+}
+func (tc *testConn) SendData(data []byte) {
+  select {
+  case tc.sent <- data:
+  case <-tc.done:
+  }
+}
+func (tc *testConn) RecvData() <-chan []byte {
+  return tc.data
+}
+func (tc *testConn) SendFrameBundle(core.FrameBundle) {}
+func (tc *testConn) RecvFrameBundle() <-chan core.FrameBundle {
+  return tc.bundles
+}
+func (tc *testConn) Id() int {
+  return 0
+}
+func (tc *testConn) Done() <-chan struct{} {
+  return tc.done
+}
+func (tc *testConn) Err() error {
+  select {
+  case <-tc.done:
+    return core.ErrConnClosed
+  default:
+    return nil
+  }
+}
+func (tc *testConn) Close() error {
+  tc.done_once.Do(func() {
+    close(tc.done)
+    close(tc.data)
+    close(tc.bundles)
+  })
+  return nil
+}
+
+// Same fields as what the host sends first when bootstrapping.
+type testInitialData struct {
+  Version  int
+  Rejected bool
+  Horizon  core.StateFrame
+  Id       core.EngineId
+  Host     core.EngineId
+}
+
+// Same fields as what the client sends back once it has its BootstrapFrame.
+type testReply struct {
+  Ready     bool
+  Spectator bool
+}
+
+func CommunicatorJoinSpec(c gospec.Context) {
+  var communicator core.Communicator
+  communicator.Raw_remote_bundles = make(chan core.FrameBundle, 10)
+  communicator.Join_stage_timeout = time.Millisecond * 50
+  conn := makeTestConn()
+  send := func(v interface{}) {
+    data, err := core.QuickGobEncode(v)
+    c.Assume(err, Equals, error(nil))
+    conn.data <- data
+  }
+  // Returns whether the client told the host that it's not coming, and
+  // closed the conn.
+  gaveUp := func() bool {
+    select {
+    case <-conn.done:
+    default:
+      return false
+    }
+    select {
+    case data := <-conn.sent:
+      var reply testReply
+      return core.QuickGobDecode(&reply, data) == nil && !reply.Ready
+    default:
+      return false
+    }
+  }
+
+  c.Specify("Joining works when the host does its part.", func() {
+    send(testInitialData{Version: core.BootstrapVersion, Horizon: 5, Id: 123})
+    send(core.BootstrapFrame{Frame: 5, Game: &TestGame{}})
+    boot, id, err := communicator.JoinContext(context.Background(), conn)
+    c.Assume(err, Equals, error(nil))
+    c.Expect(boot.Frame, Equals, core.StateFrame(5))
+    c.Expect(id, Equals, core.EngineId(123))
+    var reply testReply
+    c.Assume(core.QuickGobDecode(&reply, <-conn.sent), Equals, error(nil))
+    c.Expect(reply, Equals, testReply{Ready: true, Spectator: false})
+  })
+
+  c.Specify("Spectating tells the host that we're only watching.", func() {
+    send(testInitialData{Version: core.BootstrapVersion, Horizon: 5, Id: 123})
+    send(core.BootstrapFrame{Frame: 5, Game: &TestGame{}})
+    boot, _, err := communicator.SpectateContext(context.Background(), conn)
+    c.Assume(err, Equals, error(nil))
+    c.Expect(boot.Frame, Equals, core.StateFrame(5))
+    var reply testReply
+    c.Assume(core.QuickGobDecode(&reply, <-conn.sent), Equals, error(nil))
+    c.Expect(reply, Equals, testReply{Ready: true, Spectator: true})
+  })
+
+  c.Specify("Joining times out if the host never says anything.", func() {
+    _, _, err := communicator.JoinContext(context.Background(), conn)
+    c.Expect(err, Equals, core.ErrJoinTimeout)
+    c.Expect(gaveUp(), Equals, true)
+  })
+
+  c.Specify("Joining times out if the host never sends a BootstrapFrame.", func() {
+    send(testInitialData{Version: core.BootstrapVersion, Horizon: 5, Id: 123})
+    _, _, err := communicator.JoinContext(context.Background(), conn)
+    c.Expect(err, Equals, core.ErrJoinTimeout)
+    c.Expect(gaveUp(), Equals, true)
+  })
+
+  c.Specify("Joining stops when the context is cancelled.", func() {
+    communicator.Join_stage_timeout = time.Hour
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+      time.Sleep(time.Millisecond * 10)
+      cancel()
+    }()
+    _, _, err := communicator.JoinContext(ctx, conn)
+    c.Expect(err, Equals, context.Canceled)
+    c.Expect(gaveUp(), Equals, true)
+  })
+
+  c.Specify("Joining fails if the host uses a different version.", func() {
+    send(testInitialData{Version: core.BootstrapVersion + 1, Horizon: 5, Id: 123})
+    _, _, err := communicator.JoinContext(context.Background(), conn)
+    c.Expect(err, Equals, core.ErrJoinVersion)
+    c.Expect(gaveUp(), Equals, true)
+  })
+
+  c.Specify("Joining fails if the host rejects us.", func() {
+    send(testInitialData{Version: core.BootstrapVersion, Rejected: true})
+    _, _, err := communicator.JoinContext(context.Background(), conn)
+    c.Expect(err, Equals, core.ErrJoinRejected)
+  })
+
+  c.Specify("Joining fails if the host sends garbage.", func() {
+    conn.data <- []byte("MONKEYS")
+    _, _, err := communicator.JoinContext(context.Background(), conn)
+    c.Expect(err, Equals, core.ErrJoinDecode)
+    c.Expect(gaveUp(), Equals, true)
+  })
+
+  c.Specify("Joining fails if the conn dies.", func() {
+    conn.Close()
+    _, _, err := communicator.JoinContext(context.Background(), conn)
+    c.Expect(err, Equals, core.ErrConnClosed)
+  })
+}
+
+// A Network that only ever delivers the Conns that the test gives it.
+type testNetwork struct {
+  conns chan core.Conn
+}
+
+func (tn *testNetwork) Host(func([]byte) ([]byte, error), func([]byte) error) error {
+  return nil
+}
+func (tn *testNetwork) Ping([]byte) ([]core.RemoteHost, error) {
+  return nil, nil
+}
+func (tn *testNetwork) Join(core.RemoteHost, []byte) (core.Conn, error) {
+  return nil, core.ErrConnClosed
+}
+func (tn *testNetwork) NewConns() <-chan core.Conn {
+  return tn.conns
+}
+func (tn *testNetwork) ActiveConnections() int {
+  return 0
+}
+func (tn *testNetwork) Shutdown() {}
+
+// Same fields as a message carrying a run of empty bundles.
+type testEmptyMessage struct {
+  Empty *testEmptyFrames
+}
+type testEmptyFrames struct {
+  Id          core.EngineId
+  First, Last core.StateFrame
+}
+
+// A Game that was never registered with gob, so it can't be encoded.
+type unregisteredGame struct {
+  TestGame
+}
+
+func CommunicatorBootstrapSpec(c gospec.Context) {
+  net := &testNetwork{conns: make(chan core.Conn)}
+  broadcast_bundles := make(chan core.FrameBundle)
+  bootstrap_frames := make(chan core.BootstrapFrame)
+  local_engine_event := make(chan core.EngineEvent, 10)
+  failures := make(chan core.FailedJoin, 10)
+  dropped_engines := make(chan core.DroppedEngine, 10)
+  var communicator core.Communicator
+  communicator.Params.Max_frames = 10
+  communicator.Net = net
+  communicator.Broadcast_bundles = broadcast_bundles
+  raw_remote_bundles := make(chan core.FrameBundle, 10)
+  communicator.Raw_remote_bundles = raw_remote_bundles
+  communicator.Bootstrap_frames = bootstrap_frames
+  communicator.Local_engine_event = local_engine_event
+  communicator.Dropped_engines = dropped_engines
+  communicator.Bootstrap_timeout = time.Millisecond * 50
+  communicator.Join_failed = func(failure core.FailedJoin) {
+    failures <- failure
+  }
+  communicator.Start()
+  defer func() {
+    close(broadcast_bundles)
+    communicator.Shutdown()
+  }()
+
+  conn := makeTestConn()
+  net.conns <- conn
+  var initial testInitialData
+  c.Assume(core.QuickGobDecode(&initial, <-conn.sent), Equals, error(nil))
+  send := func(v interface{}) {
+    data, err := core.QuickGobEncode(v)
+    c.Assume(err, Equals, error(nil))
+    conn.data <- data
+  }
+  closed := func() bool {
+    select {
+    case <-conn.done:
+      return true
+    case <-time.After(time.Second):
+      return false
+    }
+  }
+
+  c.Specify("Host gives up on engines that take too long to bootstrap.", func() {
+    failure := <-failures
+    c.Expect(failure.Id, Equals, initial.Id)
+    c.Expect(failure.Err, Equals, core.ErrBootstrapTimeout)
+    c.Expect(closed(), Equals, true)
+  })
+
+  c.Specify("Host gives up on engines that give up on it.", func() {
+    send(testReply{Ready: false})
+    failure := <-failures
+    c.Expect(failure.Id, Equals, initial.Id)
+    c.Expect(failure.Err, Equals, core.ErrJoinAbandoned)
+    c.Expect(closed(), Equals, true)
+  })
+
+  c.Specify("Host gives up on engines whose BootstrapFrame can't be encoded.", func() {
+    bootstrap_frames <- core.BootstrapFrame{Frame: initial.Horizon, Game: &unregisteredGame{}}
+    failure := <-failures
+    c.Expect(failure.Id, Equals, initial.Id)
+    c.Expect(failure.Err, Not(Equals), error(nil))
+    c.Expect(closed(), Equals, true)
+  })
+
+  c.Specify("Host bootstraps engines that confirm in time.", func() {
+    bootstrap_frames <- core.BootstrapFrame{Frame: initial.Horizon, Game: &TestGame{}}
+    var boot core.BootstrapFrame
+    c.Assume(core.QuickGobDecode(&boot, <-conn.sent), Equals, error(nil))
+    c.Expect(boot.Frame, Equals, initial.Horizon)
+    send(testReply{Ready: true})
+    c.Expect(<-local_engine_event, Equals, core.EngineEvent(core.EngineJoined{Id: initial.Id}))
+
+    // Make sure it doesn't expire later on.
+    time.Sleep(time.Millisecond * 100)
+    select {
+    case failure := <-failures:
+      c.Expect(failure, Equals, nil)
+    case <-conn.done:
+      c.Expect("conn was closed", Equals, nil)
+    default:
+    }
+  })
+
+  c.Specify("Host drops engines that send two different bundles for the same frame.", func() {
+    auditor_events := make(chan core.EngineEvent, 10)
+    local_frames := make(chan core.StateFrame)
+    var auditor core.Auditor
+    auditor.Params.Max_frames = 10
+    auditor.Raw_remote_bundles = raw_remote_bundles
+    auditor.Remote_bundles = make(chan core.FrameBundle, 10)
+    auditor.Local_frames = local_frames
+    auditor.Local_engine_event = auditor_events
+    auditor.Start()
+
+    bootstrap_frames <- core.BootstrapFrame{Frame: initial.Horizon, Game: &TestGame{}}
+    <-conn.sent
+    send(testReply{Ready: true})
+    <-local_engine_event
+    frame := initial.Horizon + 1
+    bundle := core.FrameBundle{
+      Frame:  frame,
+      Bundle: core.EventBundle{initial.Id: core.AllEvents{Game: []core.Event{EventA{1}}}},
+    }
+    conn.bundles <- bundle
+    conn.bundles <- bundle
+    conn.bundles <- core.FrameBundle{
+      Frame:  frame,
+      Bundle: core.EventBundle{initial.Id: core.AllEvents{Game: []core.Event{EventA{2}}}},
+    }
+    select {
+    case event := <-auditor_events:
+      c.Expect(event, Equals, core.EngineEvent(core.EngineDropped{Id: initial.Id, Last_frame: frame}))
+    case <-time.After(time.Second):
+      c.Expect("engine was never dropped", Equals, nil)
+    }
+  })
+
+  c.Specify("Host never adds spectators to the game.", func() {
+    bootstrap_frames <- core.BootstrapFrame{Frame: initial.Horizon, Game: &TestGame{}}
+    <-conn.sent
+    send(testReply{Ready: true, Spectator: true})
+    time.Sleep(time.Millisecond * 100)
+    select {
+    case event := <-local_engine_event:
+      c.Expect(event, Equals, nil)
+    case bundle := <-raw_remote_bundles:
+      c.Expect(bundle, Equals, nil)
+    case failure := <-failures:
+      c.Expect(failure, Equals, nil)
+    default:
+    }
+  })
+
+  c.Specify("Host closes spectators that send events.", func() {
+    bootstrap_frames <- core.BootstrapFrame{Frame: initial.Horizon, Game: &TestGame{}}
+    <-conn.sent
+    send(testReply{Ready: true, Spectator: true})
+    c.Specify("in a run of empty bundles.", func() {
+      send(testEmptyMessage{&testEmptyFrames{Id: initial.Id, First: initial.Horizon + 1, Last: initial.Horizon + 2}})
+    })
+    c.Specify("in a bundle.", func() {
+      conn.bundles <- core.FrameBundle{
+        Frame:  initial.Horizon + 1,
+        Bundle: core.EventBundle{initial.Id: core.AllEvents{Game: []core.Event{EventA{1}}}},
+      }
+    })
+    c.Expect(closed(), Equals, true)
+    select {
+    case failure := <-failures:
+      c.Expect(failure, Equals, core.FailedJoin{Id: initial.Id, Err: core.ErrSpectatorEvents})
+    case <-time.After(time.Second):
+      c.Expect("spectator was never reported", Equals, nil)
+    }
+    select {
+    case bundle := <-raw_remote_bundles:
+      c.Expect(bundle, Equals, nil)
+    default:
+    }
+  })
+
+  c.Specify("Host drops engines that send malformed runs of empty bundles.", func() {
+    bootstrap_frames <- core.BootstrapFrame{Frame: initial.Horizon, Game: &TestGame{}}
+    <-conn.sent
+    send(testReply{Ready: true})
+    <-local_engine_event
+    send(testEmptyMessage{&testEmptyFrames{Id: initial.Id, First: initial.Horizon + 2, Last: initial.Horizon + 1}})
+    c.Expect(closed(), Equals, true)
+    select {
+    case dropped := <-dropped_engines:
+      c.Expect(dropped, Equals, core.DroppedEngine{Id: initial.Id, Err: core.ErrEmptyMalformed})
+    case <-time.After(time.Second):
+      c.Expect("engine was never dropped", Equals, nil)
+    }
+  })
+}
+
+// One end of an in-memory connection made by makePipe.  Closing either end
+// closes both.
+type pipeConn struct {
+  name, remote_name string
+  other             *pipeConn
+
+  // Number of bundles sent from this end.
+  sent_bundles int32
+
+  // What the other end sent, before and after it has been delivered.
+  in_data    chan []byte
+  in_bundles chan core.FrameBundle
+  data       chan []byte
+  bundles    chan core.FrameBundle
+
+  done      chan struct{}
+  done_once *sync.Once
+}
+
+func makePipe(a_name, b_name string) (*pipeConn, *pipeConn) {
+  done := make(chan struct{})
+  once := &sync.Once{}
+  makeEnd := func(name, remote_name string) *pipeConn {
+    return &pipeConn{
+      name:        name,
+      remote_name: remote_name,
+      in_data:     make(chan []byte, 100),
+      in_bundles:  make(chan core.FrameBundle, 100),
+      data:        make(chan []byte),
+      bundles:     make(chan core.FrameBundle),
+      done:        done,
+      done_once:   once,
+    }
+  }
+  a := makeEnd(a_name, b_name)
+  b := makeEnd(b_name, a_name)
+  a.other = b
+  b.other = a
+  go a.routine()
+  go b.routine()
+  return a, b
+}
+
+func (pc *pipeConn) routine() {
+  defer close(pc.data)
+  defer close(pc.bundles)
+  for {
+    select {
+    case data := <-pc.in_data:
+      select {
+      case pc.data <- data:
+      case <-pc.done:
+        return
+      }
+    case bundle := <-pc.in_bundles:
+      select {
+      case pc.bundles <- bundle:
+      case <-pc.done:
+        return
+      }
+    case <-pc.done:
+      return
+    }
+  }
+}
+func (pc *pipeConn) SendData(data []byte) {
+  select {
+  case pc.other.in_data <- data:
+  case <-pc.done:
+  }
+}
+func (pc *pipeConn) RecvData() <-chan []byte {
+  return pc.data
+}
+func (pc *pipeConn) SendFrameBundle(bundle core.FrameBundle) {
+  atomic.AddInt32(&pc.sent_bundles, 1)
+  select {
+  case pc.other.in_bundles <- bundle:
+  case <-pc.done:
+  }
+}
+func (pc *pipeConn) RecvFrameBundle() <-chan core.FrameBundle {
+  return pc.bundles
+}
+func (pc *pipeConn) Id() int {
+  return 0
+}
+func (pc *pipeConn) Done() <-chan struct{} {
+  return pc.done
+}
+func (pc *pipeConn) Err() error {
+  select {
+  case <-pc.done:
+    return core.ErrConnClosed
+  default:
+    return nil
+  }
+}
+func (pc *pipeConn) Close() error {
+  pc.done_once.Do(func() { close(pc.done) })
+  return nil
+}
+
+// A PeerNetwork where every engine can reach every other engine by name.
+type meshNetwork struct {
+  name  string
+  hub   *meshHub
+  conns chan core.Conn
+  join  func([]byte) error
+
+  // Set once ListenForPeers is called.
+  peers bool
+}
+
+// Everything shared by a set of meshNetworks.
+type meshHub struct {
+  hosts map[string]*meshNetwork
+
+  // Every conn made so far, oldest first.
+  made []*pipeConn
+
+  mutex sync.Mutex
+}
+
+// Returns the end at from of the most recent conn between from and to.
+func (hub *meshHub) conn(from, to string) *pipeConn {
+  hub.mutex.Lock()
+  defer hub.mutex.Unlock()
+  for i := len(hub.made) - 1; i >= 0; i-- {
+    if hub.made[i].name == from && hub.made[i].remote_name == to {
+      return hub.made[i]
+    }
+  }
+  return nil
+}
+
+type meshRemoteHost struct {
+  name string
+}
+
+func (rh meshRemoteHost) Data() []byte {
+  return nil
+}
+func (rh meshRemoteHost) Error() error {
+  return nil
+}
+
+func makeMeshNetworks(names ...string) []*meshNetwork {
+  hub := &meshHub{hosts: make(map[string]*meshNetwork)}
+  var nets []*meshNetwork
+  for _, name := range names {
+    net := &meshNetwork{
+      name:  name,
+      hub:   hub,
+      conns: make(chan core.Conn),
+    }
+    hub.hosts[name] = net
+    nets = append(nets, net)
+  }
+  return nets
+}
+
+func (mn *meshNetwork) Host(_ func([]byte) ([]byte, error), join func([]byte) error) error {
+  mn.hub.mutex.Lock()
+  defer mn.hub.mutex.Unlock()
+  mn.join = join
+  return nil
+}
+func (mn *meshNetwork) Ping([]byte) ([]core.RemoteHost, error) {
+  return nil, nil
+}
+func (mn *meshNetwork) Join(remote core.RemoteHost, data []byte) (core.Conn, error) {
+  mn.hub.mutex.Lock()
+  target := mn.hub.hosts[remote.(meshRemoteHost).name]
+  join, peers := target.join, target.peers
+  mn.hub.mutex.Unlock()
+  if bytes.Equal(data, core.PeerJoinData) {
+    if !peers {
+      return nil, core.ErrConnClosed
+    }
+  } else {
+    if join == nil {
+      return nil, core.ErrConnClosed
+    }
+    if err := join(data); err != nil {
+      return nil, err
+    }
+  }
+  a, b := makePipe(mn.name, target.name)
+  mn.hub.mutex.Lock()
+  mn.hub.made = append(mn.hub.made, a, b)
+  mn.hub.mutex.Unlock()
+  go func() {
+    select {
+    case target.conns <- b:
+    case <-time.After(time.Second):
+      b.Close()
+    }
+  }()
+  return a, nil
+}
+func (mn *meshNetwork) NewConns() <-chan core.Conn {
+  return mn.conns
+}
+func (mn *meshNetwork) ActiveConnections() int {
+  return 0
+}
+func (mn *meshNetwork) Shutdown() {}
+func (mn *meshNetwork) ListenForPeers() error {
+  mn.hub.mutex.Lock()
+  defer mn.hub.mutex.Unlock()
+  mn.peers = true
+  return nil
+}
+func (mn *meshNetwork) PeerAddr(conn core.Conn) (string, error) {
+  name := conn.(*pipeConn).remote_name
+  mn.hub.mutex.Lock()
+  defer mn.hub.mutex.Unlock()
+  if !mn.hub.hosts[name].peers {
+    return "", core.ErrPeerNotListening
+  }
+  return name, nil
+}
+func (mn *meshNetwork) PeerHost(addr string) (core.RemoteHost, error) {
+  return meshRemoteHost{addr}, nil
+}
+
+// Everything a test needs to drive a Communicator and see what it does.
+type testEngine struct {
+  communicator      core.Communicator
+  broadcast_bundles chan core.FrameBundle
+  bootstrap_frames  chan core.BootstrapFrame
+  remote_bundles    chan core.FrameBundle
+  dropped_engines   chan core.DroppedEngine
+  promotions        chan struct{}
+  stopped           bool
+}
+
+func makeTestEngine(net core.Network, id core.EngineId) *testEngine {
+  te := &testEngine{
+    broadcast_bundles: make(chan core.FrameBundle),
+    bootstrap_frames:  make(chan core.BootstrapFrame),
+    remote_bundles:    make(chan core.FrameBundle, 100),
+    dropped_engines:   make(chan core.DroppedEngine, 10),
+    promotions:        make(chan struct{}, 10),
+  }
+  te.communicator.Params.Id = id
+  te.communicator.Params.Max_frames = 10
+  te.communicator.Net = net
+  te.communicator.Broadcast_bundles = te.broadcast_bundles
+  te.communicator.Bootstrap_frames = te.bootstrap_frames
+  te.communicator.Raw_remote_bundles = te.remote_bundles
+  te.communicator.Local_engine_event = make(chan core.EngineEvent, 10)
+  te.communicator.Dropped_engines = te.dropped_engines
+  te.communicator.Promotions = te.promotions
+  return te
+}
+
+func (te *testEngine) shutdown() {
+  if te.stopped {
+    return
+  }
+  te.stopped = true
+  close(te.broadcast_bundles)
+  te.communicator.Shutdown()
+}
+
+// Waits a little while for a bundle for frame from id, discarding anything
+// else that comes first.
+func waitForBundle(bundles <-chan core.FrameBundle, frame core.StateFrame, id core.EngineId) bool {
+  timeout := time.After(time.Second)
+  for {
+    select {
+    case bundle := <-bundles:
+      if _, ok := bundle.Bundle[id]; ok && bundle.Frame == frame {
+        return true
+      }
+    case <-timeout:
+      return false
+    }
+  }
+}
+
+// Starts a host on nets[0] with id 1, then has a client on each of the other
+// nets join it.  The clients also connect to each other.  If setup isn't nil
+// it is called on every engine before it starts.  The caller has to shut all
+// of them down.
+func startTestGame(c gospec.Context, nets []*meshNetwork, setup func(*testEngine)) (*testEngine, []*testEngine) {
+  var networks []core.Network
+  for _, net := range nets {
+    networks = append(networks, net)
+  }
+  return startTestGameOn(c, networks, meshRemoteHost{nets[0].name}, setup)
+}
+
+// Like startTestGame, but for any PeerNetworks.  remote is where the clients
+// find the host.
+func startTestGameOn(c gospec.Context, nets []core.Network, remote core.RemoteHost, setup func(*testEngine)) (*testEngine, []*testEngine) {
+  err := nets[0].Host(func([]byte) ([]byte, error) {
+    return nil, nil
+  }, func([]byte) error {
+    return nil
+  })
+  c.Assume(err, Equals, error(nil))
+  host := makeTestEngine(nets[0], 1)
+  if setup != nil {
+    setup(host)
+  }
+  host.communicator.Start()
+
+  var clients []*testEngine
+  for _, net := range nets[1:] {
+    c.Assume(net.(core.PeerNetwork).ListenForPeers(), Equals, error(nil))
+    conn, err := net.Join(remote, []byte("MONKEYS"))
+    c.Assume(err, Equals, error(nil))
+    go func() {
+      // Give the host a moment to pick up the conn.
+      time.Sleep(time.Millisecond * 50)
+      host.bootstrap_frames <- core.BootstrapFrame{Frame: 1, Game: &TestGame{}}
+    }()
+    client := makeTestEngine(net, 0)
+    _, id, err := client.communicator.Join(conn)
+    c.Assume(err, Equals, error(nil))
+    client.communicator.Params.Id = id
+    if setup != nil {
+      setup(client)
+    }
+    client.communicator.Start()
+    clients = append(clients, client)
+  }
+  time.Sleep(time.Millisecond * 100)
+  return host, clients
+}
+
+func CommunicatorMigrationSpec(c gospec.Context) {
+  nets := makeMeshNetworks("host", "a", "b")
+  host, clients := startTestGame(c, nets, nil)
+  defer host.shutdown()
+  for _, client := range clients {
+    defer client.shutdown()
+  }
+
+  // Whichever client has the lower id takes over.
+  next, other := clients[0], clients[1]
+  if other.communicator.Params.Id < next.communicator.Params.Id {
+    next, other = other, next
+  }
+  next_id := next.communicator.Params.Id
+  other_id := other.communicator.Params.Id
+
+  c.Specify("Clients get each other's bundles.", func() {
+    other.broadcast_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{other_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(next.remote_bundles, 2, other_id), Equals, true)
+    c.Expect(waitForBundle(host.remote_bundles, 2, other_id), Equals, true)
+    c.Expect(len(next.promotions), Equals, 0)
+  })
+
+  c.Specify("The client with the lowest id takes over when the host goes away.", func() {
+    other.broadcast_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{other_id: core.AllEvents{}},
+    }
+    c.Assume(waitForBundle(next.remote_bundles, 2, other_id), Equals, true)
+    host.shutdown()
+
+    select {
+    case <-next.promotions:
+    case <-time.After(time.Second):
+      c.Expect("promoted", Equals, "not promoted")
+    }
+    select {
+    case dropped := <-next.dropped_engines:
+      c.Expect(dropped.Id, Equals, core.EngineId(1))
+    case <-time.After(time.Second):
+      c.Expect("dropped the old host", Equals, "didn't")
+    }
+    c.Expect(len(other.promotions), Equals, 0)
+
+    // Everything after goes through the new host.
+    other.broadcast_bundles <- core.FrameBundle{
+      Frame:  3,
+      Bundle: core.EventBundle{other_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(next.remote_bundles, 3, other_id), Equals, true)
+    next.broadcast_bundles <- core.FrameBundle{
+      Frame:  3,
+      Bundle: core.EventBundle{next_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(other.remote_bundles, 3, next_id), Equals, true)
+    c.Expect(next.communicator.NumConns(), Equals, 1)
+    c.Expect(other.communicator.NumConns(), Equals, 1)
+  })
+}
+
+func CommunicatorTcpMeshSpec(c gospec.Context) {
+  // Every engine is on the same machine, and they all find the host on the
+  // same port.
+  port := int(core.RandomId()%10000 + 1000)
+  var nets []core.Network
+  for i := 0; i < 3; i++ {
+    net, err := core.MakeTcpUdpNetwork(port)
+    c.Assume(err, Equals, error(nil))
+    defer net.Shutdown()
+    nets = append(nets, net)
+  }
+  remote, err := nets[0].(core.PeerNetwork).PeerHost(fmt.Sprintf("127.0.0.1:%d", port))
+  c.Assume(err, Equals, error(nil))
+  host, clients := startTestGameOn(c, nets, remote, nil)
+  defer host.shutdown()
+  for _, client := range clients {
+    defer client.shutdown()
+  }
+  next, other := clients[0], clients[1]
+  if other.communicator.Params.Id < next.communicator.Params.Id {
+    next, other = other, next
+  }
+  next_id := next.communicator.Params.Id
+  other_id := other.communicator.Params.Id
+
+  c.Specify("Clients on the same machine connect straight to each other.", func() {
+    other.broadcast_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{other_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(next.remote_bundles, 2, other_id), Equals, true)
+    c.Expect(waitForBundle(host.remote_bundles, 2, other_id), Equals, true)
+  })
+
+  c.Specify("A client on the same machine takes over when the host goes away.", func() {
+    host.shutdown()
+    select {
+    case <-next.promotions:
+    case <-time.After(time.Second):
+      c.Expect("promoted", Equals, "not promoted")
+    }
+    other.broadcast_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{other_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(next.remote_bundles, 2, other_id), Equals, true)
+    next.broadcast_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{next_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(other.remote_bundles, 2, next_id), Equals, true)
+    c.Expect(next.communicator.NumConns(), Equals, 1)
+  })
+}
+
+func CommunicatorMeshSpec(c gospec.Context) {
+  nets := makeMeshNetworks("host", "a", "b")
+  hub := nets[0].hub
+  host, clients := startTestGame(c, nets, nil)
+  defer host.shutdown()
+  for _, client := range clients {
+    defer client.shutdown()
+  }
+  a, b := clients[0], clients[1]
+  a_id := a.communicator.Params.Id
+  b_id := b.communicator.Params.Id
+  relayed := func() int32 {
+    return atomic.LoadInt32(&hub.conn("host", "b").sent_bundles)
+  }
+
+  c.Specify("Clients send bundles straight to each other.", func() {
+    before := relayed()
+    a.broadcast_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{a_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(b.remote_bundles, 2, a_id), Equals, true)
+    c.Expect(waitForBundle(host.remote_bundles, 2, a_id), Equals, true)
+    time.Sleep(time.Millisecond * 50)
+    c.Expect(relayed(), Equals, before)
+  })
+
+  c.Specify("Bundles that arrive more than once are only passed along once.", func() {
+    bundle := core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{a_id: core.AllEvents{}},
+    }
+    hub.conn("a", "b").SendFrameBundle(bundle)
+    hub.conn("host", "b").SendFrameBundle(bundle)
+    c.Expect(waitForBundle(b.remote_bundles, 2, a_id), Equals, true)
+    time.Sleep(time.Millisecond * 50)
+    c.Expect(len(b.remote_bundles), Equals, 0)
+  })
+
+  c.Specify("The host passes bundles along once clients lose their own conn.", func() {
+    a.broadcast_bundles <- core.FrameBundle{
+      Frame:  2,
+      Bundle: core.EventBundle{a_id: core.AllEvents{}},
+    }
+    c.Assume(waitForBundle(b.remote_bundles, 2, a_id), Equals, true)
+    hub.conn("a", "b").Close()
+    time.Sleep(time.Millisecond * 50)
+
+    // The host sends b everything recent from a again, in case it was lost.
+    c.Expect(waitForBundle(b.remote_bundles, 2, a_id), Equals, false)
+    c.Expect(relayed() > 0, Equals, true)
+    a.broadcast_bundles <- core.FrameBundle{
+      Frame:  3,
+      Bundle: core.EventBundle{a_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(b.remote_bundles, 3, a_id), Equals, true)
+    b.broadcast_bundles <- core.FrameBundle{
+      Frame:  3,
+      Bundle: core.EventBundle{b_id: core.AllEvents{}},
+    }
+    c.Expect(waitForBundle(a.remote_bundles, 3, b_id), Equals, true)
+  })
+}
+
+// Waits a little while for bundles from id for every frame from first through
+// last, returns whether they all showed up with no events in them.
+func waitForEmptyBundles(bundles <-chan core.FrameBundle, id core.EngineId, first, last core.StateFrame) bool {
+  missing := make(map[core.StateFrame]bool)
+  for frame := first; frame <= last; frame++ {
+    missing[frame] = true
+  }
+  timeout := time.After(time.Second)
+  for len(missing) > 0 {
+    select {
+    case bundle := <-bundles:
+      events, ok := bundle.Bundle[id]
+      if !ok {
+        break
+      }
+      if len(bundle.Bundle) != 1 || len(events.Game) != 0 || len(events.Engine) != 0 {
+        return false
+      }
+      delete(missing, bundle.Frame)
+    case <-timeout:
+      return false
+    }
+  }
+  return true
+}
+
+func CommunicatorBatchSpec(c gospec.Context) {
+  nets := makeMeshNetworks("host", "a", "b")
+  hub := nets[0].hub
+  host, clients := startTestGame(c, nets, func(te *testEngine) {
+    te.communicator.Params.Frame_ms = 20
+    te.communicator.Empty_batch = 4
+  })
+  defer host.shutdown()
+  for _, client := range clients {
+    defer client.shutdown()
+  }
+  a, b := clients[0], clients[1]
+  a_id := a.communicator.Params.Id
+  sent := func() int32 {
+    return atomic.LoadInt32(&hub.conn("a", "host").sent_bundles) +
+      atomic.LoadInt32(&hub.conn("a", "b").sent_bundles)
+  }
+  empty := func(frame core.StateFrame) core.FrameBundle {
+    return core.FrameBundle{
+      Frame:  frame,
+      Bundle: core.EventBundle{a_id: core.AllEvents{}},
+    }
+  }
+
+  c.Specify("Runs of empty bundles are sent as a single message.", func() {
+    before := sent()
+    for frame := core.StateFrame(2); frame <= 9; frame++ {
+      a.broadcast_bundles <- empty(frame)
+    }
+    c.Expect(waitForEmptyBundles(host.remote_bundles, a_id, 2, 9), Equals, true)
+    c.Expect(waitForEmptyBundles(b.remote_bundles, a_id, 2, 9), Equals, true)
+    c.Expect(sent(), Equals, before)
+  })
+
+  c.Specify("Bundles with events go out right away, after any held back ones.", func() {
+    a.broadcast_bundles <- empty(2)
+    a.broadcast_bundles <- empty(3)
+    a.broadcast_bundles <- core.FrameBundle{
+      Frame:  4,
+      Bundle: core.EventBundle{a_id: core.AllEvents{Game: []core.Event{EventA{3}}}},
+    }
+    // The run and the bundle after it can arrive in either order.
+    events := make(map[core.StateFrame]int)
+    timeout := time.After(time.Second)
+    for len(events) < 3 {
+      select {
+      case bundle := <-host.remote_bundles:
+        events[bundle.Frame] = len(bundle.Bundle[a_id].Game)
+      case <-timeout:
+        c.Expect("got frames 2 through 4", Equals, "didn't")
+        return
+      }
+    }
+    c.Expect(events, Equals, map[core.StateFrame]int{2: 0, 3: 0, 4: 1})
+  })
+
+  c.Specify("Empty bundles aren't held back for long.", func() {
+    a.broadcast_bundles <- empty(2)
+    c.Expect(waitForEmptyBundles(host.remote_bundles, a_id, 2, 2), Equals, true)
+  })
+
+  c.Specify("The host passes runs of empty bundles along.", func() {
+    hub.conn("a", "b").Close()
+    time.Sleep(time.Millisecond * 50)
+    for frame := core.StateFrame(2); frame <= 5; frame++ {
+      a.broadcast_bundles <- empty(frame)
+    }
+    c.Expect(waitForEmptyBundles(b.remote_bundles, a_id, 2, 5), Equals, true)
+  })
+}
+
+func CommunicatorSendSpec(c gospec.Context) {
+  c.Specify("Bundles and frames go out in the order they were broadcast.", func() {
+    local_frames := make(chan core.StateFrame, 100)
+    host, clients := startTestGame(c, makeMeshNetworks("host", "a"), func(te *testEngine) {
+      if te.communicator.Params.Id == 1 {
+        te.communicator.Local_frames = local_frames
+      }
+    })
+    defer host.shutdown()
+    defer clients[0].shutdown()
+    for frame := core.StateFrame(2); frame < 100; frame++ {
+      host.broadcast_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{1: core.AllEvents{}},
+      }
+    }
+    for frame := core.StateFrame(2); frame < 100; frame++ {
+      c.Expect(<-local_frames, Equals, frame)
+      c.Expect((<-clients[0].remote_bundles).Frame, Equals, frame)
+    }
+  })
+
+  c.Specify("Host drops engines that fall too far behind on what it sends them.", func() {
+    net := &testNetwork{conns: make(chan core.Conn)}
+    broadcast_bundles := make(chan core.FrameBundle)
+    bootstrap_frames := make(chan core.BootstrapFrame)
+    local_checksums := make(chan core.FrameChecksum)
+    local_engine_event := make(chan core.EngineEvent, 10)
+    dropped_engines := make(chan core.DroppedEngine, 10)
+    var communicator core.Communicator
+    communicator.Params.Max_frames = 10
+    communicator.Net = net
+    communicator.Broadcast_bundles = broadcast_bundles
+    communicator.Raw_remote_bundles = make(chan core.FrameBundle, 10)
+    communicator.Bootstrap_frames = bootstrap_frames
+    communicator.Local_checksums = local_checksums
+    communicator.Local_engine_event = local_engine_event
+    communicator.Dropped_engines = dropped_engines
+    communicator.Send_queue = 2
+    communicator.Start()
+    defer func() {
+      close(broadcast_bundles)
+      communicator.Shutdown()
+    }()
+
+    conn := makeTestConn()
+    net.conns <- conn
+    var initial testInitialData
+    c.Assume(core.QuickGobDecode(&initial, <-conn.sent), Equals, error(nil))
+    bootstrap_frames <- core.BootstrapFrame{Frame: initial.Horizon, Game: &TestGame{}}
+    <-conn.sent
+    data, err := core.QuickGobEncode(testReply{Ready: true})
+    c.Assume(err, Equals, error(nil))
+    conn.data <- data
+    <-local_engine_event
+
+    // Nobody reads what is sent on conn from here on, so once it has as
+    // much as it can hold the rest waits in its queue.
+    for frame := core.StateFrame(1); frame <= 20; frame++ {
+      local_checksums <- core.FrameChecksum{Frame: frame}
+    }
+    select {
+    case dropped := <-dropped_engines:
+      c.Expect(dropped, Equals, core.DroppedEngine{Id: initial.Id, Err: core.ErrSendQueueFull})
+    case <-time.After(time.Second):
+      c.Expect("engine was never dropped", Equals, nil)
+    }
+  })
+}
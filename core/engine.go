@@ -35,6 +35,9 @@ type EngineEvent interface {
 func init() {
   gob.Register(EngineJoined{})
   gob.Register(EngineDropped{})
+  gob.Register(EngineDelayChanged{})
+  gob.Register(EnginePaused{})
+  gob.Register(EngineResumed{})
 }
 
 type EngineJoined struct {
@@ -45,14 +48,105 @@ func (e EngineJoined) Apply(info *EngineInfo) {
   info.Engines[e.Id] = true
 }
 
+// Removes an engine from the game.  Events from the dropped engine are used
+// for every frame up to and including Last_frame, after that only empty
+// events are used for it until the EngineDropped is applied.  An engine that
+// is leaving on its own sends an EngineDropped with its own Id, in which case
+// Last_frame is ignored and it is the frame that the event is on instead.
 type EngineDropped struct {
-  Id EngineId
+  Id         EngineId
+  Last_frame StateFrame
 }
 
 func (e EngineDropped) Apply(info *EngineInfo) {
   delete(info.Engines, e.Id)
 }
 
+// Changes the number of frames that every engine waits before applying its
+// local events.  Each engine starts using the new delay once the frame that
+// this is applied on is finalized.
+type EngineDelayChanged struct {
+  Delay StateFrame
+}
+
+func (e EngineDelayChanged) Apply(info *EngineInfo) {
+  info.Delay = e.Delay
+}
+
+// Pauses the game, starting on the frame that this is applied on.  Events are
+// still applied while the game is paused, but the Game doesn't Think.  Every
+// engine stops sending bundles after Last_frame, which is filled in by the
+// Bundler that sends this, until an EngineResumed is applied.
+type EnginePaused struct {
+  Last_frame StateFrame
+}
+
+func (e EnginePaused) Apply(info *EngineInfo) {
+  info.Paused = true
+}
+
+// Resumes a paused game, starting on the frame that this is applied on.  If
+// the engines have already stopped sending bundles then this goes out on the
+// frame after Last_frame, and everyone starts sending bundles again from
+// there.
+type EngineResumed struct{}
+
+func (e EngineResumed) Apply(info *EngineInfo) {
+  info.Paused = false
+}
+
+// Sent from the Updater to the Bundler whenever an EnginePaused or an
+// EngineResumed shows up in a bundle, whether or not the frame it's on is
+// final yet.
+type PauseChange struct {
+  // The frame that the event is applied on.
+  Frame StateFrame
+
+  Paused bool
+
+  // Copied from EnginePaused.Last_frame.
+  Last_frame StateFrame
+}
+
+// Sent from the Updater whenever it starts or stops lagging, which is when it
+// has no room for more of this engine's bundles until some other engines catch
+// up.  While it lags the Bundler stalls.
+type Lag struct {
+  // The oldest frame that isn't final yet.
+  Frame StateFrame
+
+  Lagging bool
+
+  // The engines that we are still waiting on for bundles on Frame, only set
+  // when Lagging is true.
+  Engines []EngineId
+}
+
+// Sent from the Updater for every engine that joins or leaves the game, once
+// the frame it happened on is final.
+type EngineChange struct {
+  Frame  StateFrame
+  Id     EngineId
+  Joined bool
+}
+
+// Sent from the Updater whenever bundles show up for frames that it has
+// already simulated, so that it has to go back and simulate them again.
+type Rollback struct {
+  // The oldest frame that was simulated again.
+  Frame StateFrame
+
+  // How many frames were simulated again, starting with Frame.
+  Frames int
+}
+
+// Sent from the Updater to the Auditor whenever an engine has sent two
+// different bundles for the same frame.
+type BundleConflict struct {
+  Id    EngineId
+  Frame StateFrame
+}
+
 // Contains information necessary to processing StateFrames.  The data in an
 // EngineInfo can also be modified, like the GameState, but can only be done
 // by the host.
@@ -64,10 +158,19 @@ type EngineInfo struct {
   // This means that no events are expected from an engine on the first frame
   // on which that engine is listed in this set.
   Engines map[EngineId]bool
+
+  // Number of frames that every engine waits before applying its local
+  // events, see EngineParams.Delay.
+  Delay StateFrame
+
+  // True if the game is paused, see EnginePaused.
+  Paused bool
 }
 
 func (ei *EngineInfo) Copy() EngineInfo {
   var ei2 EngineInfo
+  ei2.Delay = ei.Delay
+  ei2.Paused = ei.Paused
   ei2.Engines = make(map[EngineId]bool)
   for k, v := range ei.Engines {
     ei2.Engines[k] = v
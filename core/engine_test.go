@@ -19,7 +19,8 @@ func makeUnstarted(params core.EngineParams, net core.Network, ticker core.Ticke
   bundler.Local_event = local_event
   bundler.Local_engine_event = local_engine_event
   bundler.Ticker = ticker
-  bundler.Time_delta = nil
+  time_delta := make(chan int64)
+  bundler.Time_delta = time_delta
 
   bootstrap_frames := make(chan core.BootstrapFrame)
   broadcast_bundles := make(chan core.FrameBundle)
@@ -30,6 +31,15 @@ func makeUnstarted(params core.EngineParams, net core.Network, ticker core.Ticke
   updater.Broadcast_bundles = broadcast_bundles
   updater.Local_bundles = local_bundles
   updater.Remote_bundles = remote_bundles
+  local_checksums := make(chan core.FrameChecksum)
+  updater.Checksums = local_checksums
+  resync_requests := make(chan struct{})
+  resync_frames := make(chan core.BootstrapFrame)
+  updater.Resync_requests = resync_requests
+  updater.Resync_frames = resync_frames
+  frame_limits := make(chan core.StateFrame)
+  updater.Frame_limits = frame_limits
+  bundler.Frame_limits = frame_limits
 
   var communicator core.Communicator
   raw_remote_bundles := make(chan core.FrameBundle)
@@ -39,10 +49,25 @@ func makeUnstarted(params core.EngineParams, net core.Network, ticker core.Ticke
   // communicator.Host_conn=
   communicator.Net = net
   communicator.Raw_remote_bundles = raw_remote_bundles
+  local_frames := make(chan core.StateFrame)
+  dropped_engines := make(chan core.DroppedEngine)
+  communicator.Local_frames = local_frames
+  communicator.Dropped_engines = dropped_engines
+  checksums := make(chan core.FrameChecksum)
+  communicator.Local_checksums = local_checksums
+  communicator.Checksums = checksums
+  communicator.Resync_requests = resync_requests
+  communicator.Resync_frames = resync_frames
 
   var auditor core.Auditor
+  auditor.Params = params
   auditor.Raw_remote_bundles = raw_remote_bundles
   auditor.Remote_bundles = remote_bundles
+  auditor.Local_frames = local_frames
+  auditor.Dropped_engines = dropped_engines
+  auditor.Local_engine_event = local_engine_event
+  auditor.Time_delta = time_delta
+  auditor.Checksums = checksums
 
   return local_event, &bundler, &updater, &communicator, &auditor
 }
@@ -88,11 +113,15 @@ func EngineUdpTcpSpec(c gospec.Context) {
     communicator.Start()
     auditor.Start()
     local_event <- EventA{3}
+    // The Bundler stamps its bundles Delay frames ahead and the frames before
+    // its first bundle get empty ones, so the first tick finalizes Delay extra
+    // frames.  After that it's one frame per tick.
     for i := 0; i < 10; i++ {
       host_ticker.Inc(int(params.Frame_ms))
       gs, _ := host_updater.RequestFinalGameState(-1)
-      c.Expect(gs.(*TestGame).Thinks, Equals, i+1)
-      if gs.(*TestGame).Thinks != i+1 {
+      thinks := i + 1 + int(params.Delay)
+      c.Expect(gs.(*TestGame).Thinks, Equals, thinks)
+      if gs.(*TestGame).Thinks != thinks {
         return
       }
     }
@@ -130,7 +159,7 @@ func EngineUdpTcpSpec(c gospec.Context) {
         case <-done:
           goto joined
         default:
-          host_ticker.Inc(10)
+          host_ticker.Inc(1)
           time.Sleep(time.Millisecond)
         }
       }
@@ -141,6 +170,8 @@ func EngineUdpTcpSpec(c gospec.Context) {
 
       bundler.Params.Id = id
       client_updater.Params.Id = id
+      auditor.Params.Id = id
+      auditor.Local_engine_event = nil
       c.Expect(err, Equals, error(nil))
       if err != nil {
         return
@@ -152,10 +183,13 @@ func EngineUdpTcpSpec(c gospec.Context) {
       communicator.Start()
       auditor.Start()
 
-      // Run the engines until they've actually connected
+      // Run the engines until they've actually connected, giving the network
+      // a moment each frame so that neither engine runs off the end of its
+      // window.
       for client_updater.NumEngines() < 2 && host_updater.NumEngines() < 2 {
         client_ticker.Inc(int(params.Frame_ms))
         host_ticker.Inc(int(params.Frame_ms))
+        time.Sleep(time.Millisecond)
       }
 
       // Now make sure that the two engines are in sync.  Ideally this will
@@ -175,35 +209,37 @@ func EngineUdpTcpSpec(c gospec.Context) {
         host_updater.RequestFinalGameState(current_host_frame)
       }
 
-      target := 100
-      client_a := -1
-      host_a := -2
-      max := 0
-      for i := 0; i < 2000; i++ {
-        current_client_frame++
-        current_host_frame++
+      // Either engine can finalize more than one frame per tick, so rather
+      // than stepping through frames one at a time we ask both of them for
+      // the same frame up front and compare the games they give us.
+      target := current_host_frame + 100
+      games := make(chan TestGame, 2)
+      for _, updater := range []*core.Updater{client_updater, host_updater} {
+        updater := updater
+        go func() {
+          gs, _ := updater.RequestFinalGameState(target)
+          games <- *gs.(*TestGame)
+        }()
+      }
+      var results []TestGame
+      for i := 0; i < 2000 && len(results) < 2; i++ {
         go host_ticker.Inc(17)
         go client_ticker.Inc(17)
-
         local_event <- EventA{3}
-        _gsc, _ := client_updater.RequestFinalGameState(current_client_frame)
-        gsc := _gsc.(*TestGame)
-        if gsc.Thinks == target {
-          client_a = gsc.A
-        }
-        max = gsc.Thinks
-        _gsh, _ := host_updater.RequestFinalGameState(current_host_frame)
-        gsh := _gsh.(*TestGame)
-        if gsh.Thinks == target {
-          host_a = gsh.A
-        }
-        if client_a > 0 && host_a > 0 {
-          break
+        select {
+        case game := <-games:
+          results = append(results, game)
+        case <-time.After(time.Millisecond):
         }
       }
-      c.Expect(max, Equals, target)
-      c.Expect(client_a, Not(Equals), -1)
-      c.Expect(client_a, Equals, host_a)
+      c.Assume(len(results), Equals, 2)
+      // The game thinks once per frame, so the game on frame target has
+      // thought exactly target times.  The Delay frames that the Bundler
+      // skips at the start still get thought on, with empty bundles.
+      c.Expect(results[0].Thinks, Equals, int(target))
+      c.Expect(results[1].Thinks, Equals, int(target))
+      c.Expect(results[0].A > 0, Equals, true)
+      c.Expect(results[0].A, Equals, results[1].A)
     }
   })
 }
@@ -245,11 +281,15 @@ func EngineSpec(c gospec.Context) {
     communicator.Start()
     auditor.Start()
     local_event <- EventA{3}
+    // The Bundler stamps its bundles Delay frames ahead and the frames before
+    // its first bundle get empty ones, so the first tick finalizes Delay extra
+    // frames.  After that it's one frame per tick.
     for i := 0; i < 10; i++ {
       host_ticker.Inc(int(params.Frame_ms))
       gs, _ := host_updater.RequestFinalGameState(-1)
-      c.Expect(gs.(*TestGame).Thinks, Equals, i+1)
-      if gs.(*TestGame).Thinks != i+1 {
+      thinks := i + 1 + int(params.Delay)
+      c.Expect(gs.(*TestGame).Thinks, Equals, thinks)
+      if gs.(*TestGame).Thinks != thinks {
         return
       }
     }
@@ -288,6 +328,8 @@ func EngineSpec(c gospec.Context) {
 
       bundler.Params.Id = id
       client_updater.Params.Id = id
+      auditor.Params.Id = id
+      auditor.Local_engine_event = nil
       c.Expect(err, Equals, error(nil))
       if err != nil {
         return
@@ -323,35 +365,37 @@ func EngineSpec(c gospec.Context) {
         host_updater.RequestFinalGameState(current_host_frame)
       }
 
-      target := 100
-      client_a := -1
-      host_a := -2
-      max := 0
-      for i := 0; i < 2000; i++ {
-        current_client_frame++
-        current_host_frame++
+      // Either engine can finalize more than one frame per tick, so rather
+      // than stepping through frames one at a time we ask both of them for
+      // the same frame up front and compare the games they give us.
+      target := current_host_frame + 100
+      games := make(chan TestGame, 2)
+      for _, updater := range []*core.Updater{client_updater, host_updater} {
+        updater := updater
+        go func() {
+          gs, _ := updater.RequestFinalGameState(target)
+          games <- *gs.(*TestGame)
+        }()
+      }
+      var results []TestGame
+      for i := 0; i < 2000 && len(results) < 2; i++ {
         go host_ticker.Inc(17)
         go client_ticker.Inc(17)
-
         local_event <- EventA{3}
-        _gsc, _ := client_updater.RequestFinalGameState(current_client_frame)
-        gsc := _gsc.(*TestGame)
-        if gsc.Thinks == target {
-          client_a = gsc.A
-        }
-        max = gsc.Thinks
-        _gsh, _ := host_updater.RequestFinalGameState(current_host_frame)
-        gsh := _gsh.(*TestGame)
-        if gsh.Thinks == target {
-          host_a = gsh.A
-        }
-        if client_a > 0 && host_a > 0 {
-          break
+        select {
+        case game := <-games:
+          results = append(results, game)
+        case <-time.After(time.Millisecond):
         }
       }
-      c.Expect(max, Equals, target)
-      c.Expect(client_a, Not(Equals), -1)
-      c.Expect(client_a, Equals, host_a)
+      c.Assume(len(results), Equals, 2)
+      // The game thinks once per frame, so the game on frame target has
+      // thought exactly target times.  The Delay frames that the Bundler
+      // skips at the start still get thought on, with empty bundles.
+      c.Expect(results[0].Thinks, Equals, int(target))
+      c.Expect(results[1].Thinks, Equals, int(target))
+      c.Expect(results[0].A > 0, Equals, true)
+      c.Expect(results[0].A, Equals, results[1].A)
     }
   })
 }
@@ -4,11 +4,17 @@ import (
   "bytes"
   "encoding/gob"
   "fmt"
+  "reflect"
+  "sort"
 )
 
-// FirstX happens once, potentially before any events arrive
+// FirstX happens once, the first time a frame is simulated with X, potentially
+// before any events from other engines arrive
 // X can happen multiple times, whenever anything changes
-// FinalX only happens after all events have arrived
+// FinalX happens once, when the frame is finalized after all events have
+// arrived
+// FirstX and FinalX are called on the Game right after it was simulated for
+// that frame, they are for effects like sounds and must not modify the Game.
 
 type Event interface {
   // Cannot modify the Game
@@ -16,10 +22,13 @@ type Event interface {
 
   // Can modify the game
   Apply(interface{})
+
+  // Cannot modify the Game
   ApplyFinal(interface{})
 }
 
 type Game interface {
+  // Not called on frames where the Game doesn't Think, such as while paused.
   ThinkFirst()
   Think()
   ThinkFinal()
@@ -28,12 +37,23 @@ type Game interface {
   OverwriteWith(game interface{})
 }
 
+// A Game can optionally implement Checksummer, in which case the checksum of
+// every finalized frame is compared between all engines so that the
+// application can be told when engines have fallen out of sync.  Any two
+// Games in the same state must return the same checksum, even on different
+// machines.
+type Checksummer interface {
+  Checksum() uint64
+}
+
 type AllEvents struct {
   Game   []Event
   Engine []EngineEvent
 }
 
-func (ae *AllEvents) GobEncode() ([]byte, error) {
+// GobEncode has a value receiver so that AllEvents can be encoded when stored
+// by value in an EventBundle.
+func (ae AllEvents) GobEncode() ([]byte, error) {
   buf := bytes.NewBuffer(nil)
   enc := gob.NewEncoder(buf)
   err := enc.Encode(uint32(len(ae.Game)))
@@ -106,43 +126,116 @@ type FrameBundle struct {
   Bundle EventBundle
 }
 
-func (fb EventBundle) AbsorbEventBundle(fb2 EventBundle) {
+// Returned by AbsorbEventBundle when an engine's events are already in the
+// bundle and the new ones are different, which means that the engine sent two
+// different bundles for the same frame.
+type ConflictError struct {
+  Id EngineId
+}
+
+func (e *ConflictError) Error() string {
+  return fmt.Sprintf("Engine %d sent conflicting bundles.", e.Id)
+}
+
+// Adds the events of every engine in fb2 to fb.  Engines whose events are
+// already in fb are duplicates, those are dropped if they are identical to
+// what is already there.  Otherwise the events already in fb are kept and a
+// *ConflictError is returned for the first such engine, after the rest of fb2
+// has been added.
+func (fb EventBundle) AbsorbEventBundle(fb2 EventBundle) error {
+  var err error
   for k, v := range fb2 {
-    if _, ok := fb[k]; ok {
-      // TODO: Maybe shouldn't panic?  But what should happen, at least need
-      // to report the error, maybe if the events are not identical then we
-      // can drop the engine.
-      panic(fmt.Sprintf("EngineId collision: %d", k))
+    if events, ok := fb[k]; ok {
+      if err == nil && !events.identical(v) {
+        err = &ConflictError{Id: k}
+      }
+      continue
     }
     fb[k] = v
   }
+  return err
+}
+
+// Returns true if ae and ae2 contain the same events, either because they are
+// deeply equal or because they encode to the same bytes.
+func (ae AllEvents) identical(ae2 AllEvents) bool {
+  if len(ae.Game) != len(ae2.Game) || len(ae.Engine) != len(ae2.Engine) {
+    return false
+  }
+  equal := true
+  for i := range ae.Game {
+    if !reflect.DeepEqual(ae.Game[i], ae2.Game[i]) {
+      equal = false
+    }
+  }
+  for i := range ae.Engine {
+    if !reflect.DeepEqual(ae.Engine[i], ae2.Engine[i]) {
+      equal = false
+    }
+  }
+  if equal {
+    return true
+  }
+  data, err := ae.GobEncode()
+  if err != nil {
+    return false
+  }
+  data2, err := ae2.GobEncode()
+  if err != nil {
+    return false
+  }
+  return bytes.Equal(data, data2)
 }
 
-// TODO: frame should be used to 'randomize' the order the bundles are
-// processed, but only for GameEvents, not EngineEvents.
+// Calls f on the game events from every engine in the bundle.  The order that
+// engines are visited in is shuffled using frame, so that no engine
+// consistently gets its events applied first, but it is the same for a given
+// frame and set of engines on every machine.
 func (fb EventBundle) Each(frame StateFrame, f func(EngineId, []Event)) {
-  fb.each(frame, func(id EngineId, all AllEvents) {
-    f(id, all.Game)
-  })
+  ids := fb.sortedIds()
+  shuffleIds(frame, ids)
+  for _, id := range ids {
+    f(id, fb[id].Game)
+  }
 }
 
+// Calls f on the engine events from every engine in the bundle, in order of
+// ascending EngineId.
 func (fb EventBundle) EachEngine(frame StateFrame, f func(EngineId, []EngineEvent)) {
-  fb.each(frame, func(id EngineId, all AllEvents) {
-    f(id, all.Engine)
-  })
-}
-
-func (fb EventBundle) each(frame StateFrame, f func(EngineId, AllEvents)) {
-  max := EngineId(-1)
-  for i := 0; i < len(fb); i++ {
-    cur := EngineId(-1)
-    for k := range fb {
-      if k > max && (k < cur || cur == -1) {
-        cur = k
-      }
-    }
-    max = cur
-    f(max, fb[cur])
+  for _, id := range fb.sortedIds() {
+    f(id, fb[id].Engine)
+  }
+}
+
+type engineIdSlice []EngineId
+
+func (s engineIdSlice) Len() int           { return len(s) }
+func (s engineIdSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s engineIdSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (fb EventBundle) sortedIds() []EngineId {
+  ids := make([]EngineId, 0, len(fb))
+  for id := range fb {
+    ids = append(ids, id)
+  }
+  sort.Sort(engineIdSlice(ids))
+  return ids
+}
+
+// Fisher-Yates shuffle seeded with frame.  This uses its own generator rather
+// than math/rand so that the order can never change out from under us, every
+// engine in a game must agree on it.
+func shuffleIds(frame StateFrame, ids []EngineId) {
+  state := uint64(frame)
+  for i := len(ids) - 1; i > 0; i-- {
+    // splitmix64
+    state += 0x9e3779b97f4a7c15
+    z := state
+    z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+    z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+    z = z ^ (z >> 31)
+    j := int(z % uint64(i+1))
+    ids[i], ids[j] = ids[j], ids[i]
   }
 }
 
@@ -0,0 +1,91 @@
+package core_test
+
+import (
+  "github.com/orfjackal/gospec/src/gospec"
+  . "github.com/orfjackal/gospec/src/gospec"
+  "github.com/runningwild/core"
+)
+
+func gameOrder(bundle core.EventBundle, frame core.StateFrame) []core.EngineId {
+  var ids []core.EngineId
+  bundle.Each(frame, func(id core.EngineId, events []core.Event) {
+    ids = append(ids, id)
+  })
+  return ids
+}
+
+func EventBundleSpec(c gospec.Context) {
+  bundle := make(core.EventBundle)
+  for id := core.EngineId(1); id <= 5; id++ {
+    bundle[id] = core.AllEvents{}
+  }
+
+  c.Specify("Engine events are visited in order of EngineId.", func() {
+    for frame := core.StateFrame(0); frame < 10; frame++ {
+      var ids []core.EngineId
+      bundle.EachEngine(frame, func(id core.EngineId, events []core.EngineEvent) {
+        ids = append(ids, id)
+      })
+      c.Expect(ids, Equals, []core.EngineId{1, 2, 3, 4, 5})
+    }
+  })
+
+  c.Specify("Game events visit every engine exactly once.", func() {
+    for frame := core.StateFrame(0); frame < 10; frame++ {
+      seen := make(map[core.EngineId]int)
+      for _, id := range gameOrder(bundle, frame) {
+        seen[id]++
+      }
+      c.Expect(len(seen), Equals, 5)
+      for id := core.EngineId(1); id <= 5; id++ {
+        c.Expect(seen[id], Equals, 1)
+      }
+    }
+  })
+
+  c.Specify("Game event order only depends on the frame and the engines.", func() {
+    // Build the same bundle in the opposite order, in case that affects
+    // anything.
+    reversed := make(core.EventBundle)
+    for id := core.EngineId(5); id >= 1; id-- {
+      reversed[id] = core.AllEvents{}
+    }
+    for frame := core.StateFrame(0); frame < 10; frame++ {
+      c.Expect(gameOrder(reversed, frame), Equals, gameOrder(bundle, frame))
+    }
+  })
+
+  c.Specify("Every engine gets to go first sometimes.", func() {
+    firsts := make(map[core.EngineId]bool)
+    for frame := core.StateFrame(0); frame < 100; frame++ {
+      firsts[gameOrder(bundle, frame)[0]] = true
+    }
+    c.Expect(len(firsts), Equals, 5)
+  })
+
+  c.Specify("Absorbing identical duplicates does nothing.", func() {
+    absorbed := core.EventBundle{1: core.AllEvents{Game: []core.Event{EventA{1}}}}
+    err := absorbed.AbsorbEventBundle(core.EventBundle{
+      1: core.AllEvents{Game: []core.Event{EventA{1}}},
+      2: core.AllEvents{},
+    })
+    c.Expect(err, Equals, error(nil))
+    c.Expect(absorbed, Equals, core.EventBundle{
+      1: core.AllEvents{Game: []core.Event{EventA{1}}},
+      2: core.AllEvents{},
+    })
+  })
+
+  c.Specify("Absorbing conflicting duplicates keeps the first ones.", func() {
+    absorbed := core.EventBundle{1: core.AllEvents{Game: []core.Event{EventA{1}}}}
+    err := absorbed.AbsorbEventBundle(core.EventBundle{
+      1: core.AllEvents{Game: []core.Event{EventA{2}}},
+      2: core.AllEvents{},
+    })
+    c.Expect(err, Equals, error(&core.ConflictError{Id: 1}))
+    c.Expect(absorbed, Equals, core.EventBundle{
+      1: core.AllEvents{Game: []core.Event{EventA{1}}},
+      2: core.AllEvents{},
+    })
+  })
+}
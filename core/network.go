@@ -1,5 +1,9 @@
 package core
 
+import (
+  "errors"
+)
+
 type EventBatch struct {
   Opaque_data int
 
@@ -31,11 +35,29 @@ type Conn interface {
   // with debugging.
   Id() int
 
-  // TODO: Must be able to tell if the connection died
+  // The returned channel is closed as soon as the connection dies, whether
+  // because Close was called, the remote end went away, or there was an
+  // error.  RecvData() and RecvFrameBundle() are closed once they have
+  // delivered everything that arrived before then.
+  Done() <-chan struct{}
+
+  // Once Done() is closed this returns the reason the connection died,
+  // before then it returns nil.
+  Err() error
 
+  // Anything already sent should still make it to the remote end if it can,
+  // but nothing else is delivered to RecvData() or RecvFrameBundle().
   Close() error
 }
 
+var (
+  // Reported by Conn.Err() after Close() is called.
+  ErrConnClosed = errors.New("Connection closed.")
+
+  // Reported by Conn.Err() if the remote end closed the connection.
+  ErrConnClosedRemotely = errors.New("Connection closed by remote host.")
+)
+
 // A Network maintains connections with other engines.
 // Host - allow others to connect to it.
 // Find - find hosts.
@@ -50,7 +72,9 @@ type Network interface {
   // join: like ping, called when someone requests to join, if error is not
   // nil it indicates that the join failed.
   // both ping and join may be called concurrently, so lock if you need to.
-  Host(ping func([]byte) ([]byte, error), join func([]byte) error)
+  // Returns an error if we can't listen for pings and joins, in which case
+  // we aren't hosting.
+  Host(ping func([]byte) ([]byte, error), join func([]byte) error) error
 
   // Search for hosts on the LAN, sending them data along with the ping.
   Ping(data []byte) ([]RemoteHost, error)
@@ -63,5 +87,45 @@ type Network interface {
 
   ActiveConnections() int
 
+  // Stops hosting and returns once the Network has stopped everything it
+  // started.  Conns that were already made are left alone.
   Shutdown()
 }
+
+// Implemented by Networks whose engines can connect straight to each other
+// rather than only to a host found with Ping.  The Communicator uses this to
+// connect every engine in a game to every other one, so that the game can
+// carry on without its host.
+type PeerNetwork interface {
+  // Starts listening for other engines in the game connecting straight to
+  // this one, separately from Host so that it doesn't get in the way of a
+  // host on the same machine.  Conns made this way show up on NewConns, but
+  // only joins with PeerJoinData are accepted.  This has to be called before
+  // joining anything, since whoever we join is told where we are listening
+  // then.  We keep listening until Shutdown.
+  ListenForPeers() error
+
+  // Returns an address for the engine on the other end of conn, which must
+  // have come from this Network.  Other engines can pass it to PeerHost.
+  // Returns ErrPeerNotListening if that engine never called ListenForPeers.
+  PeerAddr(conn Conn) (string, error)
+
+  // Returns a RemoteHost for the engine at addr which can be passed to Join.
+  // The engine must be hosting for the Join to succeed.
+  PeerHost(addr string) (RemoteHost, error)
+}
+
+// The data that engines already in a game pass to Join when connecting
+// straight to each other.
+var PeerJoinData = []byte("pnf-peer")
+
+var ErrPeerNotListening = errors.New("Engine isn't listening for peers.")
+
+// Implemented by Networks that can send FrameBundles with any Codec, those
+// that don't, and those that are never given one, use GobCodec.
+type CodecNetwork interface {
+  // Conns only pick up the codec when they are made, and the ones accepted
+  // while hosting use whatever codec was set when Host was called, so this
+  // should be called before Host or Join.
+  SetCodec(codec Codec)
+}
@@ -29,23 +29,48 @@ type ConnMock struct {
 
   pair_id int
 
+  // Encodes the bundles that go through send and recv.
+  codec Codec
+
   purge chan bool
+
+  // Closed once the conn has been shut down.
+  done chan struct{}
+
+  // Bundles can show up in any order, but data is delivered in the order it
+  // was sent, just like it is over tcp.  Data that shows up early waits in
+  // data_pending until everything before it has been delivered.
+  data_sent     uint64
+  data_received uint64
+  data_pending  map[uint64][]byte
 }
 type dataContainer struct {
   Data         []byte
-  Frame_bundle *FrameBundle
+  Data_seq     uint64
+  Frame_bundle []byte
 }
 
 func (c *ConnMock) routine() {
   current_purge := c.purge
   completed_purge := c.purge
   completed_purge = nil
+  c.data_pending = make(map[uint64][]byte)
   for {
     var dc dataContainer
     send := false
+    var recv_bytes chan<- []byte
+    next_data, ok := c.data_pending[c.data_received]
+    if ok {
+      recv_bytes = c.recv_bytes
+    }
     select {
+    case recv_bytes <- next_data:
+      delete(c.data_pending, c.data_received)
+      c.data_received++
+
     case shutdown := <-current_purge:
       if shutdown {
+        close(c.done)
         close(c.recv_bytes)
         close(c.recv_bundle)
         return
@@ -61,10 +86,17 @@ func (c *ConnMock) routine() {
 
     case data := <-c.send_bytes:
       dc.Data = data
+      dc.Data_seq = c.data_sent
+      c.data_sent++
       send = true
 
     case frame_bundle := <-c.send_bundle:
-      dc.Frame_bundle = &frame_bundle
+      data, err := c.codec.EncodeBundle(frame_bundle)
+      if err != nil {
+        panic(err)
+        // TODO: What to do?
+      }
+      dc.Frame_bundle = data
       send = true
 
     case data := <-c.recv:
@@ -75,14 +107,22 @@ func (c *ConnMock) routine() {
         panic(err)
         // TODO: What to do?
       }
-      go func() {
-        switch {
-        case dc.Data != nil:
-          c.recv_bytes <- dc.Data
-        case dc.Frame_bundle != nil:
-          c.recv_bundle <- *dc.Frame_bundle
+      var frame_bundle FrameBundle
+      if dc.Frame_bundle != nil {
+        frame_bundle, err = c.codec.DecodeBundle(dc.Frame_bundle)
+        if err != nil {
+          panic(err)
+          // TODO: What to do?
         }
-      }()
+      }
+      switch {
+      case dc.Data != nil:
+        c.data_pending[dc.Data_seq] = dc.Data
+      case dc.Frame_bundle != nil:
+        go func() {
+          c.recv_bundle <- frame_bundle
+        }()
+      }
     }
     if send {
       buf := bytes.NewBuffer(nil)
@@ -100,13 +140,19 @@ func (c *ConnMock) routine() {
 }
 
 func (c *ConnMock) SendData(data []byte) {
-  c.send_bytes <- data
+  select {
+  case c.send_bytes <- data:
+  case <-c.done:
+  }
 }
 func (c *ConnMock) RecvData() <-chan []byte {
   return c.recv_bytes
 }
 func (c *ConnMock) SendFrameBundle(frame_bundle FrameBundle) {
-  c.send_bundle <- frame_bundle
+  select {
+  case c.send_bundle <- frame_bundle:
+  case <-c.done:
+  }
 }
 func (c *ConnMock) RecvFrameBundle() <-chan FrameBundle {
   return c.recv_bundle
@@ -114,8 +160,23 @@ func (c *ConnMock) RecvFrameBundle() <-chan FrameBundle {
 func (c *ConnMock) Id() int {
   return c.pair_id
 }
+func (c *ConnMock) Done() <-chan struct{} {
+  return c.done
+}
+func (c *ConnMock) Err() error {
+  select {
+  case <-c.done:
+    return ErrConnClosed
+  default:
+    return nil
+  }
+}
 func (c *ConnMock) Close() error {
-  c.purge <- true
+  select {
+  case c.purge <- true:
+  case <-c.done:
+    return nil
+  }
   c.purge <- true
   return nil
 }
@@ -130,19 +191,23 @@ func makeConnMockPair(hm1, hm2 *HostMock) (Conn, Conn) {
 
   c1 := ConnMock{
     pair_id:     pair_id,
+    codec:       hm1.codec,
     recv_bundle: make(chan FrameBundle),
     send_bundle: make(chan FrameBundle),
     recv_bytes:  make(chan []byte),
     send_bytes:  make(chan []byte),
     purge:       make(chan bool),
+    done:        make(chan struct{}),
   }
   c2 := ConnMock{
     pair_id:     pair_id,
+    codec:       hm2.codec,
     recv_bundle: make(chan FrameBundle),
     send_bundle: make(chan FrameBundle),
     recv_bytes:  make(chan []byte),
     send_bytes:  make(chan []byte),
     purge:       make(chan bool),
+    done:        make(chan struct{}),
   }
 
   send_1 := make(chan []byte)
@@ -213,6 +278,9 @@ type HostMock struct {
   ping func([]byte) ([]byte, error)
   join func([]byte) error
 
+  // Used by every conn made after it is set, protected by net.host_mutex.
+  codec Codec
+
   conn_data map[*ConnMock]*hostConnMockData
 
   new_conns chan Conn
@@ -227,6 +295,7 @@ func NewHostMock(net *NetworkMock) Network {
   hm.net = net
   hm.id = hm.net.host_id
   hm.net.host_id++
+  hm.codec = GobCodec{}
   hm.conn_data = make(map[*ConnMock]*hostConnMockData)
   hm.new_conns = make(chan Conn)
   hm.net.hosts = append(hm.net.hosts, &hm)
@@ -272,11 +341,18 @@ func (hm *HostMock) connRoutine(cd *hostConnMockData) {
   }
 }
 
-func (hm *HostMock) Host(ping func([]byte) ([]byte, error), join func([]byte) error) {
+func (hm *HostMock) Host(ping func([]byte) ([]byte, error), join func([]byte) error) error {
   hm.net.host_mutex.Lock()
   defer hm.net.host_mutex.Unlock()
   hm.ping = ping
   hm.join = join
+  return nil
+}
+
+func (hm *HostMock) SetCodec(codec Codec) {
+  hm.net.host_mutex.Lock()
+  defer hm.net.host_mutex.Unlock()
+  hm.codec = codec
 }
 
 type networkMockRemoteHost struct {
@@ -337,10 +413,11 @@ func (hm *HostMock) Join(remote RemoteHost, data []byte) (Conn, error) {
         hm.net.host_mutex.Unlock()
         return nil, err
       }
-      c1, c2 := makeConnMockPair(hm, hm.net.hosts[i])
+      remote := hm.net.hosts[i]
+      c1, c2 := makeConnMockPair(hm, remote)
       go func() {
         hm.net.host_mutex.Unlock()
-        hm.net.hosts[i].new_conns <- c2
+        remote.new_conns <- c2
       }()
       return c1, nil
     }
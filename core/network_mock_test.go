@@ -73,8 +73,14 @@ func NetworkMockSpec(c gospec.Context) {
       }
       c.Expect(len(fb2.Bundle[0].Game), Equals, 0)
     }
+    c.Expect(conn.Err(), Equals, error(nil))
     conn.Close()
     conn2.Close()
+    <-conn.Done()
+    c.Expect(conn.Err(), Equals, core.ErrConnClosed)
+
+    // Closing twice is harmless.
+    conn.Close()
     hm1.Shutdown()
     hm2.Shutdown()
   })
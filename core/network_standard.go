@@ -1,11 +1,16 @@
 package core
 
 import (
+  "bufio"
   "bytes"
-  "encoding/gob"
+  "encoding/binary"
   "errors"
   "fmt"
+  "io"
+  "io/ioutil"
   "net"
+  "strconv"
+  "sync"
   "time"
 )
 
@@ -15,11 +20,44 @@ type networkTcpUdp struct {
   port      int
   ping      func([]byte) ([]byte, error)
   join      func([]byte) error
+
+  // If this is non-zero FrameBundles are sent over udp rather than tcp, see
+  // MakeUdpBundleNetwork.
+  redundancy int
+
+  // Used for every FrameBundle sent over conns made by this network, only
+  // touched by routine, see SetCodec.
+  codec Codec
+
+  // Tracks every goroutine started while hosting, so that we can be sure
+  // they've all exited before we stop or change how we're hosting.
+  hosting sync.WaitGroup
+
+  // The port that ListenForPeers is listening on, or 0 if it isn't.  It is
+  // sent along whenever we join anything, see PeerAddr.  Only touched by
+  // routine.
+  peer_port int
+
+  // Tracks every goroutine started by ListenForPeers, they run until we
+  // shut down.
+  peering sync.WaitGroup
+
+  // Closed once routine has exited.
+  done chan struct{}
 }
 
 type hostRequest struct {
-  ping func([]byte) ([]byte, error)
-  join func([]byte) error
+  ping     func([]byte) ([]byte, error)
+  join     func([]byte) error
+  response chan error
+}
+
+type codecRequest struct {
+  codec Codec
+}
+
+type peerRequest struct {
+  response chan error
 }
 
 type pingRequest struct {
@@ -45,8 +83,10 @@ type joinResponse struct {
 func MakeTcpUdpNetwork(port int) (Network, error) {
   var n networkTcpUdp
   n.port = port
+  n.codec = GobCodec{}
   n.requests = make(chan interface{})
   n.new_conns = make(chan Conn)
+  n.done = make(chan struct{})
   go n.routine()
   return &n, nil
 }
@@ -62,29 +102,22 @@ func (n *networkTcpUdp) launchPingRoutine(die chan struct{}) error {
   if err != nil {
     return err
   }
+  n.hosting.Add(2)
   go func() {
-    defer listener.Close()
+    defer n.hosting.Done()
+    <-die
+    listener.Close()
+  }()
+  go func() {
+    defer n.hosting.Done()
 
     // TODO: Should either document the size of this buffer or make it configurable.
     buf := make([]byte, 1024)
     for {
-      err = listener.SetDeadline(time.Now().Add(time.Second))
-      if err != nil {
-        go func() {
-          <-die
-        }()
-        return
-      }
       size, raddr, err := listener.ReadFromUDP(buf)
       if err != nil {
-        if err.(net.Error).Timeout() {
-          continue
-        } else {
-          go func() {
-            <-die
-          }()
-          return
-        }
+        // The listener is closed when we stop hosting.
+        return
       }
       select {
       case <-die:
@@ -113,80 +146,171 @@ func (n *networkTcpUdp) launchPingRoutine(die chan struct{}) error {
 
 // Listens on a tcp port
 func (n *networkTcpUdp) launchJoinRoutine(die chan struct{}) error {
-  laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", n.port))
+  listener, err := listenTcp(n.port)
   if err != nil {
-    return errors.New(fmt.Sprintf("Unable to resolve local tcp addr: %v", err))
+    return err
+  }
+  n.acceptJoins(listener, die, &n.hosting, n.join)
+  return nil
+}
+
+var errNotPeer = errors.New("Only engines in the game can join this port.")
+
+// Listens on a port of its own for other engines in the game, see
+// ListenForPeers.  Returns the port.
+func (n *networkTcpUdp) launchPeerRoutine(die chan struct{}) (int, error) {
+  listener, err := listenTcp(0)
+  if err != nil {
+    return 0, err
+  }
+  n.acceptJoins(listener, die, &n.peering, func(data []byte) error {
+    if !bytes.Equal(data, PeerJoinData) {
+      return errNotPeer
+    }
+    return nil
+  })
+  return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Listens on port, or on any port if it's 0.
+func listenTcp(port int) (*net.TCPListener, error) {
+  laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
+  if err != nil {
+    return nil, errors.New(fmt.Sprintf("Unable to resolve local tcp addr: %v", err))
   }
   listener, err := net.ListenTCP("tcp", laddr)
   if err != nil {
-    return errors.New(fmt.Sprintf("Unable to listen for joins: %v", err))
+    return nil, errors.New(fmt.Sprintf("Unable to listen for joins: %v", err))
   }
+  return listener, nil
+}
 
+// Accepts conns on listener until die is closed, passing the data that comes
+// with each one to join, and tracking every goroutine with routines.  Joins
+// start with a uvarint, the port that the joining engine listens for peers on,
+// followed by the data passed to Join.
+func (n *networkTcpUdp) acceptJoins(listener *net.TCPListener, die chan struct{}, routines *sync.WaitGroup, join func([]byte) error) {
+  codec := n.codec
+  routines.Add(2)
   go func() {
+    defer routines.Done()
     <-die
     listener.Close()
   }()
 
   go func() {
+    defer routines.Done()
     for {
       raw_con, err := listener.Accept()
       if err != nil {
-        panic("FUCK")
+        // The listener is closed when we stop hosting.
         return
       }
+      routines.Add(1)
       go func() {
+        defer routines.Done()
         buf := make([]byte, 1024)
+        raw_con.SetDeadline(time.Now().Add(time.Second))
         num, err := raw_con.Read(buf)
         if err != nil {
+          raw_con.Close()
           return
         }
-        err = n.join(buf[0:num])
-        raw_con.SetWriteDeadline(time.Now().Add(time.Second))
+        peer_port, size := binary.Uvarint(buf[0:num])
+        if size <= 0 || peer_port > 65535 {
+          raw_con.Close()
+          return
+        }
+        err = join(buf[size:num])
         if err != nil {
           raw_con.Write([]byte(fmt.Sprintf("FAIL: %v", err)))
+          raw_con.Close()
+          return
+        }
+        _, err = raw_con.Write([]byte(joinSuccess))
+        if err != nil {
+          raw_con.Close()
           return
         }
-        _, err = raw_con.Write([]byte("SUCCESS"))
+        conn, err := n.makeConn(raw_con.(*net.TCPConn), true, codec, int(peer_port))
         if err != nil {
+          raw_con.Close()
           return
         }
-        raw_con.SetDeadline(time.Time{})
-        conn := makeTcpConn(raw_con.(*net.TCPConn))
-        n.new_conns <- conn
+        select {
+        case n.new_conns <- conn:
+        case <-die:
+          conn.Close()
+        }
       }()
     }
   }()
-  return nil
 }
 
+// What the host responds with when a join succeeds, a failed join gets a
+// response starting with "FAIL" instead.
+const joinSuccess = "SUCCESS"
+
 func (n *networkTcpUdp) routine() {
+  defer close(n.done)
   var kill chan struct{}
+  stopHosting := func() {
+    if kill != nil {
+      close(kill)
+      n.hosting.Wait()
+      kill = nil
+    }
+  }
+  defer stopHosting()
+  var peer_kill chan struct{}
+  defer func() {
+    if peer_kill != nil {
+      close(peer_kill)
+      n.peering.Wait()
+    }
+  }()
   for _req := range n.requests {
     switch req := _req.(type) {
     case hostRequest:
-      if kill != nil {
-        kill <- struct{}{}
-        kill <- struct{}{}
-      }
+      stopHosting()
       if req.ping == nil || req.join == nil {
         n.ping = nil
         n.join = nil
+        req.response <- nil
+        continue
+      }
+      n.ping = req.ping
+      n.join = req.join
+      kill = make(chan struct{})
+      err := n.launchPingRoutine(kill)
+      if err != nil {
         kill = nil
-      } else {
-        n.ping = req.ping
-        n.join = req.join
-        kill = make(chan struct{})
-        err := n.launchPingRoutine(kill)
-        if err != nil {
-          kill = nil
-          continue
-        }
-        err = n.launchJoinRoutine(kill)
-        if err != nil {
-          kill <- struct{}{}
-          kill = nil
-        }
+        req.response <- errors.New(fmt.Sprintf("Unable to listen for pings: %v", err))
+        continue
+      }
+      err = n.launchJoinRoutine(kill)
+      if err != nil {
+        stopHosting()
+      }
+      req.response <- err
+
+    case codecRequest:
+      n.codec = req.codec
+
+    case peerRequest:
+      if peer_kill != nil {
+        req.response <- nil
+        continue
+      }
+      peer_kill = make(chan struct{})
+      port, err := n.launchPeerRoutine(peer_kill)
+      if err != nil {
+        peer_kill = nil
+        req.response <- err
+        continue
       }
+      n.peer_port = port
+      req.response <- nil
 
     case pingRequest:
       req.response <- n.handlePingRequest(req)
@@ -200,6 +324,8 @@ func (n *networkTcpUdp) routine() {
 type standardRemoteHost struct {
   data []byte
   ip   string
+
+  // The tcp port that it listens for joins on.
   port int
 }
 
@@ -246,6 +372,9 @@ func (n *networkTcpUdp) handlePingRequest(req pingRequest) (resp pingResponse) {
     return
   }
 
+  // Hosts listen for joins on the same port that they get pings on, which
+  // isn't the port that they respond from.
+  port := n.port
   data := make([]byte, 2048)
   for {
     n, addr, err := conn.ReadFromUDP(data)
@@ -255,7 +384,7 @@ func (n *networkTcpUdp) handlePingRequest(req pingRequest) (resp pingResponse) {
     var rh standardRemoteHost
     rh.data = make([]byte, n)
     copy(rh.data, data)
-    rh.port = addr.Port
+    rh.port = port
     rh.ip = addr.IP.String()
     resp.hosts = append(resp.hosts, rh)
   }
@@ -263,7 +392,7 @@ func (n *networkTcpUdp) handlePingRequest(req pingRequest) (resp pingResponse) {
 }
 
 func (n *networkTcpUdp) handleJoinRequest(req joinRequest) (resp joinResponse) {
-  raddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", req.remote.ip, n.port))
+  raddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(req.remote.ip, strconv.Itoa(req.remote.port)))
   if err != nil {
     resp.err = errors.New(fmt.Sprintf("Unable to resolve remote tcp addr: %v", err))
     return
@@ -274,32 +403,79 @@ func (n *networkTcpUdp) handleJoinRequest(req joinRequest) (resp joinResponse) {
     return
   }
 
-  buf := make([]byte, 1024)
   conn.SetDeadline(time.Now().Add(time.Second))
 
-  _, err = conn.Write(req.data)
+  _, err = conn.Write(append(binary.AppendUvarint(nil, uint64(n.peer_port)), req.data...))
   if err != nil {
+    conn.Close()
     resp.err = errors.New(fmt.Sprintf("Unable to write: %v", err))
     return
   }
 
-  num, err := conn.Read(buf)
+  // The host can start sending on the new connection immediately after its
+  // response, so we have to read exactly as much as the response and no more.
+  buf := make([]byte, len(joinSuccess))
+  _, err = io.ReadFull(conn, buf[0:4])
+  if err == nil && string(buf[0:4]) == "FAIL" {
+    rest, _ := ioutil.ReadAll(io.LimitReader(conn, 1024))
+    conn.Close()
+    resp.err = errors.New(fmt.Sprintf("Unable to join: %s%s", buf[0:4], rest))
+    return
+  }
+  if err == nil {
+    _, err = io.ReadFull(conn, buf[4:])
+  }
+  if err == nil && string(buf) != joinSuccess {
+    err = errors.New(fmt.Sprintf("unexpected response %q", buf))
+  }
   if err != nil {
+    conn.Close()
     resp.err = errors.New(fmt.Sprintf("Unable to read: %v", err))
     return
   }
-
-  if string(buf[0:4]) == "FAIL" {
-    resp.err = errors.New(fmt.Sprintf("Unable to join: %s", buf[0:num]))
-    return
+  resp.conn, err = n.makeConn(conn, false, n.codec, req.remote.port)
+  if err != nil {
+    conn.Close()
+    resp.err = errors.New(fmt.Sprintf("Unable to set up connection: %v", err))
   }
-  conn.SetDeadline(time.Time{})
-  resp.conn = makeTcpConn(conn)
   return
 }
 
-func (n *networkTcpUdp) Host(ping func([]byte) ([]byte, error), join func([]byte) error) {
-  n.requests <- hostRequest{ping, join}
+// Turns a tcp connection that has just finished joining into a Conn.  hosting
+// indicates which end of the connection we are, and peer_port is the port
+// that the engine on the other end listens for peers on.
+func (n *networkTcpUdp) makeConn(raw *net.TCPConn, hosting bool, codec Codec, peer_port int) (Conn, error) {
+  if n.redundancy == 0 {
+    raw.SetDeadline(time.Time{})
+    conn := makeTcpConn(raw, nil, codec)
+    conn.peer_port = peer_port
+    return conn, nil
+  }
+  raw.SetDeadline(time.Now().Add(time.Second))
+  conn, err := makeUdpConn(raw, hosting, n.redundancy, codec)
+  if err != nil {
+    return nil, err
+  }
+  conn.tcpConn.peer_port = peer_port
+  return conn, nil
+}
+
+func (n *networkTcpUdp) Host(ping func([]byte) ([]byte, error), join func([]byte) error) error {
+  response := make(chan error)
+  n.requests <- hostRequest{ping, join, response}
+  return <-response
+}
+
+func (n *networkTcpUdp) SetCodec(codec Codec) {
+  n.requests <- codecRequest{codec}
+}
+
+// Listens on a port picked by the OS, so any number of engines on the same
+// machine can do this along with a host.
+func (n *networkTcpUdp) ListenForPeers() error {
+  response := make(chan error)
+  n.requests <- peerRequest{response}
+  return <-response
 }
 
 func (n *networkTcpUdp) Ping(data []byte) ([]RemoteHost, error) {
@@ -328,12 +504,56 @@ func (n *networkTcpUdp) ActiveConnections() int {
   return 0
 }
 
+// Stops hosting, if we were, and returns once everything started while
+// hosting has exited.  Conns that were already made are unaffected.
 func (n *networkTcpUdp) Shutdown() {
   close(n.requests)
+  <-n.done
+}
+
+// An engine's address is its ip along with the port that it told us it
+// listens for peers on when the conn was made, or the port we reached it on if
+// we were the one that joined.
+func (n *networkTcpUdp) PeerAddr(conn Conn) (string, error) {
+  var raw *net.TCPConn
+  var port int
+  switch c := conn.(type) {
+  case *tcpConn:
+    raw, port = c.raw, c.peer_port
+  case *udpConn:
+    raw, port = c.tcpConn.raw, c.tcpConn.peer_port
+  default:
+    return "", errors.New("Conn didn't come from this Network.")
+  }
+  if port == 0 {
+    return "", ErrPeerNotListening
+  }
+  addr, ok := raw.RemoteAddr().(*net.TCPAddr)
+  if !ok {
+    return "", errors.New("Conn doesn't have a tcp address.")
+  }
+  return net.JoinHostPort(addr.IP.String(), strconv.Itoa(port)), nil
+}
+
+func (n *networkTcpUdp) PeerHost(addr string) (RemoteHost, error) {
+  ip, port_str, err := net.SplitHostPort(addr)
+  if err != nil || net.ParseIP(ip) == nil {
+    return nil, errors.New(fmt.Sprintf("Invalid peer address %q.", addr))
+  }
+  port, err := strconv.Atoi(port_str)
+  if err != nil || port <= 0 || port > 65535 {
+    return nil, errors.New(fmt.Sprintf("Invalid peer address %q.", addr))
+  }
+  return standardRemoteHost{ip: ip, port: port}, nil
 }
 
 type tcpConn struct {
-  raw  *net.TCPConn
+  raw   *net.TCPConn
+  codec Codec
+
+  // The port that the engine on the other end listens for peers on, or 0 if
+  // it doesn't, see PeerAddr.
+  peer_port int
   data struct {
     from_net chan []byte
     to_pnf   chan []byte
@@ -346,12 +566,34 @@ type tcpConn struct {
     from_pnf chan TcpConnPayload
     to_net   chan TcpConnPayload
   }
+
+  // Payloads with a Datagram are sent here, if this is nil then receiving
+  // one is an error.
+  datagrams chan []byte
+
+  // Closed when the conn is terminated, all goroutines watch this so they
+  // know when to exit.
   kill chan struct{}
+
+  // Closed when Close is called.  Anything that has already been sent is
+  // still written before the conn is terminated, but nothing more is
+  // delivered to RecvData or RecvFrameBundle.
+  closed     chan struct{}
+  close_once sync.Once
+
+  // Why the conn was terminated, only valid once kill is closed.
+  err            error
+  terminate_once sync.Once
+
+  // Tracks all of the goroutines so that Close can wait for them.
+  routines sync.WaitGroup
 }
 
-func makeTcpConn(raw *net.TCPConn) *tcpConn {
+func makeTcpConn(raw *net.TCPConn, datagrams chan []byte, codec Codec) *tcpConn {
   var c tcpConn
   c.raw = raw
+  c.codec = codec
+  c.datagrams = datagrams
   c.data.from_net = make(chan []byte, 100)
   c.data.to_pnf = make(chan []byte, 100)
   c.bundle.from_net = make(chan FrameBundle, 100)
@@ -360,6 +602,8 @@ func makeTcpConn(raw *net.TCPConn) *tcpConn {
   c.send.to_net = make(chan TcpConnPayload)
 
   c.kill = make(chan struct{})
+  c.closed = make(chan struct{})
+  c.routines.Add(5)
   go c.readRoutine()
   go c.writeRoutine()
   go c.sendRoutine()
@@ -368,8 +612,14 @@ func makeTcpConn(raw *net.TCPConn) *tcpConn {
   return &c
 }
 
-func (c *tcpConn) terminate() {
-  // Send signals along c.kill
+// Shuts down the conn, err is what will be reported by Err().  Only the first
+// call to terminate has any effect.
+func (c *tcpConn) terminate(err error) {
+  c.terminate_once.Do(func() {
+    c.err = err
+    close(c.kill)
+    c.raw.Close()
+  })
 }
 
 func check(err error) {
@@ -381,176 +631,240 @@ func check(err error) {
 type TcpConnPayload struct {
   Data   []byte
   Bundle *FrameBundle
+
+  // Packets that a udp conn couldn't, or didn't want to, send as datagrams.
+  Datagram []byte
 }
 
-// func (cp *TcpConnPayload) GobDecode(data []byte) error {
-//   buf := bytes.NewBuffer(data)
-//   dec := gob.NewDecoder(buf)
-//   var length uint32
-//   err := dec.Decode(&length)
-//   if err != nil {
-//     return err
-//   }
-//   cp.Data = make([]byte, int(length))
-//   _, err = buf.Read(cp.Data)
-//   if err != nil {
-//     return err
-//   }
-//   var ok bool
-//   err = dec.Decode(&ok)
-//   if err != nil {
-//     return err
-//   }
-//   if !ok {
-//     return nil
-//   }
-//   err = dec.Decode(&cp.Bundle)
-//   if err != nil {
-//     return err
-//   }
-//   return nil
-// }
-
-// func (cp *TcpConnPayload) GobEncode() ([]byte, error) {
-//   buf := bytes.NewBuffer(nil)
-//   enc := gob.NewEncoder(buf)
-//   err := enc.Encode(uint32(len(cp.Data)))
-//   if err != nil {
-//     return nil, err
-//   }
-//   _, err = buf.Write(cp.Data)
-//   if err != nil {
-//     return nil, err
-//   }
-//   err = enc.Encode(cp.Bundle != nil)
-//   if err != nil {
-//     return nil, err
-//   }
-//   if cp.Bundle != nil {
-//     err = enc.Encode(cp.Bundle)
-//     if err != nil {
-//       return nil, err
-//     }
-//   }
-//   return buf.Bytes(), nil
-// }
-
-// func (c *tcpConn) readRoutine() {
-//   dec := gob.NewDecoder(c.raw)
-//   for {
-//     var payload TcpConnPayload
-//     err := dec.Decode(&payload)
-//     if err != nil {
-//       c.terminate()
-//       fmt.Printf("Error in readRoutine: %v\n", err)
-//       return
-//     }
-//     if payload.Bundle != nil {
-//       c.bundle.from_net <- *payload.Bundle
-//     } else {
-//       c.data.from_net <- payload.Data
-//     }
-//   }
-// }
+// Every TcpConnPayload is sent as a single frame.  A frame consists of a
+// header followed by the body:
+//   4 bytes: big-endian length of everything after these 4 bytes
+//   1 byte:  version, always TcpFrameVersion
+//   1 byte:  type, one of tcpFrameData, tcpFrameBundle or tcpFrameDatagram
+// For tcpFrameData the body is just TcpConnPayload.Data, for tcpFrameBundle
+// it is TcpConnPayload.Bundle as encoded by the conn's Codec, and for
+// tcpFrameDatagram it is just TcpConnPayload.Datagram.
+const (
+  TcpFrameVersion = 1
 
-func (c *tcpConn) readRoutine() {
-  db := bytes.NewBuffer(nil)
-  dec := gob.NewDecoder(db)
-  buf := make([]byte, 4096*256)
-  for {
-    tbuf := buf[:]
-    var payload TcpConnPayload
-    n, err := c.raw.Read(tbuf)
+  // Largest frame, not including the length, that will be read or written.
+  MaxTcpFrameSize = 1 << 24
+
+  tcpFrameData     = 1
+  tcpFrameBundle   = 2
+  tcpFrameDatagram = 3
+
+  tcpFrameLengthSize = 4
+  tcpFrameHeaderSize = 2
+)
+
+var (
+  ErrTcpFrameTooLarge = errors.New("Tcp frame exceeds the maximum frame size.")
+  ErrTcpFrameVersion  = errors.New("Tcp frame has an unknown version.")
+  ErrTcpFrameType     = errors.New("Tcp frame has an unknown type.")
+)
+
+// Writes payload to w as a single frame with a single call to w.Write.
+// Bundles are encoded with codec.
+func WriteTcpConnPayload(w io.Writer, payload TcpConnPayload, codec Codec) error {
+  buf := bytes.NewBuffer(nil)
+  buf.Write(make([]byte, tcpFrameLengthSize))
+  if payload.Bundle != nil {
+    buf.Write([]byte{TcpFrameVersion, tcpFrameBundle})
+    data, err := codec.EncodeBundle(*payload.Bundle)
+    if err != nil {
+      return err
+    }
+    buf.Write(data)
+  } else if payload.Datagram != nil {
+    buf.Write([]byte{TcpFrameVersion, tcpFrameDatagram})
+    buf.Write(payload.Datagram)
+  } else {
+    buf.Write([]byte{TcpFrameVersion, tcpFrameData})
+    buf.Write(payload.Data)
+  }
+  frame := buf.Bytes()
+  length := len(frame) - tcpFrameLengthSize
+  if length > MaxTcpFrameSize {
+    return ErrTcpFrameTooLarge
+  }
+  binary.BigEndian.PutUint32(frame, uint32(length))
+  _, err := w.Write(frame)
+  return err
+}
+
+// Reads exactly one frame from r.  The frame can arrive across any number of
+// reads, and anything after the frame is left in r.  Bundles are decoded with
+// codec.
+func ReadTcpConnPayload(r io.Reader, codec Codec) (TcpConnPayload, error) {
+  var payload TcpConnPayload
+  var length_buf [tcpFrameLengthSize]byte
+  _, err := io.ReadFull(r, length_buf[:])
+  if err != nil {
+    return payload, err
+  }
+  length := binary.BigEndian.Uint32(length_buf[:])
+  if length > MaxTcpFrameSize {
+    return payload, ErrTcpFrameTooLarge
+  }
+  if length < tcpFrameHeaderSize {
+    return payload, io.ErrUnexpectedEOF
+  }
+  frame := make([]byte, int(length))
+  _, err = io.ReadFull(r, frame)
+  if err == io.EOF {
+    err = io.ErrUnexpectedEOF
+  }
+  if err != nil {
+    return payload, err
+  }
+  if frame[0] != TcpFrameVersion {
+    return payload, ErrTcpFrameVersion
+  }
+  body := frame[tcpFrameHeaderSize:]
+  switch frame[1] {
+  case tcpFrameData:
+    payload.Data = body
+  case tcpFrameBundle:
+    bundle, err := codec.DecodeBundle(body)
     if err != nil {
-      panic(err.Error())
+      return TcpConnPayload{}, err
     }
-    tbuf = tbuf[:n]
-    db.Write(tbuf)
-    err = dec.Decode(&payload)
+    payload.Bundle = &bundle
+  case tcpFrameDatagram:
+    payload.Datagram = body
+  default:
+    return payload, ErrTcpFrameType
+  }
+  return payload, nil
+}
+
+func (c *tcpConn) readRoutine() {
+  defer c.routines.Done()
+  r := bufio.NewReader(c.raw)
+  for {
+    payload, err := ReadTcpConnPayload(r, c.codec)
     if err != nil {
-      c.terminate()
-      fmt.Printf("Error in readRoutine: %v\n", err)
+      if err == io.EOF {
+        err = ErrConnClosedRemotely
+      }
+      c.terminate(err)
       return
     }
     if payload.Bundle != nil {
-      c.bundle.from_net <- *payload.Bundle
+      select {
+      case c.bundle.from_net <- *payload.Bundle:
+      case <-c.kill:
+        return
+      }
+    } else if payload.Datagram != nil {
+      if c.datagrams == nil {
+        c.terminate(ErrTcpFrameType)
+        return
+      }
+      select {
+      case c.datagrams <- payload.Datagram:
+      case <-c.kill:
+        return
+      }
     } else {
-      c.data.from_net <- payload.Data
+      select {
+      case c.data.from_net <- payload.Data:
+      case <-c.kill:
+        return
+      }
     }
   }
 }
 
-// func (c *tcpConn) writeRoutine() {
-//   enc := gob.NewEncoder(c.raw)
-//   for payload := range c.send.to_net {
-//     err := enc.Encode(payload)
-//     if err != nil {
-//       c.terminate()
-//       fmt.Printf("Error in writeRoutine: %v\n", err)
-//       return
-//     }
-//     fmt.Printf("Encoded payload: %v\n", payload)
-//   }
-// }
-
 func (c *tcpConn) writeRoutine() {
-  buf := bytes.NewBuffer(nil)
-  enc := gob.NewEncoder(buf)
-  for payload := range c.send.to_net {
-    err := enc.Encode(payload)
-    if err != nil {
-      c.terminate()
-      fmt.Printf("Error in writeRoutine: %v\n", err)
+  defer c.routines.Done()
+  for {
+    var payload TcpConnPayload
+    var ok bool
+    select {
+    case payload, ok = <-c.send.to_net:
+      if !ok {
+        // sendRoutine has flushed everything after a call to Close.
+        c.terminate(ErrConnClosed)
+        return
+      }
+    case <-c.kill:
       return
     }
-    _, err = c.raw.Write(buf.Bytes())
-    buf.Reset()
+    err := WriteTcpConnPayload(c.raw, payload, c.codec)
     if err != nil {
-      c.terminate()
-      fmt.Printf("Error in writeRoutine: %v\n", err)
+      select {
+      case <-c.closed:
+        // Close gave up waiting for the remote end.
+        err = ErrConnClosed
+      default:
+      }
+      c.terminate(err)
       return
     }
   }
 }
 
 func (c *tcpConn) sendRoutine() {
+  defer c.routines.Done()
   var queue []TcpConnPayload
   var out chan TcpConnPayload
   var payload TcpConnPayload
+  closed := c.closed
   for {
     if len(queue) > 0 {
       out = c.send.to_net
       payload = queue[0]
     } else {
       out = nil
+      if closed == nil {
+        close(c.send.to_net)
+        return
+      }
     }
     select {
     case payload = <-c.send.from_pnf:
       queue = append(queue, payload)
     case out <- payload:
       queue = queue[1:]
+    case <-closed:
+      closed = nil
+    case <-c.kill:
+      return
     }
   }
 }
 
 // Buffers infinitely, so that we don't rely on the capacity of any channel.
+// Once the conn is terminated the channel returned by RecvData() is closed,
+// though not until everything that arrived before then has been delivered,
+// unless Close was called.
 func (c *tcpConn) recvDataRoutine() {
+  defer c.routines.Done()
+  defer close(c.data.to_pnf)
   var queue [][]byte
   var out chan []byte
   var datum []byte
+  kill := c.kill
   for {
     if len(queue) > 0 {
       out = c.data.to_pnf
       datum = queue[0]
     } else {
       out = nil
+      if kill == nil && len(c.data.from_net) == 0 {
+        return
+      }
     }
     select {
     case data := <-c.data.from_net:
       queue = append(queue, data)
     case out <- datum:
       queue = queue[1:]
-    case <-c.kill:
+    case <-kill:
+      kill = nil
+    case <-c.closed:
       return
     }
   }
@@ -558,35 +872,49 @@ func (c *tcpConn) recvDataRoutine() {
 
 // Exactly like recvDataRoutine(), but for the FrameBundles
 func (c *tcpConn) recvBundleRoutine() {
+  defer c.routines.Done()
+  defer close(c.bundle.to_pnf)
   var queue []FrameBundle
   var out chan FrameBundle
   var datum FrameBundle
+  kill := c.kill
   for {
     if len(queue) > 0 {
       out = c.bundle.to_pnf
       datum = queue[0]
     } else {
       out = nil
+      if kill == nil && len(c.bundle.from_net) == 0 {
+        return
+      }
     }
     select {
     case bundle := <-c.bundle.from_net:
       queue = append(queue, bundle)
     case out <- datum:
       queue = queue[1:]
-    case <-c.kill:
+    case <-kill:
+      kill = nil
+    case <-c.closed:
       return
     }
   }
 }
 
 func (c *tcpConn) SendData(data []byte) {
-  c.send.from_pnf <- TcpConnPayload{Data: data}
+  select {
+  case c.send.from_pnf <- TcpConnPayload{Data: data}:
+  case <-c.kill:
+  }
 }
 func (c *tcpConn) RecvData() <-chan []byte {
   return c.data.to_pnf
 }
 func (c *tcpConn) SendFrameBundle(bundle FrameBundle) {
-  c.send.from_pnf <- TcpConnPayload{Bundle: &bundle}
+  select {
+  case c.send.from_pnf <- TcpConnPayload{Bundle: &bundle}:
+  case <-c.kill:
+  }
 }
 func (c *tcpConn) RecvFrameBundle() <-chan FrameBundle {
   return c.bundle.to_pnf
@@ -594,6 +922,25 @@ func (c *tcpConn) RecvFrameBundle() <-chan FrameBundle {
 func (c *tcpConn) Id() int {
   return 0
 }
+func (c *tcpConn) Done() <-chan struct{} {
+  return c.kill
+}
+func (c *tcpConn) Err() error {
+  select {
+  case <-c.kill:
+    return c.err
+  default:
+    return nil
+  }
+}
+// Writes anything that has already been sent before closing the conn, but
+// doesn't wait more than a second for the remote end to take it.
 func (c *tcpConn) Close() error {
+  c.close_once.Do(func() {
+    close(c.closed)
+  })
+  c.raw.SetWriteDeadline(time.Now().Add(time.Second))
+  <-c.kill
+  c.routines.Wait()
   return nil
 }
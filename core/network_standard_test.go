@@ -1,12 +1,15 @@
 package core_test
 
 import (
+  "bufio"
   "bytes"
+  "encoding/binary"
   "encoding/gob"
   "fmt"
   "github.com/orfjackal/gospec/src/gospec"
   . "github.com/orfjackal/gospec/src/gospec"
   "github.com/runningwild/core"
+  "io"
   "net"
   "time"
 )
@@ -99,7 +102,7 @@ func NetworkStandardSpec(c gospec.Context) {
     println(host, client)
 
     ping := func(data []byte) ([]byte, error) {
-      return []byte(fmt.Sprintf("Ping(%d)", string(data))), nil
+      return []byte(fmt.Sprintf("Ping(%s)", data)), nil
     }
 
     join := func(data []byte) error {
@@ -136,3 +139,172 @@ func NetworkStandardSpec(c gospec.Context) {
     host.Shutdown()
   })
 }
+
+func NetworkStandardConnSpec(c gospec.Context) {
+  c.Specify("Standard conns report when they die.", func() {
+    port := int(core.RandomId()%10000 + 1000)
+    host, err := core.MakeTcpUdpNetwork(port)
+    c.Expect(err, Equals, error(nil))
+    client, err := core.MakeTcpUdpNetwork(port)
+    c.Expect(err, Equals, error(nil))
+    defer host.Shutdown()
+    defer client.Shutdown()
+
+    ping := func(data []byte) ([]byte, error) {
+      return data, nil
+    }
+    join := func(data []byte) error {
+      return nil
+    }
+    host.Host(ping, join)
+    time.Sleep(time.Millisecond * 100)
+    rhs, err := client.Ping([]byte("MONKEYS"))
+    c.Assume(len(rhs), Equals, 1)
+    conn, err := client.Join(rhs[0], rhs[0].Data())
+    c.Assume(err, Equals, error(nil))
+    var new_conn core.Conn
+    select {
+    case new_conn = <-host.NewConns():
+    case <-time.After(time.Second):
+    }
+    c.Assume(new_conn, Not(Equals), core.Conn(nil))
+
+    c.Expect(conn.Err(), Equals, error(nil))
+    c.Expect(new_conn.Err(), Equals, error(nil))
+    c.Expect(conn.Close(), Equals, error(nil))
+    c.Expect(conn.Err(), Equals, core.ErrConnClosed)
+
+    select {
+    case <-new_conn.Done():
+    case <-time.After(time.Second):
+    }
+    c.Expect(new_conn.Err(), Equals, core.ErrConnClosedRemotely)
+    _, ok := <-new_conn.RecvData()
+    c.Expect(ok, Equals, false)
+    _, ok = <-new_conn.RecvFrameBundle()
+    c.Expect(ok, Equals, false)
+
+    // Sending on a dead conn should not block.
+    new_conn.SendData([]byte("Anyone there?"))
+    c.Expect(new_conn.Close(), Equals, error(nil))
+    c.Expect(new_conn.Err(), Equals, core.ErrConnClosedRemotely)
+  })
+}
+
+// Writes data to conn a few bytes at a time so that the reader has to deal
+// with partial frames.
+func writeFragmented(conn net.Conn, data []byte) error {
+  for len(data) > 0 {
+    n := 3
+    if n > len(data) {
+      n = len(data)
+    }
+    _, err := conn.Write(data[0:n])
+    if err != nil {
+      return err
+    }
+    data = data[n:]
+    time.Sleep(time.Microsecond * 100)
+  }
+  return nil
+}
+
+func NetworkStandardFramingSpec(c gospec.Context) {
+  laddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+  c.Assume(err, Equals, error(nil))
+  listener, err := net.ListenTCP("tcp", laddr)
+  c.Assume(err, Equals, error(nil))
+  defer listener.Close()
+  accepted := make(chan net.Conn, 1)
+  go func() {
+    conn, err := listener.Accept()
+    if err != nil {
+      close(accepted)
+      return
+    }
+    accepted <- conn
+  }()
+  client, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+  c.Assume(err, Equals, error(nil))
+  defer client.Close()
+  server, ok := <-accepted
+  c.Assume(ok, Equals, true)
+  defer server.Close()
+
+  data_payload := core.TcpConnPayload{Data: []byte("MONKEYS RULE!!!")}
+  bundle_payload := core.TcpConnPayload{
+    Bundle: &core.FrameBundle{
+      Frame: 12,
+      Bundle: core.EventBundle{
+        3: core.AllEvents{Game: []core.Event{EventA{5}, EventB{"foo"}}},
+      },
+    },
+  }
+
+  c.Specify("Payloads survive fragmented writes.", func() {
+    buf := bytes.NewBuffer(nil)
+    c.Assume(core.WriteTcpConnPayload(buf, data_payload, core.GobCodec{}), Equals, error(nil))
+    c.Assume(core.WriteTcpConnPayload(buf, bundle_payload, core.GobCodec{}), Equals, error(nil))
+    c.Assume(core.WriteTcpConnPayload(buf, data_payload, core.GobCodec{}), Equals, error(nil))
+    go writeFragmented(client, buf.Bytes())
+
+    p, err := core.ReadTcpConnPayload(server, core.GobCodec{})
+    c.Expect(err, Equals, error(nil))
+    c.Expect(string(p.Data), Equals, string(data_payload.Data))
+    c.Expect(p.Bundle, Equals, (*core.FrameBundle)(nil))
+
+    p, err = core.ReadTcpConnPayload(server, core.GobCodec{})
+    c.Expect(err, Equals, error(nil))
+    c.Assume(p.Bundle, Not(Equals), (*core.FrameBundle)(nil))
+    c.Expect(p.Bundle.Frame, Equals, core.StateFrame(12))
+    c.Assume(len(p.Bundle.Bundle[3].Game), Equals, 2)
+    c.Expect(p.Bundle.Bundle[3].Game[0], Equals, core.Event(EventA{5}))
+    c.Expect(p.Bundle.Bundle[3].Game[1], Equals, core.Event(EventB{"foo"}))
+
+    p, err = core.ReadTcpConnPayload(server, core.GobCodec{})
+    c.Expect(err, Equals, error(nil))
+    c.Expect(string(p.Data), Equals, string(data_payload.Data))
+  })
+
+  c.Specify("Several payloads in a single write are all read.", func() {
+    buf := bytes.NewBuffer(nil)
+    for i := 0; i < 10; i++ {
+      c.Assume(core.WriteTcpConnPayload(buf, bundle_payload, core.GobCodec{}), Equals, error(nil))
+    }
+    _, err := client.Write(buf.Bytes())
+    c.Assume(err, Equals, error(nil))
+    r := bufio.NewReader(server)
+    for i := 0; i < 10; i++ {
+      p, err := core.ReadTcpConnPayload(r, core.GobCodec{})
+      c.Expect(err, Equals, error(nil))
+      c.Assume(p.Bundle, Not(Equals), (*core.FrameBundle)(nil))
+      c.Expect(p.Bundle.Frame, Equals, core.StateFrame(12))
+    }
+  })
+
+  c.Specify("Frames that are too large are rejected.", func() {
+    var header [4]byte
+    binary.BigEndian.PutUint32(header[:], core.MaxTcpFrameSize+1)
+    _, err := client.Write(header[:])
+    c.Assume(err, Equals, error(nil))
+    _, err = core.ReadTcpConnPayload(server, core.GobCodec{})
+    c.Expect(err, Equals, core.ErrTcpFrameTooLarge)
+  })
+
+  c.Specify("Frames with an unknown version are rejected.", func() {
+    _, err := client.Write([]byte{0, 0, 0, 3, core.TcpFrameVersion + 1, 1, 0})
+    c.Assume(err, Equals, error(nil))
+    _, err = core.ReadTcpConnPayload(server, core.GobCodec{})
+    c.Expect(err, Equals, core.ErrTcpFrameVersion)
+  })
+
+  c.Specify("A frame cut off by a closed connection is an error.", func() {
+    buf := bytes.NewBuffer(nil)
+    c.Assume(core.WriteTcpConnPayload(buf, bundle_payload, core.GobCodec{}), Equals, error(nil))
+    _, err := client.Write(buf.Bytes()[0 : buf.Len()/2])
+    c.Assume(err, Equals, error(nil))
+    client.Close()
+    _, err = core.ReadTcpConnPayload(server, core.GobCodec{})
+    c.Expect(err, Equals, io.ErrUnexpectedEOF)
+  })
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "time"
+)
+
+// Like MakeTcpUdpNetwork, except that the conns it makes send FrameBundles
+// over udp so that a single lost packet doesn't hold up every frame after it.
+// Each datagram also carries up to redundancy of the most recent bundles that
+// the remote engine hasn't acknowledged yet, so an occasional lost datagram
+// costs nothing.  Any bundle that is still unacknowledged after that many
+// datagrams is resent over tcp, so bundles are never lost, though they may
+// arrive out of order.  Data sent with SendData always goes over tcp.  Every
+// engine in a game must use the same kind of network.
+func MakeUdpBundleNetwork(port, redundancy int) (Network, error) {
+  if redundancy < 1 || redundancy > maxUdpRedundancy {
+    return nil, errors.New(fmt.Sprintf("Redundancy must be between 1 and %d, not %d.", maxUdpRedundancy, redundancy))
+  }
+  var n networkTcpUdp
+  n.port = port
+  n.redundancy = redundancy
+  n.codec = GobCodec{}
+  n.requests = make(chan interface{})
+  n.new_conns = make(chan Conn)
+  n.done = make(chan struct{})
+  go n.routine()
+  return &n, nil
+}
+
+// Every datagram, and every packet that gets resent over tcp, looks like:
+//   1 byte:  version, always UdpPacketVersion
+//   4 bytes: ack, every sequence number before this one has been received
+//   1 byte:  number of bundles
+// followed by each bundle:
+//   4 bytes: sequence number
+//   4 bytes: length of the bundle
+//   the bundle as encoded by the conn's Codec
+// All integers are big-endian.
+const (
+  UdpPacketVersion = 1
+
+  // Largest datagram that will be sent, small enough to avoid fragmentation
+  // on pretty much any network.
+  MaxUdpPacketSize = 1200
+
+  maxUdpRedundancy = 255
+
+  udpPacketHeaderSize = 6
+  udpEntryHeaderSize  = 8
+)
+
+var (
+  ErrUdpPacketVersion   = errors.New("Udp packet has an unknown version.")
+  ErrUdpPacketMalformed = errors.New("Udp packet is malformed.")
+)
+
+type udpEntry struct {
+  seq    uint32
+  bundle []byte
+}
+
+func udpPacketSize(entries []udpEntry) int {
+  size := udpPacketHeaderSize
+  for _, entry := range entries {
+    size += udpEntryHeaderSize + len(entry.bundle)
+  }
+  return size
+}
+
+func encodeUdpPacket(ack uint32, entries []udpEntry) []byte {
+  packet := make([]byte, udpPacketHeaderSize, udpPacketSize(entries))
+  packet[0] = UdpPacketVersion
+  binary.BigEndian.PutUint32(packet[1:5], ack)
+  packet[5] = byte(len(entries))
+  var header [udpEntryHeaderSize]byte
+  for _, entry := range entries {
+    binary.BigEndian.PutUint32(header[0:4], entry.seq)
+    binary.BigEndian.PutUint32(header[4:8], uint32(len(entry.bundle)))
+    packet = append(packet, header[:]...)
+    packet = append(packet, entry.bundle...)
+  }
+  return packet
+}
+
+func decodeUdpPacket(packet []byte) (ack uint32, entries []udpEntry, err error) {
+  if len(packet) < udpPacketHeaderSize {
+    return 0, nil, ErrUdpPacketMalformed
+  }
+  if packet[0] != UdpPacketVersion {
+    return 0, nil, ErrUdpPacketVersion
+  }
+  ack = binary.BigEndian.Uint32(packet[1:5])
+  count := int(packet[5])
+  packet = packet[udpPacketHeaderSize:]
+  for i := 0; i < count; i++ {
+    if len(packet) < udpEntryHeaderSize {
+      return 0, nil, ErrUdpPacketMalformed
+    }
+    seq := binary.BigEndian.Uint32(packet[0:4])
+    length := binary.BigEndian.Uint32(packet[4:8])
+    packet = packet[udpEntryHeaderSize:]
+    if uint32(len(packet)) < length {
+      return 0, nil, ErrUdpPacketMalformed
+    }
+    entries = append(entries, udpEntry{seq, packet[0:length]})
+    packet = packet[length:]
+  }
+  if len(packet) != 0 {
+    return 0, nil, ErrUdpPacketMalformed
+  }
+  return ack, entries, nil
+}
+
+// A tcpConn that sends its FrameBundles over udp.  Everything other than
+// SendFrameBundle is handled by the tcpConn, and bundles received over udp
+// are delivered through the tcpConn's RecvFrameBundle.
+type udpConn struct {
+  *tcpConn
+
+  udp        *net.UDPConn
+  raddr      *net.UDPAddr
+  redundancy int
+
+  bundles chan FrameBundle
+  packets chan []byte
+
+  // Close sends on this so that udpRoutine can get everything that hasn't
+  // been acked to the tcpConn before it is closed.
+  closing chan chan struct{}
+
+  // Everything below is only touched by udpRoutine.
+
+  // Sequence number for the next bundle we send.
+  next_seq uint32
+
+  // Bundles we've sent that haven't been acked, oldest first.
+  unacked []udpEntry
+
+  // We've received every sequence number before this one, and also every
+  // sequence number in early.
+  recv_next  uint32
+  recv_early map[uint32]bool
+}
+
+// Sets up udp on a tcp connection that has just finished joining.  Both ends
+// send the port of their udp socket over the tcp connection, the joining end
+// goes first.
+func makeUdpConn(raw *net.TCPConn, hosting bool, redundancy int, codec Codec) (*udpConn, error) {
+  udp, err := net.ListenUDP("udp", &net.UDPAddr{})
+  if err != nil {
+    return nil, err
+  }
+  var local_port, remote_port [2]byte
+  binary.BigEndian.PutUint16(local_port[:], uint16(udp.LocalAddr().(*net.UDPAddr).Port))
+  if hosting {
+    _, err = io.ReadFull(raw, remote_port[:])
+    if err == nil {
+      _, err = raw.Write(local_port[:])
+    }
+  } else {
+    _, err = raw.Write(local_port[:])
+    if err == nil {
+      _, err = io.ReadFull(raw, remote_port[:])
+    }
+  }
+  if err != nil {
+    udp.Close()
+    return nil, err
+  }
+  raw.SetDeadline(time.Time{})
+
+  var c udpConn
+  c.udp = udp
+  c.raddr = &net.UDPAddr{
+    IP:   raw.RemoteAddr().(*net.TCPAddr).IP,
+    Port: int(binary.BigEndian.Uint16(remote_port[:])),
+  }
+  c.redundancy = redundancy
+  c.bundles = make(chan FrameBundle)
+  c.packets = make(chan []byte, 100)
+  c.closing = make(chan chan struct{})
+  c.recv_early = make(map[uint32]bool)
+  c.tcpConn = makeTcpConn(raw, make(chan []byte), codec)
+  c.routines.Add(2)
+  go c.udpRoutine()
+  go c.udpReadRoutine()
+  return &c, nil
+}
+
+func (c *udpConn) udpReadRoutine() {
+  defer c.routines.Done()
+  buf := make([]byte, 1<<16)
+  for {
+    n, addr, err := c.udp.ReadFromUDP(buf)
+    if err != nil {
+      // This is how we find out that udpRoutine closed the socket, in which
+      // case the conn has already been terminated.
+      c.terminate(err)
+      return
+    }
+    if !addr.IP.Equal(c.raddr.IP) || addr.Port != c.raddr.Port {
+      continue
+    }
+    packet := make([]byte, n)
+    copy(packet, buf)
+    select {
+    case c.packets <- packet:
+    case <-c.kill:
+      return
+    }
+  }
+}
+
+func (c *udpConn) udpRoutine() {
+  defer c.routines.Done()
+  defer c.udp.Close()
+  for {
+    select {
+    case bundle := <-c.bundles:
+      c.sendBundle(bundle)
+
+    case packet := <-c.packets:
+      // Udp makes no promises, so a bad datagram is just dropped.
+      c.handlePacket(packet)
+
+    case packet := <-c.datagrams:
+      err := c.handlePacket(packet)
+      if err != nil {
+        c.terminate(err)
+        return
+      }
+
+    case done := <-c.closing:
+      if len(c.unacked) > 0 {
+        c.sendReliable(c.unacked)
+        c.unacked = nil
+      }
+      close(done)
+
+    case <-c.kill:
+      return
+    }
+  }
+}
+
+func (c *udpConn) handlePacket(packet []byte) error {
+  ack, entries, err := decodeUdpPacket(packet)
+  if err != nil {
+    return err
+  }
+  for len(c.unacked) > 0 && c.unacked[0].seq < ack {
+    c.unacked = c.unacked[1:]
+  }
+  for _, entry := range entries {
+    if entry.seq < c.recv_next || c.recv_early[entry.seq] {
+      continue
+    }
+    bundle, err := c.codec.DecodeBundle(entry.bundle)
+    if err != nil {
+      return err
+    }
+    c.recv_early[entry.seq] = true
+    for c.recv_early[c.recv_next] {
+      delete(c.recv_early, c.recv_next)
+      c.recv_next++
+    }
+    select {
+    case c.bundle.from_net <- bundle:
+    case <-c.kill:
+      return nil
+    }
+  }
+  return nil
+}
+
+func (c *udpConn) sendBundle(bundle FrameBundle) {
+  data, err := c.codec.EncodeBundle(bundle)
+  if err != nil {
+    c.terminate(err)
+    return
+  }
+  c.unacked = append(c.unacked, udpEntry{c.next_seq, data})
+  c.next_seq++
+
+  // Anything that has gone out in as many datagrams as we're willing to send
+  // it in without being acked is resent reliably.
+  if len(c.unacked) > c.redundancy {
+    evicted := len(c.unacked) - c.redundancy
+    c.sendReliable(c.unacked[0:evicted])
+    c.unacked = c.unacked[evicted:]
+  }
+
+  // Pack in as many of the most recent bundles as will fit.
+  entries := c.unacked
+  for len(entries) > 1 && udpPacketSize(entries) > MaxUdpPacketSize {
+    entries = entries[1:]
+  }
+  if udpPacketSize(entries) > MaxUdpPacketSize {
+    // This bundle will never fit in a datagram.
+    c.sendReliable(entries)
+    c.unacked = c.unacked[0 : len(c.unacked)-1]
+    return
+  }
+
+  // If this fails then it's no different than if the datagram got lost.
+  c.udp.WriteToUDP(encodeUdpPacket(c.recv_next, entries), c.raddr)
+}
+
+func (c *udpConn) sendReliable(entries []udpEntry) {
+  select {
+  case c.send.from_pnf <- TcpConnPayload{Datagram: encodeUdpPacket(c.recv_next, entries)}:
+  case <-c.kill:
+  }
+}
+
+func (c *udpConn) SendFrameBundle(bundle FrameBundle) {
+  select {
+  case c.bundles <- bundle:
+  case <-c.kill:
+  }
+}
+
+// Resends anything that hasn't been acked over tcp, so that it is flushed
+// along with everything else before the conn is closed.
+func (c *udpConn) Close() error {
+  done := make(chan struct{})
+  select {
+  case c.closing <- done:
+    <-done
+  case <-c.kill:
+  }
+  return c.tcpConn.Close()
+}
@@ -0,0 +1,124 @@
+package core_test
+
+import (
+  "github.com/orfjackal/gospec/src/gospec"
+  . "github.com/orfjackal/gospec/src/gospec"
+  "github.com/runningwild/core"
+  "time"
+)
+
+// Receives bundles from conn until it has seen every frame in [1, frames], or
+// it gives up.  Returns how many distinct frames it saw.
+func recvFrames(conn core.Conn, frames int) int {
+  seen := make(map[core.StateFrame]bool)
+  timeout := time.After(time.Second * 5)
+  for len(seen) < frames {
+    select {
+    case bundle, ok := <-conn.RecvFrameBundle():
+      if !ok {
+        return len(seen)
+      }
+      seen[bundle.Frame] = true
+    case <-timeout:
+      return len(seen)
+    }
+  }
+  return len(seen)
+}
+
+func NetworkUdpBundleSpec(c gospec.Context) {
+  _, err := core.MakeUdpBundleNetwork(1234, 0)
+  c.Expect(err, Not(Equals), error(nil))
+
+  port := int(core.RandomId()%10000 + 1000)
+  host, err := core.MakeUdpBundleNetwork(port, 4)
+  c.Assume(err, Equals, error(nil))
+  client, err := core.MakeUdpBundleNetwork(port, 4)
+  c.Assume(err, Equals, error(nil))
+  defer host.Shutdown()
+  defer client.Shutdown()
+
+  ping := func(data []byte) ([]byte, error) {
+    return data, nil
+  }
+  join := func(data []byte) error {
+    return nil
+  }
+  host.Host(ping, join)
+  time.Sleep(time.Millisecond * 100)
+  rhs, err := client.Ping([]byte("MONKEYS"))
+  c.Assume(len(rhs), Equals, 1)
+  conn, err := client.Join(rhs[0], rhs[0].Data())
+  c.Assume(err, Equals, error(nil))
+  var new_conn core.Conn
+  select {
+  case new_conn = <-host.NewConns():
+  case <-time.After(time.Second):
+  }
+  c.Assume(new_conn, Not(Equals), core.Conn(nil))
+  defer conn.Close()
+  defer new_conn.Close()
+
+  c.Specify("Data still goes over a reliable channel.", func() {
+    new_conn.SendData([]byte("MONKEYS RULE!!!"))
+    var recv_data []byte
+    select {
+    case recv_data = <-conn.RecvData():
+    case <-time.After(time.Second):
+    }
+    c.Expect(string(recv_data), Equals, "MONKEYS RULE!!!")
+  })
+
+  c.Specify("Bundles get through in both directions.", func() {
+    for frame := core.StateFrame(1); frame <= 50; frame++ {
+      conn.SendFrameBundle(core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{2: core.AllEvents{Game: []core.Event{EventA{int(frame)}}}},
+      })
+      new_conn.SendFrameBundle(core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{1: core.AllEvents{}},
+      })
+    }
+    c.Expect(recvFrames(new_conn, 50), Equals, 50)
+    c.Expect(recvFrames(conn, 50), Equals, 50)
+  })
+
+  c.Specify("Bundles that are never acked still get through.", func() {
+    // Nothing is ever sent back, so no acks are piggybacked on anything.
+    for frame := core.StateFrame(1); frame <= 50; frame++ {
+      conn.SendFrameBundle(core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{2: core.AllEvents{}},
+      })
+    }
+    c.Expect(recvFrames(new_conn, 50), Equals, 50)
+  })
+
+  c.Specify("Bundles too large for a datagram still get through.", func() {
+    big := core.AllEvents{Game: make([]core.Event, 1000)}
+    for i := range big.Game {
+      big.Game[i] = EventB{"This is a rather long string, there will be lots of them."}
+    }
+    conn.SendFrameBundle(core.FrameBundle{
+      Frame:  1,
+      Bundle: core.EventBundle{2: big},
+    })
+    var bundle core.FrameBundle
+    select {
+    case bundle = <-new_conn.RecvFrameBundle():
+    case <-time.After(time.Second):
+    }
+    c.Expect(len(bundle.Bundle[2].Game), Equals, 1000)
+  })
+
+  c.Specify("Udp conns report when they die.", func() {
+    c.Expect(conn.Close(), Equals, error(nil))
+    c.Expect(conn.Err(), Equals, core.ErrConnClosed)
+    select {
+    case <-new_conn.Done():
+    case <-time.After(time.Second):
+    }
+    c.Expect(new_conn.Err(), Equals, core.ErrConnClosedRemotely)
+  })
+}
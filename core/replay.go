@@ -0,0 +1,236 @@
+package core
+
+import (
+  "encoding/gob"
+  "errors"
+  "fmt"
+  "io"
+  "sort"
+)
+
+// The Updater records the game through a Recorder if it has one.  Start is
+// called with the state that the game starts on, and again any time the game
+// is replaced, like after a resync.  Frame is called with the bundle for
+// every frame after that, in order, as soon as the frame is finalized.
+type Recorder interface {
+  Start(frame StateFrame, game Game, info EngineInfo)
+  Frame(bundle FrameBundle)
+}
+
+// A replay file is a gob stream consisting of a replayHeader followed by any
+// number of replayRecords.  The first record is always a Start record.
+const ReplayVersion = 1
+
+var (
+  ErrReplayVersion = errors.New("Replay has an unknown version.")
+  ErrReplayEnd     = errors.New("Reached the end of the replay.")
+)
+
+type replayHeader struct {
+  Version int
+  Params  EngineParams
+}
+
+type replayStart struct {
+  Frame StateFrame
+  Game  Game
+  Info  EngineInfo
+}
+
+// Exactly one field is set.
+type replayRecord struct {
+  Start  *replayStart
+  Bundle *FrameBundle
+}
+
+// Writes a replay file.  Everything is encoded as soon as it is recorded, so
+// the Game can be modified immediately afterwards.  Any concrete types that
+// are used for Game or Event must be registered with gob.
+type ReplayWriter struct {
+  enc *gob.Encoder
+
+  // The first error encountered, once there is an error nothing else is
+  // written.
+  err error
+}
+
+func NewReplayWriter(w io.Writer, params EngineParams) (*ReplayWriter, error) {
+  rw := &ReplayWriter{enc: gob.NewEncoder(w)}
+  err := rw.enc.Encode(replayHeader{ReplayVersion, params})
+  if err != nil {
+    return nil, err
+  }
+  return rw, nil
+}
+
+func (rw *ReplayWriter) write(record replayRecord) {
+  if rw.err != nil {
+    return
+  }
+  rw.err = rw.enc.Encode(record)
+}
+
+func (rw *ReplayWriter) Start(frame StateFrame, game Game, info EngineInfo) {
+  rw.write(replayRecord{Start: &replayStart{frame, game, info}})
+}
+
+func (rw *ReplayWriter) Frame(bundle FrameBundle) {
+  rw.write(replayRecord{Bundle: &bundle})
+}
+
+// Returns the first error encountered while writing, if any.
+func (rw *ReplayWriter) Err() error {
+  return rw.err
+}
+
+// Plays back a replay file one frame at a time.
+type Replayer struct {
+  // The params of the engine that recorded the replay.
+  Params EngineParams
+
+  // Sorted by frame.
+  starts  []replayStart
+  bundles map[StateFrame]EventBundle
+
+  // Last frame in the replay.
+  last StateFrame
+
+  // The current frame and its state, spare is only kept around so that we
+  // have something to simulate the next frame into.
+  data  FrameData
+  frame StateFrame
+  spare Game
+}
+
+type replayStartSlice []replayStart
+
+func (s replayStartSlice) Len() int           { return len(s) }
+func (s replayStartSlice) Less(i, j int) bool { return s[i].Frame < s[j].Frame }
+func (s replayStartSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Reads an entire replay from r.  The returned Replayer is positioned on the
+// first frame of the replay.
+func ReadReplay(r io.Reader) (*Replayer, error) {
+  dec := gob.NewDecoder(r)
+  var header replayHeader
+  err := dec.Decode(&header)
+  if err != nil {
+    return nil, err
+  }
+  if header.Version != ReplayVersion {
+    return nil, ErrReplayVersion
+  }
+  rp := &Replayer{
+    Params:  header.Params,
+    bundles: make(map[StateFrame]EventBundle),
+  }
+  for {
+    var record replayRecord
+    err := dec.Decode(&record)
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    var frame StateFrame
+    switch {
+    case record.Start != nil:
+      rp.starts = append(rp.starts, *record.Start)
+      frame = record.Start.Frame
+    case record.Bundle != nil:
+      rp.bundles[record.Bundle.Frame] = record.Bundle.Bundle
+      frame = record.Bundle.Frame
+    default:
+      continue
+    }
+    if frame > rp.last {
+      rp.last = frame
+    }
+  }
+  if len(rp.starts) == 0 {
+    return nil, errors.New("Replay doesn't contain a starting state.")
+  }
+  sort.Sort(replayStartSlice(rp.starts))
+  rp.reset(rp.starts[0])
+  return rp, nil
+}
+
+func (rp *Replayer) reset(start replayStart) {
+  rp.frame = start.Frame
+  rp.data = FrameData{
+    Game: start.Game.Copy().(Game),
+    Info: start.Info.Copy(),
+  }
+  rp.spare = start.Game.Copy().(Game)
+}
+
+// Returns the game on the current frame.  It must not be modified, and is only
+// valid until the next call to Step or Seek.
+func (rp *Replayer) Game() Game {
+  return rp.data.Game
+}
+
+func (rp *Replayer) Frame() StateFrame {
+  return rp.frame
+}
+
+func (rp *Replayer) First() StateFrame {
+  return rp.starts[0].Frame
+}
+
+func (rp *Replayer) Last() StateFrame {
+  return rp.last
+}
+
+// Advances to the next frame.  Returns ErrReplayEnd if we're on the last
+// frame.
+func (rp *Replayer) Step() error {
+  if rp.frame >= rp.last {
+    return ErrReplayEnd
+  }
+  next := rp.frame + 1
+
+  // If the game was replaced on this frame then the recorded state is the
+  // truth, whatever the events say.
+  i := sort.Search(len(rp.starts), func(i int) bool {
+    return rp.starts[i].Frame >= next
+  })
+  if i < len(rp.starts) && rp.starts[i].Frame == next {
+    rp.reset(rp.starts[i])
+    return nil
+  }
+
+  bundle, ok := rp.bundles[next]
+  if !ok {
+    return errors.New(fmt.Sprintf("Replay is missing frame %d.", next))
+  }
+  data := FrameData{Game: rp.spare, Bundle: bundle}
+  simulateFrame(next, rp.data, &data)
+  rp.spare = rp.data.Game
+  rp.data = data
+  rp.frame = next
+  return nil
+}
+
+// Moves to the specified frame, which must be between First() and Last().
+func (rp *Replayer) Seek(frame StateFrame) error {
+  if frame < rp.First() || frame > rp.last {
+    return errors.New(fmt.Sprintf("Frame %d is not in the replay, which covers frames %d through %d.", frame, rp.First(), rp.last))
+  }
+  // Start over from the closest starting state if we have to go backwards,
+  // or if it gets us there faster.
+  i := sort.Search(len(rp.starts), func(i int) bool {
+    return rp.starts[i].Frame > frame
+  })
+  if frame < rp.frame || rp.starts[i-1].Frame > rp.frame {
+    rp.reset(rp.starts[i-1])
+  }
+  for rp.frame < frame {
+    err := rp.Step()
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
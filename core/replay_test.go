@@ -0,0 +1,91 @@
+package core_test
+
+import (
+  "bytes"
+  "github.com/orfjackal/gospec/src/gospec"
+  . "github.com/orfjackal/gospec/src/gospec"
+  "github.com/runningwild/core"
+)
+
+func ReplaySpec(c gospec.Context) {
+  var params core.EngineParams
+  params.Id = 1234
+  params.Frame_ms = 5
+  params.Max_frames = 25
+  buf := bytes.NewBuffer(nil)
+  writer, err := core.NewReplayWriter(buf, params)
+  c.Assume(err, Equals, error(nil))
+
+  // Record 20 frames of a game where every frame adds the frame number to A.
+  var updater core.Updater
+  updater.Params = params
+  local_bundles := make(chan core.FrameBundle)
+  broadcast_bundles := make(chan core.FrameBundle, 100)
+  updater.Local_bundles = local_bundles
+  updater.Broadcast_bundles = broadcast_bundles
+  updater.Recorder = writer
+  updater.Start(10, core.FrameData{
+    Game: &TestGame{},
+    Info: core.EngineInfo{
+      Engines: map[core.EngineId]bool{params.Id: true},
+    },
+  })
+  for frame := core.StateFrame(11); frame <= 30; frame++ {
+    local_bundles <- core.FrameBundle{
+      Frame:  frame,
+      Bundle: core.EventBundle{params.Id: core.AllEvents{Game: []core.Event{EventA{int(frame)}}}},
+    }
+  }
+  final, final_frame := updater.RequestFinalGameState(-1)
+  c.Assume(final_frame, Equals, core.StateFrame(30))
+  c.Assume(writer.Err(), Equals, error(nil))
+
+  replayer, err := core.ReadReplay(bytes.NewBuffer(buf.Bytes()))
+  c.Assume(err, Equals, error(nil))
+
+  c.Specify("Replays cover every finalized frame.", func() {
+    c.Expect(replayer.Params, Equals, params)
+    c.Expect(replayer.First(), Equals, core.StateFrame(10))
+    c.Expect(replayer.Last(), Equals, core.StateFrame(30))
+    c.Expect(replayer.Frame(), Equals, core.StateFrame(10))
+    c.Expect(*replayer.Game().(*TestGame), Equals, TestGame{})
+  })
+
+  c.Specify("Stepping through a replay reproduces the game.", func() {
+    for frame := core.StateFrame(11); frame <= 30; frame++ {
+      c.Assume(replayer.Step(), Equals, error(nil))
+    }
+    c.Expect(replayer.Step(), Equals, core.ErrReplayEnd)
+    c.Expect(*replayer.Game().(*TestGame), Equals, *final.(*TestGame))
+  })
+
+  c.Specify("Seeking in a replay works in both directions.", func() {
+    c.Assume(replayer.Seek(20), Equals, error(nil))
+    c.Expect(replayer.Frame(), Equals, core.StateFrame(20))
+    // 11 + 12 + ... + 20
+    c.Expect(replayer.Game().(*TestGame).A, Equals, 155)
+    c.Expect(replayer.Game().(*TestGame).Thinks, Equals, 10)
+
+    c.Assume(replayer.Seek(12), Equals, error(nil))
+    c.Expect(replayer.Game().(*TestGame).A, Equals, 23)
+    c.Assume(replayer.Seek(30), Equals, error(nil))
+    c.Expect(*replayer.Game().(*TestGame), Equals, *final.(*TestGame))
+    c.Expect(replayer.Seek(31), Not(Equals), error(nil))
+  })
+
+  c.Specify("Replays pick up the new game after a resync.", func() {
+    writer.Start(30, &TestGame{A: 1000}, core.EngineInfo{
+      Engines: map[core.EngineId]bool{params.Id: true},
+    })
+    writer.Frame(core.FrameBundle{
+      Frame:  31,
+      Bundle: core.EventBundle{params.Id: core.AllEvents{Game: []core.Event{EventA{1}}}},
+    })
+    replayer, err := core.ReadReplay(bytes.NewBuffer(buf.Bytes()))
+    c.Assume(err, Equals, error(nil))
+    c.Assume(replayer.Seek(31), Equals, error(nil))
+    c.Expect(replayer.Game().(*TestGame).A, Equals, 1001)
+    c.Assume(replayer.Seek(29), Equals, error(nil))
+    c.Expect(replayer.Game().(*TestGame).A, Equals, final.(*TestGame).A-30)
+  })
+}
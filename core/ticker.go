@@ -13,6 +13,11 @@ type Ticker interface {
 type BasicTicker struct {
   ticker *time.Ticker
   c      chan struct{}
+
+  // Closed by Stop, done is closed once the goroutine forwarding ticks has
+  // exited.
+  stop chan struct{}
+  done chan struct{}
 }
 
 func NewBasicTicker() Ticker {
@@ -24,17 +29,35 @@ func (bt *BasicTicker) Start() {
   }
   bt.ticker = time.NewTicker(time.Millisecond)
   bt.c = make(chan struct{})
-  go func() {
-    for _ = range bt.ticker.C {
-      bt.c <- struct{}{}
+  bt.stop = make(chan struct{})
+  bt.done = make(chan struct{})
+  go bt.routine(bt.ticker, bt.stop, bt.done)
+}
+func (bt *BasicTicker) routine(ticker *time.Ticker, stop, done chan struct{}) {
+  defer close(done)
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+    select {
+    case bt.c <- struct{}{}:
+    case <-stop:
+      return
     }
-  }()
+  }
 }
+
+// Stops the ticker and returns once it is guaranteed that no more ticks will
+// be sent.
 func (bt *BasicTicker) Stop() {
   if bt.ticker == nil {
     panic("Cannot stop a BasicTicker that has not been started yet.")
   }
   bt.ticker.Stop()
+  close(bt.stop)
+  <-bt.done
   bt.ticker = nil
 }
 func (bt *BasicTicker) Chan() <-chan struct{} {
@@ -1,9 +1,15 @@
 package core
 
 import (
+  "errors"
+  "sort"
   "time"
 )
 
+var (
+  ErrBundleTooFar = errors.New("Engine sent a bundle further ahead than the frame limits allow.")
+)
+
 // Used for bootstrapping
 type BootstrapFrame struct {
   Frame StateFrame
@@ -11,6 +17,14 @@ type BootstrapFrame struct {
   Info  EngineInfo
 }
 
+// The checksum of the Game on a finalized frame, as computed by a single
+// engine.
+type FrameChecksum struct {
+  Id       EngineId
+  Frame    StateFrame
+  Checksum uint64
+}
+
 // The updater has the following tasks:
 // Receive Events from all engines, including localhost, store the events and
 // apply them to the Game as necessary.  If events show up late it will rewind
@@ -41,6 +55,123 @@ type Updater struct {
   // want to host can safely leave this as nil.
   Bootstrap_frames chan<- BootstrapFrame
 
+  // If the Game implements Checksummer then the checksum of every frame is
+  // sent through here to the Communicator when the frame is finalized.  This
+  // can safely be left as nil.
+  Checksums chan<- FrameChecksum
+
+  // Calling Resync sends a request through here to the Communicator, which
+  // gets a fresh BootstrapFrame from the host and sends it back through
+  // Resync_frames.  A host can safely leave these as nil.
+  Resync_requests chan<- struct{}
+  Resync_frames   <-chan BootstrapFrame
+
+  // If this is not nil then the starting state of the game and every frame
+  // after that is recorded here as soon as it is finalized, so that the game
+  // can be replayed later.
+  Recorder Recorder
+
+  // Set for engines that joined as spectators.  They never join the game, so
+  // their local bundles are never applied, but they are still passed along to
+  // Broadcast_bundles.
+  Spectating bool
+
+  // Whenever a change to EngineInfo.Delay is finalized the new delay is sent
+  // here so that the Bundler can start using it.  This can safely be left as
+  // nil.
+  Delays chan<- StateFrame
+
+  // The most recent delay finalized, and whether we still need to send it to
+  // Delays.
+  delay         StateFrame
+  delay_changed bool
+
+  // If this is more than 1 then only frames that are a multiple of it, and the
+  // final frame, keep a copy of the Game in data_window.  Rolling back then
+  // rethinks from the closest of those frames in a single Game, rather than
+  // copying the Game on every frame that is rethought, and the window holds
+  // about Max_frames/Snapshot_interval Games instead of Max_frames.  The
+  // price is up to Snapshot_interval-1 extra Thinks per rollback and one more
+  // Think per finalized frame.  The Game on the final frame and the most
+  // recent frame are then changed in place.  This must be set before calling
+  // Start or Bootstrap.
+  Snapshot_interval int
+
+  // When Snapshot_interval is more than 1 this holds the Game on head_frame,
+  // the most recent frame simulated.
+  head       Game
+  head_frame StateFrame
+
+  // The last frame that data_window has room for is sent here whenever it
+  // changes, so that the Bundler doesn't get more than Params.Max_frames
+  // ahead of the slowest engine.  This can safely be left as nil.
+  Frame_limits chan<- StateFrame
+
+  // The most recent frame limit, and whether we still need to send it to
+  // Frame_limits.
+  frame_limit         StateFrame
+  frame_limit_changed bool
+
+  // Whenever this engine starts or stops lagging, which is when data_window
+  // has no room for its bundles because some engines are too far behind, a
+  // Lag is sent here.  If nobody is listening the Lag is dropped rather than
+  // holding up the game.  This can safely be left as nil.
+  Lags    chan<- Lag
+  lagging bool
+
+  // Whenever an engine sends two different bundles for the same frame it is
+  // reported here, so that the Auditor can drop it.  Only the first bundle is
+  // used, and identical duplicates are ignored.  This can safely be left as
+  // nil.
+  Conflicts chan<- BundleConflict
+
+  // BundleConflicts that haven't been sent to Conflicts yet.
+  conflicts []BundleConflict
+
+  // Engines that send bundles at least Params.Max_frames past the end of
+  // data_window are reported here with ErrBundleTooFar, so that the Auditor
+  // can drop them.  Nobody following the frame limits can get that far
+  // ahead, and their bundles are discarded since there will never be room
+  // for them.  This can safely be left as nil.
+  Dropped_engines chan<- DroppedEngine
+
+  // DroppedEngines that haven't been sent to Dropped_engines yet.
+  dropped_engines []DroppedEngine
+
+  // Every engine that joins or leaves the game is sent here once the frame
+  // that it happened on is final, and whenever we have to simulate frames
+  // again because of bundles that showed up late a Rollback is sent here.
+  // Either of these are dropped if nobody is listening, and both can safely
+  // be left as nil.
+  Engine_changes chan<- EngineChange
+  Rollbacks      chan<- Rollback
+
+  // The most recent frame that has been simulated.
+  simulated StateFrame
+
+  // Bundles for frames past the end of data_window wait here until there is
+  // room for them.
+  future_local  []FrameBundle
+  future_remote []FrameBundle
+
+  // Every EnginePaused and EngineResumed in a bundle is sent here as soon as
+  // we see it, so that the Bundler knows when to stop and start sending
+  // bundles.  This can safely be left as nil.
+  Pause_changes chan<- PauseChange
+
+  // PauseChanges that haven't been sent to Pause_changes yet.
+  pause_changes []PauseChange
+
+  // Resync() sends requests to the routine along this channel.  While we are
+  // waiting on a BootstrapFrame the window doesn't advance, so that we still
+  // have every bundle after the BootstrapFrame when it arrives.
+  resync    chan struct{}
+  resyncing bool
+
+  // Set when we need to send a request to Resync_requests.  The Communicator
+  // might be waiting to send us bundles, so we don't block on it.
+  resync_pending bool
+
   // If this is non-negative then local events occurring on a frame before
   // this are ignored.  This is for bootstrapping engines that haven't figured
   // out what frame they should join the game on yet.  While an engine is
@@ -48,6 +179,9 @@ type Updater struct {
   // should be discarded for now.
   skip_to_frame StateFrame
 
+  // The most recent local bundle discarded because of skip_to_frame.
+  skipped_frame StateFrame
+
   // Requests for game states are made along this channel and a response is
   // given immediately, or stored in final_requests or fast_requests to be
   // fulfilled later.
@@ -77,29 +211,61 @@ type Updater struct {
   // back yet to reThink.
   oldest_dirty_frame StateFrame
 
-  // Shuts everything down and closes all channels it sends on.
+  // For every frame that has been simulated but isn't final yet, which
+  // engines' events have had ApplyFirst called and whether the Game has had
+  // ThinkFirst called.  Rethinking a frame doesn't call these again, and the
+  // Final variants are only called for what is recorded here.
+  firsts map[StateFrame]*frameFirsts
+
+  // The Updater shuts down when Local_bundles or Remote_bundles is closed, or
+  // when Shutdown is called.  done is closed once it has finished.
   shutdown chan struct{}
+  done     chan struct{}
 }
 
 func (u *Updater) Start(frame StateFrame, data FrameData) {
   u.data_window = NewDataWindow(u.Params.Max_frames+1, frame)
   u.data_window.Set(frame, data)
   for i := u.data_window.Start(); i < u.data_window.End(); i++ {
+    if i != frame && !u.keeps(i) {
+      continue
+    }
     future_data := u.data_window.Get(i)
     future_data.Game = data.Game.Copy().(Game)
     u.data_window.Set(i, future_data)
   }
+  if u.Snapshot_interval > 1 {
+    u.head = data.Game.Copy().(Game)
+    u.head_frame = frame
+  }
+  if u.Recorder != nil {
+    u.Recorder.Start(frame, data.Game, data.Info)
+  }
   u.local_frame = frame
   u.global_frame = frame
   u.oldest_dirty_frame = frame + 1
-  u.remote_bundles = make(chan []FrameBundle)
+  u.simulated = frame
+  u.firsts = make(map[StateFrame]*frameFirsts)
+  u.noteLag()
+  u.delay = data.Info.Delay
   u.request_state = make(chan stateRequest)
   u.info_request = make(chan struct{})
   u.info_response = make(chan int)
-  go u.nagle()
+  u.resync = make(chan struct{})
+  u.shutdown = make(chan struct{})
+  u.done = make(chan struct{})
+  if u.Remote_bundles != nil {
+    u.remote_bundles = make(chan []FrameBundle)
+    go u.nagle()
+  }
   go u.routine()
 }
 
+type frameFirsts struct {
+  engines map[EngineId]bool
+  thought bool
+}
+
 type stateRequest struct {
   frame    StateFrame
   response chan stateResponse
@@ -116,7 +282,10 @@ func (u *Updater) Bootstrap(boot *BootstrapFrame) {
   for engine_id := range boot.Info.Engines {
     dummy_bundles[engine_id] = AllEvents{}
   }
-  for i := u.data_window.Start(); i < u.data_window.End(); i++ {
+  for i := u.data_window.Start() + 2; i < u.data_window.End(); i++ {
+    if !u.keeps(i) {
+      continue
+    }
     future_data := u.data_window.Get(i)
     future_data.Game = boot.Game.Copy().(Game)
     u.data_window.Set(i, future_data)
@@ -131,15 +300,31 @@ func (u *Updater) Bootstrap(boot *BootstrapFrame) {
     Game:   boot.Game.Copy().(Game), // Really just a placeholder
     Info:   boot.Info,               // Prevents us from proceeding too early
   })
+  if u.Snapshot_interval > 1 {
+    u.head = boot.Game.Copy().(Game)
+    u.head_frame = boot.Frame + 1
+  }
+  if u.Recorder != nil {
+    u.Recorder.Start(boot.Frame, boot.Game, boot.Info)
+  }
   u.skip_to_frame = -1
+  u.delay = boot.Info.Delay
   u.local_frame = boot.Frame + 1
   u.global_frame = boot.Frame + 1
   u.oldest_dirty_frame = boot.Frame + 2
-  u.remote_bundles = make(chan []FrameBundle)
+  u.simulated = boot.Frame // boot.Frame + 1 is only a placeholder
+  u.firsts = make(map[StateFrame]*frameFirsts)
+  u.noteLag()
   u.request_state = make(chan stateRequest)
   u.info_request = make(chan struct{})
   u.info_response = make(chan int)
-  go u.nagle()
+  u.resync = make(chan struct{})
+  u.shutdown = make(chan struct{})
+  u.done = make(chan struct{})
+  if u.Remote_bundles != nil {
+    u.remote_bundles = make(chan []FrameBundle)
+    go u.nagle()
+  }
   go u.routine()
 }
 
@@ -149,7 +334,7 @@ func (u *Updater) fulfillFinalRequests() {
   for i := 0; i < len(u.final_requests); i++ {
     if u.final_requests[i].frame == u.data_window.Start() {
       u.final_requests[i].response <- stateResponse{
-        game:  u.data_window.Get(u.data_window.Start()).Game,
+        game:  u.finalGame(),
         frame: u.data_window.Start(),
       }
       u.final_requests[i] = u.final_requests[len(u.final_requests)-1]
@@ -163,53 +348,160 @@ func (u *Updater) fulfillFinalRequests() {
 func (u *Updater) fulfillFastRequests() {
   for i := 0; i < len(u.fast_requests); i++ {
     if u.fast_requests[i].frame == u.local_frame {
-      u.fast_requests[i].response <- stateResponse{
-        game:  u.data_window.Get(u.local_frame).Game,
-        frame: u.local_frame,
-      }
+      u.fast_requests[i].response <- u.fastState(u.local_frame)
       u.fast_requests[i] = u.fast_requests[len(u.fast_requests)-1]
       u.fast_requests = u.fast_requests[0 : len(u.fast_requests)-1]
     }
   }
 }
 
-// Does a rethink on every dirty frame and then advances data_window as much
-// as possible.
+// Returns the most recent Game we have on or before frame, which is always the
+// one on frame unless Snapshot_interval is more than 1.
+func (u *Updater) fastState(frame StateFrame) stateResponse {
+  if u.head != nil && u.head_frame == frame {
+    return stateResponse{game: u.head.Copy().(Game), frame: frame}
+  }
+  for frame > u.data_window.Start() && u.data_window.Get(frame).Game == nil {
+    frame--
+  }
+  if frame == u.data_window.Start() {
+    return stateResponse{game: u.finalGame(), frame: frame}
+  }
+  return stateResponse{
+    game:  u.data_window.Get(frame).Game.Copy().(Game),
+    frame: frame,
+  }
+}
+
+// Returns a copy of the Game on the final frame.  Every Game in data_window
+// gets overwritten once the window has moved past it, so nothing outside of
+// the Updater gets to hold on to one.
+func (u *Updater) finalGame() Game {
+  return u.data_window.Get(u.data_window.Start()).Game.Copy().(Game)
+}
+
+// Whether the Game on frame is kept in data_window, see Snapshot_interval.
+func (u *Updater) keeps(frame StateFrame) bool {
+  return u.Snapshot_interval <= 1 || frame%StateFrame(u.Snapshot_interval) == 0
+}
+
+// Computes the state of the game on frame, from the state on the frame before
+// it, prev, and the events in data.Bundle.  Everything that simulates frames
+// goes through here so that they all do it exactly the same way.
+func simulateFrame(frame StateFrame, prev FrameData, data *FrameData) {
+  data.Game.OverwriteWith(prev.Game)
+  data.Info = prev.Info.Copy()
+  stepFrame(frame, data)
+}
+
+// Like simulateFrame, but data.Game and data.Info must already hold the state
+// on the frame before frame.
+func stepFrame(frame StateFrame, data *FrameData) {
+  data.Bundle.EachEngine(frame, func(id EngineId, events []EngineEvent) {
+    for _, event := range events {
+      event.Apply(&data.Info)
+    }
+  })
+  data.Bundle.Each(frame, func(id EngineId, events []Event) {
+    if _, ok := data.Info.Engines[id]; !ok {
+      // TODO: What on earth to do about this?
+      return
+    }
+    for _, event := range events {
+      event.Apply(data.Game)
+    }
+  })
+
+  if thinks(data.Info) {
+    data.Game.Think()
+  }
+}
+
+// A nil set of Engines is the signal that this is a bootstrap game state, so
+// we should not think on it and just copy it to the next frame.
+func thinks(info EngineInfo) bool {
+  return info.Engines != nil && !info.Paused
+}
+
+// Calls ApplyFirst on the events of every engine on frame that we haven't
+// called it for yet, and ThinkFirst if the Game thought on frame and we
+// haven't called it yet.  data must have just been simulated.
+func (u *Updater) firstFrame(frame StateFrame, data FrameData) {
+  firsts := u.firsts[frame]
+  if firsts == nil {
+    firsts = &frameFirsts{engines: make(map[EngineId]bool)}
+    u.firsts[frame] = firsts
+  }
+  data.Bundle.Each(frame, func(id EngineId, events []Event) {
+    if _, ok := data.Info.Engines[id]; !ok || firsts.engines[id] {
+      return
+    }
+    firsts.engines[id] = true
+    for _, event := range events {
+      event.ApplyFirst(data.Game)
+    }
+  })
+  if !firsts.thought && thinks(data.Info) {
+    firsts.thought = true
+    data.Game.ThinkFirst()
+  }
+}
+
+// Calls ApplyFinal and ThinkFinal for everything on frame that ApplyFirst and
+// ThinkFirst were called for.  frame must have just been finalized.
+func (u *Updater) finalFrame(frame StateFrame, data FrameData) {
+  firsts := u.firsts[frame]
+  if firsts == nil {
+    return
+  }
+  delete(u.firsts, frame)
+  data.Bundle.Each(frame, func(id EngineId, events []Event) {
+    if !firsts.engines[id] {
+      return
+    }
+    for _, event := range events {
+      event.ApplyFinal(data.Game)
+    }
+  })
+  if firsts.thought {
+    data.Game.ThinkFinal()
+  }
+}
+
+// Does advanceWindow, and again every time that makes room for bundles that
+// were waiting for it.
 func (u *Updater) advance() {
-  prev_data := u.data_window.Get(u.oldest_dirty_frame - 1)
-  for frame := u.oldest_dirty_frame; frame <= u.global_frame; frame++ {
-    data := u.data_window.Get(frame)
-    data.Game.OverwriteWith(prev_data.Game)
-    new_info := prev_data.Info.Copy()
-    data.Info = new_info
-    data.Bundle.EachEngine(frame, func(id EngineId, events []EngineEvent) {
-      for _, event := range events {
-        event.Apply(&data.Info)
-      }
-    })
-    data.Bundle.Each(frame, func(id EngineId, events []Event) {
-      if _, ok := data.Info.Engines[id]; !ok {
-        // TODO: What on earth to do about this?
-        return
-      }
-      for _, event := range events {
-        event.Apply(data.Game)
-      }
-    })
+  u.advanceWindow()
+  for u.addFutureBundles() {
+    u.advanceWindow()
+  }
+  u.noteLag()
+}
 
-    // A nil set of Engines is the signal that this is a bootstrap game state,
-    // so we should not think on it and just copy it to the next frame.
-    if data.Info.Engines != nil {
-      data.Game.Think()
+// Does a rethink on every dirty frame and then advances data_window as much
+// as possible.
+func (u *Updater) advanceWindow() {
+  if u.oldest_dirty_frame <= u.simulated {
+    u.noteRollback(u.oldest_dirty_frame, int(u.simulated-u.oldest_dirty_frame)+1)
+  }
+  if u.head != nil {
+    u.advanceHead()
+  } else {
+    prev_data := u.data_window.Get(u.oldest_dirty_frame - 1)
+    for frame := u.oldest_dirty_frame; frame <= u.global_frame; frame++ {
+      data := u.data_window.Get(frame)
+      simulateFrame(frame, prev_data, &data)
+      u.firstFrame(frame, data)
+      u.data_window.Set(frame, data)
+      prev_data = data
     }
-    u.data_window.Set(frame, data)
-    prev_data = data
   }
   u.oldest_dirty_frame = u.global_frame + 1
+  u.simulated = u.global_frame
 
   // As long as the *second* frame in the window is complete we can advance,
   // this way we always keep around one frame to copy from if we need it.
-  for u.data_window.Start() < u.global_frame {
+  for !u.resyncing && u.data_window.Start() < u.global_frame {
     prev_info := u.data_window.Get(u.data_window.Start() + 1).Info
     data := u.data_window.Get(u.data_window.Start() + 1)
     all_present := true
@@ -219,15 +511,50 @@ func (u *Updater) advance() {
       }
     }
     if all_present {
+      prev_final := u.data_window.Get(u.data_window.Start()).Info
+      if data.Game == nil {
+        // Only snapshots keep their Game, so we take the Game from the frame
+        // we're about to drop and bring it up to this one.
+        start := u.data_window.Get(u.data_window.Start())
+        step := FrameData{
+          Game:   start.Game,
+          Info:   start.Info.Copy(),
+          Bundle: data.Bundle,
+        }
+        stepFrame(u.data_window.Start()+1, &step)
+        data.Game = step.Game
+        start.Game = nil
+        u.data_window.Set(u.data_window.Start(), start)
+        u.data_window.Set(u.data_window.Start()+1, data)
+      }
       u.data_window.Advance()
+      u.finalFrame(u.data_window.Start(), data)
+      u.noteEngineChanges(u.data_window.Start(), prev_final, data.Info)
+      if data.Info.Delay != u.delay {
+        u.delay = data.Info.Delay
+        u.delay_changed = true
+      }
+      if u.Recorder != nil {
+        u.Recorder.Frame(FrameBundle{
+          Frame:  u.data_window.Start(),
+          Bundle: data.Bundle,
+        })
+      }
       if u.Bootstrap_frames != nil {
         bootstrap_frame := BootstrapFrame{
           Frame: u.data_window.Start(),
-          Game:  data.Game,
+          Game:  u.finalGame(),
           Info:  data.Info,
         }
         u.Bootstrap_frames <- bootstrap_frame
       }
+      if checksummer, ok := data.Game.(Checksummer); ok && u.Checksums != nil {
+        u.Checksums <- FrameChecksum{
+          Id:       u.Params.Id,
+          Frame:    u.data_window.Start(),
+          Checksum: checksummer.Checksum(),
+        }
+      }
       // As soon as we get to a final state we check to see if anyone was
       // waiting on it.
       u.fulfillFinalRequests()
@@ -237,6 +564,92 @@ func (u *Updater) advance() {
   }
 }
 
+// Does the same rethinking as advance when Snapshot_interval is more than 1.
+// Everything is rethought in u.head, starting from the most recent Game we
+// have before the oldest dirty frame, and copied into the snapshots along the
+// way.
+func (u *Updater) advanceHead() {
+  if u.head_frame != u.oldest_dirty_frame-1 {
+    base := u.oldest_dirty_frame - 1
+    for base > u.data_window.Start() && u.data_window.Get(base).Game == nil {
+      base--
+    }
+    u.head.OverwriteWith(u.data_window.Get(base).Game)
+    u.head_frame = base
+  }
+  prev_data := u.data_window.Get(u.head_frame)
+  for frame := u.head_frame + 1; frame <= u.global_frame; frame++ {
+    data := u.data_window.Get(frame)
+    step := FrameData{
+      Game:   u.head,
+      Info:   prev_data.Info.Copy(),
+      Bundle: data.Bundle,
+    }
+    stepFrame(frame, &step)
+    u.firstFrame(frame, step)
+    data.Info = step.Info
+    if data.Game != nil {
+      data.Game.OverwriteWith(u.head)
+    } else if u.keeps(frame) {
+      data.Game = u.head.Copy().(Game)
+    }
+    u.data_window.Set(frame, data)
+    prev_data = data
+  }
+  u.head_frame = u.global_frame
+}
+
+// Replaces everything up to and including boot.Frame with boot, keeping all
+// of the bundles we have for later frames.
+func (u *Updater) resyncTo(boot BootstrapFrame) {
+  old_window := u.data_window
+  if boot.Frame < old_window.Start() {
+    // We've already thrown away bundles that we would need, so we have to try
+    // again.
+    u.resync_pending = true
+    return
+  }
+  u.resyncing = false
+  if u.Recorder != nil {
+    u.Recorder.Start(boot.Frame, boot.Game, boot.Info)
+  }
+  u.data_window = NewDataWindow(u.Params.Max_frames+1, boot.Frame)
+  for i := u.data_window.Start(); i < u.data_window.End(); i++ {
+    data := u.data_window.Get(i)
+    if i == boot.Frame || u.keeps(i) {
+      data.Game = boot.Game.Copy().(Game)
+    }
+    data.Bundle = make(EventBundle)
+    data.Info = boot.Info.Copy()
+    if i > boot.Frame && i <= u.global_frame && i < old_window.End() {
+      data.Bundle = old_window.Get(i).Bundle
+    }
+    u.data_window.Set(i, data)
+  }
+  if u.global_frame < boot.Frame {
+    u.global_frame = boot.Frame
+  }
+  if u.local_frame < boot.Frame {
+    u.local_frame = boot.Frame
+  }
+  if boot.Info.Delay != u.delay {
+    u.delay = boot.Info.Delay
+    u.delay_changed = true
+  }
+  for frame := range u.firsts {
+    if frame <= boot.Frame {
+      delete(u.firsts, frame)
+    }
+  }
+  if u.head != nil {
+    u.head.OverwriteWith(boot.Game)
+    u.head_frame = boot.Frame
+  }
+  u.oldest_dirty_frame = boot.Frame + 1
+  u.simulated = boot.Frame
+  u.advance()
+}
+
 func (u *Updater) nagle() {
   for bundle := range u.Remote_bundles {
     group := []FrameBundle{bundle}
@@ -252,6 +665,7 @@ func (u *Updater) nagle() {
   send:
     u.remote_bundles <- group
   }
+  close(u.remote_bundles)
 }
 
 func (u *Updater) initFrameData(frame StateFrame) {
@@ -262,83 +676,373 @@ func (u *Updater) initFrameData(frame StateFrame) {
   data := u.data_window.Get(frame)
   data.Bundle = make(EventBundle)
   data.Info = prev_data.Info.Copy()
+  if !u.keeps(frame) {
+    data.Game = nil
+  }
   u.data_window.Set(frame, data)
 }
 
-func (u *Updater) routine() {
-  for {
-    select {
-    case local_bundle := <-u.Local_bundles:
-      if u.skip_to_frame == -1 || local_bundle.Frame < u.skip_to_frame {
+// Handles a bundle from Local_bundles.  If there is no room for it in
+// data_window yet then it waits in future_local until there is.  Local bundles
+// come in order, so once one is waiting every one after it waits too.
+func (u *Updater) addLocalBundle(local_bundle FrameBundle) {
+  if u.skip_to_frame == -1 || local_bundle.Frame < u.skip_to_frame {
+    if local_bundle.Frame > u.skipped_frame {
+      u.skipped_frame = local_bundle.Frame
+    }
+    if u.Spectating {
+      // Nothing we do is part of the game, but the Communicator still
+      // uses our bundles to keep track of what frame we're on.
+      u.Broadcast_bundles <- local_bundle
+    }
+    return
+  }
+  if local_bundle.Frame >= u.data_window.End() {
+    // We won't send anything for the frames before this one, so they don't
+    // have to wait on it.
+    u.fillLocal(u.data_window.End())
+    u.future_local = append(u.future_local, local_bundle)
+    return
+  }
+  if local_bundle.Frame <= u.data_window.Start() {
+    // After a resync we can end up past the frames that our own bundles
+    // are for, but everyone else still needs them.
+    u.Broadcast_bundles <- local_bundle
+    return
+  }
+  for frame := u.global_frame + 1; frame <= local_bundle.Frame; frame++ {
+    u.initFrameData(frame)
+  }
+  if u.global_frame < local_bundle.Frame {
+    u.global_frame = local_bundle.Frame
+  }
+  u.fillLocal(local_bundle.Frame)
+  u.local_frame = local_bundle.Frame
+  if u.local_frame < u.oldest_dirty_frame {
+    u.oldest_dirty_frame = u.local_frame
+  }
+  u.notePauses(local_bundle)
+  u.absorb(local_bundle.Frame, local_bundle.Bundle)
+  u.Broadcast_bundles <- local_bundle
+}
+
+// Our bundles are Params.Delay frames ahead of our clock, so when we start,
+// join, or the delay goes up, there are frames that we never sent a bundle
+// for.  Nobody can finish those frames without one, so every frame in
+// data_window after local_frame and before until gets an empty one.  Returns
+// whether there were any.
+func (u *Updater) fillLocal(until StateFrame) bool {
+  if u.skip_to_frame > 0 {
+    // We've just joined, so we haven't sent anything for any of the frames
+    // since we joined.
+    u.local_frame = u.skip_to_frame - 1
+    u.skip_to_frame = 0
+  }
+  filled := false
+  for ; u.local_frame+1 < until; u.local_frame++ {
+    frame := u.local_frame + 1
+    if frame <= u.data_window.Start() {
+      continue
+    }
+    if frame > u.global_frame {
+      u.initFrameData(frame)
+      u.global_frame = frame
+    }
+    dummy_bundle := EventBundle(map[EngineId]AllEvents{u.Params.Id: AllEvents{}})
+    u.absorb(frame, dummy_bundle)
+    u.Broadcast_bundles <- FrameBundle{
+      Bundle: dummy_bundle,
+      Frame:  frame,
+    }
+    if frame < u.oldest_dirty_frame {
+      u.oldest_dirty_frame = frame
+    }
+    filled = true
+  }
+  return filled
+}
+
+// Once Local_bundles is closed we won't be around to find room for the bundles
+// in future_local, so they go out now, along with empty ones for any frames
+// before them that we never sent anything for.  The last bundle from an engine
+// that is shutting down is where it drops itself, so everyone needs to get it
+// even if that engine is lagging.
+func (u *Updater) flushLocal() {
+  for _, local_bundle := range u.future_local {
+    for ; u.local_frame+1 < local_bundle.Frame; u.local_frame++ {
+      if u.local_frame+1 <= u.data_window.Start() {
         continue
       }
-      if u.skip_to_frame > 0 {
-        if u.skip_to_frame < u.oldest_dirty_frame {
-          u.oldest_dirty_frame = u.skip_to_frame
-        }
-        for frame := u.skip_to_frame; frame < local_bundle.Frame; frame++ {
-          data := u.data_window.Get(frame)
-          dummy_bundle := EventBundle(map[EngineId]AllEvents{u.Params.Id: AllEvents{}})
-          data.Bundle.AbsorbEventBundle(dummy_bundle)
-          u.Broadcast_bundles <- FrameBundle{
-            Bundle: dummy_bundle,
-            Frame:  frame,
-          }
-          u.data_window.Set(frame, data)
+      u.Broadcast_bundles <- FrameBundle{
+        Bundle: EventBundle(map[EngineId]AllEvents{u.Params.Id: AllEvents{}}),
+        Frame:  u.local_frame + 1,
+      }
+    }
+    u.local_frame = local_bundle.Frame
+    u.Broadcast_bundles <- local_bundle
+  }
+  u.future_local = nil
+}
+
+// Handles a bundle from Remote_bundles.  If there is no room for it in
+// data_window yet then it waits in future_remote until there is.
+func (u *Updater) addRemoteBundle(remote_bundle FrameBundle) {
+  // When bootstrapping it is totally possible to get events before our
+  // world begins, so we need to make sure to discard those.
+  if remote_bundle.Frame <= u.data_window.Start() {
+    return
+  }
+  if remote_bundle.Frame >= u.data_window.End() {
+    // Nobody can get more than Max_frames past the end of our window, since
+    // their own windows can't get past the last bundle we sent them.
+    if remote_bundle.Frame < u.data_window.End()+StateFrame(u.Params.Max_frames) {
+      u.future_remote = append(u.future_remote, remote_bundle)
+    } else if u.Dropped_engines != nil {
+      for _, id := range remote_bundle.Bundle.sortedIds() {
+        u.dropped_engines = append(u.dropped_engines, DroppedEngine{
+          Id:  id,
+          Err: ErrBundleTooFar,
+        })
+      }
+    }
+    return
+  }
+  for frame := u.global_frame + 1; frame <= remote_bundle.Frame; frame++ {
+    u.initFrameData(frame)
+  }
+  if u.global_frame < remote_bundle.Frame {
+    u.global_frame = remote_bundle.Frame
+  }
+  if remote_bundle.Frame < u.oldest_dirty_frame {
+    u.oldest_dirty_frame = remote_bundle.Frame
+  }
+  if u.skip_to_frame == -1 {
+    remote_bundle.Bundle.EachEngine(remote_bundle.Frame, func(id EngineId, events []EngineEvent) {
+      for _, event := range events {
+        if joined, ok := event.(EngineJoined); ok && joined.Id == u.Params.Id {
+          u.skip_to_frame = remote_bundle.Frame
         }
-        u.skip_to_frame = 0
       }
-      u.local_frame = local_bundle.Frame
-      start := u.global_frame + 1
-      if start < u.skip_to_frame {
-        start = u.skip_to_frame
+    })
+    if u.skip_to_frame > 0 && u.skipped_frame >= u.skip_to_frame {
+      // We discarded our bundles for these frames before we knew that we
+      // were in the game, and the Bundler might not send any more until they
+      // are done.
+      until := u.skipped_frame + 1
+      if until > u.data_window.End() {
+        until = u.data_window.End()
       }
-      // TODO: Check that the local bundle is in bounds
-      for frame := start; frame <= u.local_frame; frame++ {
-        u.initFrameData(frame)
+      u.fillLocal(until)
+    }
+  }
+  u.notePauses(remote_bundle)
+  u.absorb(remote_bundle.Frame, remote_bundle.Bundle)
+}
+
+// Adds bundle to the bundle we have for frame, and queues up a BundleConflict
+// if it has different events from an engine than the ones we already have.
+func (u *Updater) absorb(frame StateFrame, bundle EventBundle) {
+  data := u.data_window.Get(frame)
+  err := data.Bundle.AbsorbEventBundle(bundle)
+  u.data_window.Set(frame, data)
+  if conflict, ok := err.(*ConflictError); ok && u.Conflicts != nil {
+    u.conflicts = append(u.conflicts, BundleConflict{
+      Id:    conflict.Id,
+      Frame: frame,
+    })
+  }
+}
+
+// Adds any bundles from future_local and future_remote that there is room for
+// now, and returns true if there were any.
+func (u *Updater) addFutureBundles() bool {
+  added := false
+  for len(u.future_local) > 0 && u.future_local[0].Frame < u.data_window.End() {
+    local_bundle := u.future_local[0]
+    u.future_local = u.future_local[1:]
+    u.addLocalBundle(local_bundle)
+    added = true
+  }
+  if len(u.future_local) > 0 && u.fillLocal(u.data_window.End()) {
+    added = true
+  }
+  remaining := u.future_remote[0:0]
+  for _, remote_bundle := range u.future_remote {
+    if remote_bundle.Frame < u.data_window.End() {
+      u.addRemoteBundle(remote_bundle)
+      added = true
+    } else {
+      remaining = append(remaining, remote_bundle)
+    }
+  }
+  u.future_remote = remaining
+  return added
+}
+
+// Keeps track of whether we are lagging, which is when data_window is too
+// full to hold any more of our own bundles because some engines are far
+// behind us, and sends a Lag to Lags whenever that changes.
+func (u *Updater) noteLag() {
+  limit := u.data_window.End() - 1
+  if limit != u.frame_limit {
+    u.frame_limit = limit
+    u.frame_limit_changed = true
+  }
+  lagging := u.local_frame >= limit || len(u.future_local) > 0
+  if lagging == u.lagging {
+    return
+  }
+  u.lagging = lagging
+  if u.Lags == nil {
+    return
+  }
+  lag := Lag{
+    Frame:   u.data_window.Start() + 1,
+    Lagging: lagging,
+  }
+  if lagging {
+    data := u.data_window.Get(lag.Frame)
+    for id := range data.Info.Engines {
+      if _, ok := data.Bundle[id]; !ok {
+        lag.Engines = append(lag.Engines, id)
       }
-      if u.global_frame < u.local_frame {
-        u.global_frame = u.local_frame
+    }
+    sort.Sort(engineIdSlice(lag.Engines))
+  }
+  select {
+  case u.Lags <- lag:
+  default:
+  }
+}
+
+// Sends an EngineChange to Engine_changes for every engine that is in one of
+// prev and info but not the other, info being the EngineInfo on frame.
+func (u *Updater) noteEngineChanges(frame StateFrame, prev, info EngineInfo) {
+  if u.Engine_changes == nil {
+    return
+  }
+  var ids []EngineId
+  for id := range prev.Engines {
+    if _, ok := info.Engines[id]; !ok {
+      ids = append(ids, id)
+    }
+  }
+  for id := range info.Engines {
+    if _, ok := prev.Engines[id]; !ok {
+      ids = append(ids, id)
+    }
+  }
+  sort.Sort(engineIdSlice(ids))
+  for _, id := range ids {
+    _, joined := info.Engines[id]
+    select {
+    case u.Engine_changes <- EngineChange{Frame: frame, Id: id, Joined: joined}:
+    default:
+    }
+  }
+}
+
+// Sends a Rollback to Rollbacks, if anyone is listening.
+func (u *Updater) noteRollback(frame StateFrame, frames int) {
+  if u.Rollbacks == nil {
+    return
+  }
+  select {
+  case u.Rollbacks <- Rollback{Frame: frame, Frames: frames}:
+  default:
+  }
+}
+
+// Queues up a PauseChange for every EnginePaused and EngineResumed in bundle.
+func (u *Updater) notePauses(bundle FrameBundle) {
+  if u.Pause_changes == nil {
+    return
+  }
+  for _, events := range bundle.Bundle {
+    for _, event := range events.Engine {
+      switch e := event.(type) {
+      case EnginePaused:
+        u.pause_changes = append(u.pause_changes, PauseChange{
+          Frame:      bundle.Frame,
+          Paused:     true,
+          Last_frame: e.Last_frame,
+        })
+      case EngineResumed:
+        u.pause_changes = append(u.pause_changes, PauseChange{
+          Frame: bundle.Frame,
+        })
       }
-      if u.local_frame < u.oldest_dirty_frame {
-        u.oldest_dirty_frame = u.local_frame
+    }
+  }
+}
+
+func (u *Updater) routine() {
+  for {
+    var resync_requests chan<- struct{}
+    if u.resync_pending {
+      resync_requests = u.Resync_requests
+    }
+    var delays chan<- StateFrame
+    if u.delay_changed {
+      delays = u.Delays
+    }
+    var frame_limits chan<- StateFrame
+    if u.frame_limit_changed {
+      frame_limits = u.Frame_limits
+    }
+    var pause_changes chan<- PauseChange
+    var pause_change PauseChange
+    if len(u.pause_changes) > 0 {
+      pause_changes = u.Pause_changes
+      pause_change = u.pause_changes[0]
+    }
+    var conflicts chan<- BundleConflict
+    var conflict BundleConflict
+    if len(u.conflicts) > 0 {
+      conflicts = u.Conflicts
+      conflict = u.conflicts[0]
+    }
+    var dropped_engines chan<- DroppedEngine
+    var dropped DroppedEngine
+    if len(u.dropped_engines) > 0 {
+      dropped_engines = u.Dropped_engines
+      dropped = u.dropped_engines[0]
+    }
+    select {
+    case resync_requests <- struct{}{}:
+      u.resync_pending = false
+    case delays <- u.delay:
+      u.delay_changed = false
+
+    case pause_changes <- pause_change:
+      u.pause_changes = u.pause_changes[1:]
+
+    case frame_limits <- u.frame_limit:
+      u.frame_limit_changed = false
+
+    case conflicts <- conflict:
+      u.conflicts = u.conflicts[1:]
+
+    case dropped_engines <- dropped:
+      u.dropped_engines = u.dropped_engines[1:]
+
+    case local_bundle, ok := <-u.Local_bundles:
+      if !ok {
+        u.flushLocal()
+        u.stop(nil, u.remote_bundles)
+        return
       }
-      data := u.data_window.Get(local_bundle.Frame)
-      data.Bundle.AbsorbEventBundle(local_bundle.Bundle)
-      u.data_window.Set(local_bundle.Frame, data)
-      u.Broadcast_bundles <- local_bundle
+      u.addLocalBundle(local_bundle)
       u.advance()
       u.fulfillFastRequests()
 
-    case remote_bundles := <-u.remote_bundles:
+    case remote_bundles, ok := <-u.remote_bundles:
+      if !ok {
+        u.stop(u.Local_bundles, nil)
+        return
+      }
       for _, remote_bundle := range remote_bundles {
-        // When bootstrapping it is totally possible to get events before our
-        // world begins, so we need to make sure to discard those.
-        if remote_bundle.Frame <= u.data_window.Start() {
-          continue
-        }
-        for frame := u.global_frame + 1; frame <= remote_bundle.Frame; frame++ {
-          u.initFrameData(frame)
-        }
-        if u.global_frame < remote_bundle.Frame {
-          u.global_frame = remote_bundle.Frame
-        }
-        if remote_bundle.Frame < u.oldest_dirty_frame {
-          u.oldest_dirty_frame = remote_bundle.Frame
-        }
-        if u.skip_to_frame == -1 {
-          remote_bundle.Bundle.EachEngine(remote_bundle.Frame, func(id EngineId, events []EngineEvent) {
-            for _, event := range events {
-              if joined, ok := event.(EngineJoined); ok && joined.Id == u.Params.Id {
-                u.skip_to_frame = remote_bundle.Frame
-              }
-            }
-          })
-        }
-        // TODO: Check that the remote bundle is in bounds
-        data := u.data_window.Get(remote_bundle.Frame)
-        data.Bundle.AbsorbEventBundle(remote_bundle.Bundle)
-        u.data_window.Set(remote_bundle.Frame, data)
+        u.addRemoteBundle(remote_bundle)
       }
       u.advance()
 
@@ -347,7 +1051,7 @@ func (u *Updater) routine() {
         switch {
         case req.frame < 0 || req.frame == u.data_window.Start():
           req.response <- stateResponse{
-            game:  u.data_window.Get(u.data_window.Start()).Game,
+            game:  u.finalGame(),
             frame: u.data_window.Start(),
           }
         case req.frame < u.data_window.Start():
@@ -358,34 +1062,83 @@ func (u *Updater) routine() {
       } else {
         switch {
         case req.frame < 0:
-          req.response <- stateResponse{
-            game:  u.data_window.Get(u.local_frame).Game,
-            frame: u.local_frame,
-          }
+          req.response <- u.fastState(u.local_frame)
         case req.frame < u.data_window.Start():
           req.response <- stateResponse{}
         case req.frame <= u.local_frame:
-          req.response <- stateResponse{
-            game:  u.data_window.Get(req.frame).Game,
-            frame: req.frame,
-          }
+          req.response <- u.fastState(req.frame)
         default:
           u.fast_requests = append(u.fast_requests, req)
         }
       }
 
+    case <-u.resync:
+      if !u.resyncing && u.Resync_requests != nil {
+        u.resyncing = true
+        u.resync_pending = true
+      }
+
+    case boot := <-u.Resync_frames:
+      if u.resyncing {
+        u.resyncTo(boot)
+        u.fulfillFastRequests()
+      }
+
     case <-u.info_request:
       info := u.data_window.Get(u.data_window.Start()).Info
       u.info_response <- len(info.Engines)
 
     case <-u.shutdown:
-      close(u.Broadcast_bundles)
+      u.stop(u.Local_bundles, u.remote_bundles)
       return
     }
   }
 }
 
-// Pass frame < 0 to get the most recent final frame
+// Once we've stopped we close Broadcast_bundles and don't send anything else
+// anywhere, but we keep taking whatever is sent to us until both local and
+// remote have been closed, so that nothing upstream gets stuck.  Any requests
+// for game states get a nil Game.
+func (u *Updater) stop(local <-chan FrameBundle, remote chan []FrameBundle) {
+  if u.Broadcast_bundles != nil {
+    close(u.Broadcast_bundles)
+  }
+  for _, req := range u.final_requests {
+    req.response <- stateResponse{}
+  }
+  for _, req := range u.fast_requests {
+    req.response <- stateResponse{}
+  }
+  u.final_requests = nil
+  u.fast_requests = nil
+  resync_frames := u.Resync_frames
+  for local != nil || remote != nil {
+    select {
+    case _, ok := <-local:
+      if !ok {
+        local = nil
+      }
+    case _, ok := <-remote:
+      if !ok {
+        remote = nil
+      }
+    case _, ok := <-resync_frames:
+      if !ok {
+        resync_frames = nil
+      }
+    case req := <-u.request_state:
+      req.response <- stateResponse{}
+    case <-u.info_request:
+      u.info_response <- 0
+    case <-u.resync:
+    case <-u.shutdown:
+    }
+  }
+  close(u.done)
+}
+
+// Pass frame < 0 to get the most recent final frame.  The Game returned is a
+// copy, so it can be kept for as long as is needed.
 func (u *Updater) RequestFinalGameState(frame StateFrame) (Game, StateFrame) {
   response := make(chan stateResponse)
   u.request_state <- stateRequest{frame, response, true}
@@ -400,11 +1153,23 @@ func (u *Updater) RequestFastGameState(frame StateFrame) (Game, StateFrame) {
   return data.game, data.frame
 }
 
+// Asks the host for a fresh copy of the game, for when this engine has fallen
+// out of sync with everyone else.  Does nothing if Resync_requests is nil.
+func (u *Updater) Resync() {
+  u.resync <- struct{}{}
+}
+
 func (u *Updater) NumEngines() int {
   u.info_request <- struct{}{}
   return <-u.info_response
 }
 
+// Closes Broadcast_bundles and returns once the Updater has stopped.  This
+// doesn't return until Local_bundles and Remote_bundles have both been closed.
 func (u *Updater) Shutdown() {
-  u.shutdown <- struct{}{}
+  select {
+  case u.shutdown <- struct{}{}:
+  case <-u.done:
+  }
+  <-u.done
 }
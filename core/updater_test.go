@@ -5,9 +5,155 @@ import (
   "github.com/orfjackal/gospec/src/gospec"
   . "github.com/orfjackal/gospec/src/gospec"
   "github.com/runningwild/core"
+  "runtime"
+  "testing"
+  "time"
 )
 
+// A TestGame whose checksum is the number of times it has thought.
+type ChecksumGame struct {
+  TestGame
+}
+
+func (g *ChecksumGame) Copy() interface{} {
+  g2 := *g
+  return &g2
+}
+func (g *ChecksumGame) OverwriteWith(_g2 interface{}) {
+  *g = *_g2.(*ChecksumGame)
+}
+func (g *ChecksumGame) Checksum() uint64 {
+  return uint64(g.Thinks)
+}
+
+// Records every call to the First and Final variants made on it or its events,
+// the record is shared between all copies of the game.
+type lifecycleRecord struct {
+  apply_first map[string]int
+  apply       map[string]int
+  apply_final map[string]int
+  think_first []int
+  think_final []int
+}
+
+type LifecycleGame struct {
+  TestGame
+  record *lifecycleRecord
+}
+
+func (g *LifecycleGame) ThinkFirst() {
+  g.record.think_first = append(g.record.think_first, g.Thinks)
+}
+func (g *LifecycleGame) ThinkFinal() {
+  g.record.think_final = append(g.record.think_final, g.Thinks)
+}
+func (g *LifecycleGame) Copy() interface{} {
+  g2 := *g
+  return &g2
+}
+func (g *LifecycleGame) OverwriteWith(_g2 interface{}) {
+  *g = *_g2.(*LifecycleGame)
+}
+
+type EventL struct {
+  Name string
+}
+
+func (e EventL) ApplyFirst(g interface{}) {
+  g.(*LifecycleGame).record.apply_first[e.Name]++
+}
+func (e EventL) Apply(g interface{}) {
+  g.(*LifecycleGame).record.apply[e.Name]++
+}
+func (e EventL) ApplyFinal(g interface{}) {
+  g.(*LifecycleGame).record.apply_final[e.Name]++
+}
+
 func UpdaterSpec(c gospec.Context) {
+  c.Specify("Updater replaces its game with the one it resyncs to.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 25
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 100)
+    resync_requests := make(chan struct{})
+    resync_frames := make(chan core.BootstrapFrame)
+    updater.Local_bundles = local_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Resync_requests = resync_requests
+    updater.Resync_frames = resync_frames
+    info := core.EngineInfo{
+      Engines: map[core.EngineId]bool{params.Id: true},
+    }
+    updater.Start(10, core.FrameData{Game: &TestGame{}, Info: info})
+    send := func(first, last core.StateFrame) {
+      for frame := first; frame <= last; frame++ {
+        local_bundles <- core.FrameBundle{
+          Frame:  frame,
+          Bundle: core.EventBundle{params.Id: core.AllEvents{Game: []core.Event{EventA{1}}}},
+        }
+      }
+    }
+    send(11, 15)
+    updater.Resync()
+    send(16, 20)
+
+    // Nothing past where we asked to resync gets finalized until the resync
+    // is done, and nobody has to take the request for the Updater to keep
+    // going.
+    _, frame := updater.RequestFinalGameState(-1)
+    c.Expect(frame, Equals, core.StateFrame(15))
+    <-resync_requests
+
+    resync_frames <- core.BootstrapFrame{
+      Frame: 17,
+      Game:  &TestGame{A: 100},
+      Info:  info,
+    }
+    state, frame := updater.RequestFinalGameState(-1)
+    c.Expect(frame, Equals, core.StateFrame(20))
+    c.Expect(state.(*TestGame).A, Equals, 103)
+    c.Expect(state.(*TestGame).Thinks, Equals, 3)
+  })
+
+  c.Specify("Updater sends checksums of finalized frames.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 25
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 100)
+    checksums := make(chan core.FrameChecksum, 100)
+    updater.Local_bundles = local_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Checksums = checksums
+    updater.Start(10, core.FrameData{
+      Game: &ChecksumGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true},
+      },
+    })
+    for frame := core.StateFrame(11); frame <= 15; frame++ {
+      local_bundles <- core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{params.Id: core.AllEvents{}},
+      }
+    }
+    updater.RequestFinalGameState(-1)
+    c.Assume(len(checksums), Equals, 5)
+    for frame := core.StateFrame(11); frame <= 15; frame++ {
+      c.Expect(<-checksums, Equals, core.FrameChecksum{
+        Id:       params.Id,
+        Frame:    frame,
+        Checksum: uint64(frame - 10),
+      })
+    }
+  })
+
+
   c.Specify("Basic Updater functionality.", func() {
     var params core.EngineParams
     params.Id = 1234
@@ -110,7 +256,7 @@ func UpdaterSpec(c gospec.Context) {
         Bundle: core.EventBundle{
           params.Id: core.AllEvents{
             Engine: []core.EngineEvent{
-              core.EngineDropped{params.Id + 1},
+              core.EngineDropped{Id: params.Id + 1},
             },
             Game: []core.Event{
               EventA{1},
@@ -129,7 +275,7 @@ func UpdaterSpec(c gospec.Context) {
         Bundle: core.EventBundle{
           params.Id: core.AllEvents{
             Engine: []core.EngineEvent{
-              core.EngineJoined{params.Id + 1},
+              core.EngineJoined{Id: params.Id + 1},
             },
             Game: []core.Event{
               EventA{1},
@@ -166,4 +312,540 @@ func UpdaterSpec(c gospec.Context) {
       c.Expect(tg.A, Equals, 5)
     })
   })
+
+  c.Specify("Updater fills in the frames that delayed local bundles skip.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Delay = 2
+    params.Max_frames = 25
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 10)
+    delays := make(chan core.StateFrame)
+    updater.Local_bundles = local_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Delays = delays
+    data := core.FrameData{
+      Game: &TestGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true},
+        Delay:   params.Delay,
+      },
+    }
+    updater.Start(10, data)
+    defer close(local_bundles)
+    local_bundles <- core.FrameBundle{
+      Frame: 13,
+      Bundle: core.EventBundle{
+        params.Id: core.AllEvents{
+          Game: []core.Event{EventA{1}},
+        },
+      },
+    }
+    for frame := core.StateFrame(11); frame <= 13; frame++ {
+      c.Expect((<-broadcast_bundles).Frame, Equals, frame)
+    }
+    state, _ := updater.RequestFinalGameState(13)
+    c.Expect(state.(*TestGame).Thinks, Equals, 3)
+    c.Expect(state.(*TestGame).A, Equals, 1)
+
+    c.Specify("and reports changes to the delay once they're final.", func() {
+      local_bundles <- core.FrameBundle{
+        Frame: 14,
+        Bundle: core.EventBundle{
+          params.Id: core.AllEvents{
+            Engine: []core.EngineEvent{core.EngineDelayChanged{Delay: 5}},
+          },
+        },
+      }
+      c.Expect(<-delays, Equals, core.StateFrame(5))
+    })
+  })
+
+  c.Specify("Updater calls the First and Final variants exactly once, even when rolling back.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 25
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    remote_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 10)
+    updater.Local_bundles = local_bundles
+    updater.Remote_bundles = remote_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    record := &lifecycleRecord{
+      apply_first: make(map[string]int),
+      apply:       make(map[string]int),
+      apply_final: make(map[string]int),
+    }
+    updater.Start(10, core.FrameData{
+      Game: &LifecycleGame{record: record},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true, params.Id + 1: true},
+      },
+    })
+    defer close(local_bundles)
+    for frame := core.StateFrame(11); frame <= 13; frame++ {
+      local_bundles <- core.FrameBundle{
+        Frame: frame,
+        Bundle: core.EventBundle{
+          params.Id: core.AllEvents{
+            Game: []core.Event{EventL{fmt.Sprintf("local %d", frame)}},
+          },
+        },
+      }
+    }
+
+    // The remote bundles show up late, so every frame gets rethought.
+    for frame := core.StateFrame(11); frame <= 13; frame++ {
+      remote_bundles <- core.FrameBundle{
+        Frame: frame,
+        Bundle: core.EventBundle{
+          params.Id + 1: core.AllEvents{
+            Game: []core.Event{EventL{fmt.Sprintf("remote %d", frame)}},
+          },
+        },
+      }
+    }
+    updater.RequestFinalGameState(13)
+    for frame := core.StateFrame(11); frame <= 13; frame++ {
+      for _, name := range []string{"local", "remote"} {
+        event := fmt.Sprintf("%s %d", name, frame)
+        c.Expect(record.apply_first[event], Equals, 1)
+        c.Expect(record.apply_final[event], Equals, 1)
+      }
+      c.Expect(record.apply[fmt.Sprintf("local %d", frame)] > 1, Equals, true)
+    }
+    c.Expect(record.think_first, Equals, []int{1, 2, 3})
+    c.Expect(record.think_final, Equals, []int{1, 2, 3})
+  })
+
+  for _, interval := range []int{0, 3, 4} {
+    c.Specify(fmt.Sprintf("Updater with a Snapshot_interval of %d gets every frame right when rolling back.", interval), func() {
+      var params core.EngineParams
+      params.Id = 1234
+      params.Max_frames = 50
+      var updater core.Updater
+      updater.Params = params
+      updater.Snapshot_interval = interval
+      local_bundles := make(chan core.FrameBundle)
+      remote_bundles := make(chan core.FrameBundle)
+      broadcast_bundles := make(chan core.FrameBundle, 100)
+      bootstrap_frames := make(chan core.BootstrapFrame, 100)
+      updater.Local_bundles = local_bundles
+      updater.Remote_bundles = remote_bundles
+      updater.Broadcast_bundles = broadcast_bundles
+      updater.Bootstrap_frames = bootstrap_frames
+      updater.Start(10, core.FrameData{
+        Game: &TestGame{},
+        Info: core.EngineInfo{
+          Engines: map[core.EngineId]bool{params.Id: true, params.Id + 1: true},
+        },
+      })
+      defer close(local_bundles)
+      bundle := func(id core.EngineId, frame core.StateFrame, data int) core.FrameBundle {
+        return core.FrameBundle{
+          Frame: frame,
+          Bundle: core.EventBundle{
+            id: core.AllEvents{Game: []core.Event{EventA{data}}},
+          },
+        }
+      }
+
+      // Remote bundles show up anywhere from 3 to 7 frames late.
+      remote := core.StateFrame(11)
+      for frame := core.StateFrame(11); frame <= 40; frame++ {
+        local_bundles <- bundle(params.Id, frame, 1)
+        if frame%5 != 0 {
+          continue
+        }
+        for ; remote <= frame-3; remote++ {
+          remote_bundles <- bundle(params.Id+1, remote, 10)
+        }
+        // Once the last remote bundle has been applied we can look at the
+        // prediction for the frame we're on.
+        updater.RequestFinalGameState(frame - 3)
+        state, fast_frame := updater.RequestFastGameState(-1)
+        c.Expect(fast_frame, Equals, frame)
+        c.Expect(state.(*TestGame).A, Equals, int(frame-10)+10*int(remote-11))
+        c.Expect(state.(*TestGame).Thinks, Equals, int(frame-10))
+      }
+      for ; remote <= 40; remote++ {
+        remote_bundles <- bundle(params.Id+1, remote, 10)
+      }
+      state, _ := updater.RequestFinalGameState(40)
+      c.Expect(state.(*TestGame).A, Equals, 11*30)
+      for frame := core.StateFrame(11); frame <= 40; frame++ {
+        boot := <-bootstrap_frames
+        c.Expect(boot.Frame, Equals, frame)
+        c.Expect(boot.Game.(*TestGame).A, Equals, 11*int(frame-10))
+        c.Expect(boot.Game.(*TestGame).Thinks, Equals, int(frame-10))
+      }
+    })
+  }
+
+  c.Specify("Updater holds on to bundles past the end of its window and reports when it lags.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 5
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    remote_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 100)
+    frame_limits := make(chan core.StateFrame)
+    lags := make(chan core.Lag, 10)
+    updater.Local_bundles = local_bundles
+    updater.Remote_bundles = remote_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Frame_limits = frame_limits
+    updater.Lags = lags
+    updater.Start(10, core.FrameData{
+      Game: &TestGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true, params.Id + 1: true},
+      },
+    })
+    defer close(local_bundles)
+    bundle := func(id core.EngineId, frame core.StateFrame, data int) core.FrameBundle {
+      return core.FrameBundle{
+        Frame: frame,
+        Bundle: core.EventBundle{
+          id: core.AllEvents{Game: []core.Event{EventA{data}}},
+        },
+      }
+    }
+    c.Expect(<-frame_limits, Equals, core.StateFrame(15))
+
+    // Neither of these fit in the window until the remote engine catches up.
+    remote_bundles <- bundle(params.Id+1, 17, 10)
+    for frame := core.StateFrame(11); frame <= 17; frame++ {
+      local_bundles <- bundle(params.Id, frame, 1)
+    }
+    c.Expect(<-lags, Equals, core.Lag{
+      Frame:   11,
+      Lagging: true,
+      Engines: []core.EngineId{params.Id + 1},
+    })
+
+    for frame := core.StateFrame(11); frame <= 16; frame++ {
+      remote_bundles <- bundle(params.Id+1, frame, 10)
+    }
+    state, frame := updater.RequestFinalGameState(17)
+    c.Expect(frame, Equals, core.StateFrame(17))
+    c.Expect(state.(*TestGame).A, Equals, 77)
+    c.Expect(state.(*TestGame).Thinks, Equals, 7)
+    lag := <-lags
+    c.Expect(lag.Lagging, Equals, false)
+    c.Expect(lag.Engines, Equals, []core.EngineId(nil))
+    c.Expect(<-frame_limits, Equals, core.StateFrame(22))
+  })
+
+  c.Specify("Updater sends the bundles past the end of its window when it stops.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 5
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    remote_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 100)
+    updater.Local_bundles = local_bundles
+    updater.Remote_bundles = remote_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Start(10, core.FrameData{
+      Game: &TestGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true, params.Id + 1: true},
+      },
+    })
+    defer close(remote_bundles)
+    dropped := core.FrameBundle{
+      Frame: 18,
+      Bundle: core.EventBundle{
+        params.Id: core.AllEvents{
+          Engine: []core.EngineEvent{core.EngineDropped{Id: params.Id}},
+        },
+      },
+    }
+    local_bundles <- dropped
+    close(local_bundles)
+    for frame := core.StateFrame(11); frame < 18; frame++ {
+      bundle := <-broadcast_bundles
+      c.Expect(bundle.Frame, Equals, frame)
+      c.Expect(len(bundle.Bundle[params.Id].Engine), Equals, 0)
+    }
+    c.Expect(<-broadcast_bundles, Equals, dropped)
+    _, ok := <-broadcast_bundles
+    c.Expect(ok, Equals, false)
+  })
+
+  c.Specify("Updater ignores duplicate bundles and reports conflicting ones.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 25
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    remote_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 10)
+    conflicts := make(chan core.BundleConflict, 10)
+    updater.Local_bundles = local_bundles
+    updater.Remote_bundles = remote_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Conflicts = conflicts
+    updater.Start(10, core.FrameData{
+      Game: &TestGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true, params.Id + 1: true},
+      },
+    })
+    defer close(local_bundles)
+    bundle := func(id core.EngineId, frame core.StateFrame, data int) core.FrameBundle {
+      return core.FrameBundle{
+        Frame: frame,
+        Bundle: core.EventBundle{
+          id: core.AllEvents{Game: []core.Event{EventA{data}}},
+        },
+      }
+    }
+    local_bundles <- bundle(params.Id, 11, 1)
+    local_bundles <- bundle(params.Id, 12, 1)
+    // Frame 12 can't be finalized until frame 11 is, so all of these show up
+    // while it's still in the window.
+    remote_bundles <- bundle(params.Id+1, 12, 10)
+    remote_bundles <- bundle(params.Id+1, 12, 10)
+    remote_bundles <- bundle(params.Id+1, 12, 100)
+    remote_bundles <- bundle(params.Id+1, 11, 10)
+    state, _ := updater.RequestFinalGameState(12)
+    c.Expect(state.(*TestGame).A, Equals, 22)
+    c.Expect(<-conflicts, Equals, core.BundleConflict{Id: params.Id + 1, Frame: 12})
+    c.Expect(len(conflicts), Equals, 0)
+  })
+
+  c.Specify("Updater reports engines that send bundles further ahead than they could have.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 10
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    remote_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 10)
+    dropped_engines := make(chan core.DroppedEngine, 10)
+    updater.Local_bundles = local_bundles
+    updater.Remote_bundles = remote_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Dropped_engines = dropped_engines
+    updater.Start(10, core.FrameData{
+      Game: &TestGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true, params.Id + 1: true},
+      },
+    })
+    defer close(local_bundles)
+    // The window ends on frame 21, so anything from frame 31 on is too far.
+    remote_bundles <- core.FrameBundle{
+      Frame:  30,
+      Bundle: core.EventBundle{params.Id + 1: core.AllEvents{}},
+    }
+    remote_bundles <- core.FrameBundle{
+      Frame:  31,
+      Bundle: core.EventBundle{params.Id + 1: core.AllEvents{}},
+    }
+    select {
+    case dropped := <-dropped_engines:
+      c.Expect(dropped, Equals, core.DroppedEngine{Id: params.Id + 1, Err: core.ErrBundleTooFar})
+    case <-time.After(time.Second):
+      c.Expect("engine was never reported", Equals, nil)
+    }
+    c.Expect(len(dropped_engines), Equals, 0)
+  })
+
+  c.Specify("Updater reports rollbacks and engines joining and leaving.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 25
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    remote_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 10)
+    engine_changes := make(chan core.EngineChange, 10)
+    rollbacks := make(chan core.Rollback, 10)
+    updater.Local_bundles = local_bundles
+    updater.Remote_bundles = remote_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Engine_changes = engine_changes
+    updater.Rollbacks = rollbacks
+    updater.Start(10, core.FrameData{
+      Game: &TestGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true},
+      },
+    })
+    defer close(local_bundles)
+    bundle := func(id core.EngineId, frame core.StateFrame, events ...core.EngineEvent) core.FrameBundle {
+      return core.FrameBundle{
+        Frame: frame,
+        Bundle: core.EventBundle{
+          id: core.AllEvents{Engine: events},
+        },
+      }
+    }
+    local_bundles <- bundle(params.Id, 11, core.EngineJoined{Id: params.Id + 1})
+    local_bundles <- bundle(params.Id, 12)
+    local_bundles <- bundle(params.Id, 13)
+    // The new engine is in the game on the frame that it joined, so it needs
+    // a bundle for that frame as well.
+    remote_bundles <- bundle(params.Id+1, 11)
+    remote_bundles <- bundle(params.Id+1, 12)
+    remote_bundles <- bundle(params.Id+1, 13)
+    local_bundles <- bundle(params.Id, 14, core.EngineDropped{Id: params.Id + 1, Last_frame: 13})
+    _, frame := updater.RequestFinalGameState(14)
+    c.Expect(frame, Equals, core.StateFrame(14))
+    c.Expect(<-rollbacks, Equals, core.Rollback{Frame: 11, Frames: 3})
+    c.Expect(<-engine_changes, Equals, core.EngineChange{Frame: 11, Id: params.Id + 1, Joined: true})
+    c.Expect(<-engine_changes, Equals, core.EngineChange{Frame: 14, Id: params.Id + 1, Joined: false})
+    c.Expect(len(engine_changes), Equals, 0)
+  })
+
+  c.Specify("Updater doesn't think while the game is paused.", func() {
+    var params core.EngineParams
+    params.Id = 1234
+    params.Max_frames = 25
+    var updater core.Updater
+    updater.Params = params
+    local_bundles := make(chan core.FrameBundle)
+    broadcast_bundles := make(chan core.FrameBundle, 10)
+    pause_changes := make(chan core.PauseChange, 10)
+    updater.Local_bundles = local_bundles
+    updater.Broadcast_bundles = broadcast_bundles
+    updater.Pause_changes = pause_changes
+    data := core.FrameData{
+      Game: &TestGame{},
+      Info: core.EngineInfo{
+        Engines: map[core.EngineId]bool{params.Id: true},
+      },
+    }
+    updater.Start(10, data)
+    defer close(local_bundles)
+    engine_events := map[core.StateFrame][]core.EngineEvent{
+      11: []core.EngineEvent{core.EnginePaused{Last_frame: 20}},
+      13: []core.EngineEvent{core.EngineResumed{}},
+    }
+    for frame := core.StateFrame(11); frame <= 14; frame++ {
+      local_bundles <- core.FrameBundle{
+        Frame: frame,
+        Bundle: core.EventBundle{
+          params.Id: core.AllEvents{
+            Game:   []core.Event{EventA{1}},
+            Engine: engine_events[frame],
+          },
+        },
+      }
+    }
+    state, _ := updater.RequestFinalGameState(14)
+    c.Expect(state.(*TestGame).Thinks, Equals, 2)
+    c.Expect(state.(*TestGame).A, Equals, 4)
+    c.Expect(<-pause_changes, Equals, core.PauseChange{Frame: 11, Paused: true, Last_frame: 20})
+    c.Expect(<-pause_changes, Equals, core.PauseChange{Frame: 13})
+  })
+}
+
+// A TestGame with a large state, that counts how many times it gets copied.
+type BigGame struct {
+  TestGame
+  State  []byte
+  copies *int
+}
+
+func (g *BigGame) Copy() interface{} {
+  *g.copies++
+  g2 := *g
+  g2.State = make([]byte, len(g.State))
+  copy(g2.State, g.State)
+  return &g2
+}
+func (g *BigGame) OverwriteWith(_g2 interface{}) {
+  *g.copies++
+  g2 := _g2.(*BigGame)
+  state := g.State
+  *g = *g2
+  g.State = state
+  copy(g.State, g2.State)
+}
+
+// Every op is a local bundle that arrives on time and a remote bundle that
+// arrives Max_frames/2 frames late, so every op is a rollback over half of the
+// window.  Reports how many times the Game was copied per op, and how much
+// memory the Updater is holding on to once the window is full.
+func BenchmarkUpdaterRollback(b *testing.B) {
+  for _, max_frames := range []int{16, 64, 256} {
+    for _, interval := range []int{0, 8} {
+      name := fmt.Sprintf("max_frames=%d/snapshot=%d", max_frames, interval)
+      b.Run(name, func(b *testing.B) {
+        benchmarkUpdaterRollback(b, max_frames, interval)
+      })
+    }
+  }
+}
+
+func benchmarkUpdaterRollback(b *testing.B, max_frames, interval int) {
+  var params core.EngineParams
+  params.Id = 1234
+  params.Max_frames = max_frames
+  var updater core.Updater
+  updater.Params = params
+  updater.Snapshot_interval = interval
+  local_bundles := make(chan core.FrameBundle)
+  remote_bundles := make(chan core.FrameBundle)
+  broadcast_bundles := make(chan core.FrameBundle)
+  updater.Local_bundles = local_bundles
+  updater.Remote_bundles = remote_bundles
+  updater.Broadcast_bundles = broadcast_bundles
+  go func() {
+    for _ = range broadcast_bundles {
+    }
+  }()
+  defer close(remote_bundles)
+  defer close(local_bundles)
+  bundle := func(id core.EngineId, frame core.StateFrame) core.FrameBundle {
+    return core.FrameBundle{
+      Frame:  frame,
+      Bundle: core.EventBundle{id: core.AllEvents{}},
+    }
+  }
+
+  var before, after runtime.MemStats
+  runtime.GC()
+  runtime.ReadMemStats(&before)
+  copies := 0
+  updater.Start(0, core.FrameData{
+    Game: &BigGame{State: make([]byte, 1<<16), copies: &copies},
+    Info: core.EngineInfo{
+      Engines: map[core.EngineId]bool{params.Id: true, params.Id + 1: true},
+    },
+  })
+  lag := core.StateFrame(max_frames / 2)
+  for frame := core.StateFrame(1); frame <= lag; frame++ {
+    local_bundles <- bundle(params.Id, frame)
+  }
+  updater.RequestFastGameState(lag)
+  runtime.GC()
+  runtime.ReadMemStats(&after)
+
+  copies = 0
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    frame := lag + 1 + core.StateFrame(i)
+    local_bundles <- bundle(params.Id, frame)
+    remote_bundles <- bundle(params.Id+1, frame-lag)
+    updater.RequestFinalGameState(frame - lag)
+  }
+  b.StopTimer()
+  b.ReportMetric(float64(copies)/float64(b.N), "copies/op")
+  b.ReportMetric(float64(after.HeapAlloc)-float64(before.HeapAlloc), "heap-B")
 }
@@ -0,0 +1,128 @@
+package pnf
+
+import (
+  "github.com/runningwild/pnf/core"
+)
+
+// Everything sent on Engine.Events is one of the types below.
+type Notification interface {
+  notification()
+}
+
+// An engine joined the game on Frame.
+type EngineJoined struct {
+  Id    core.EngineId
+  Frame core.StateFrame
+}
+
+// An engine left the game, or was dropped from it, on Frame.
+type EngineDropped struct {
+  Id    core.EngineId
+  Frame core.StateFrame
+}
+
+// This engine got so far ahead of the slowest engines in the game that it
+// stopped to wait for them.  Frame is the oldest frame that isn't final yet,
+// and Engines are the ones that haven't sent their bundles for it.
+type Stalled struct {
+  Frame   core.StateFrame
+  Engines []core.EngineId
+}
+
+// This engine caught up after being Stalled, and is running again.
+type Resumed struct {
+  Frame core.StateFrame
+}
+
+// Bundles showed up late, so Frames frames starting at Frame had to be
+// simulated again.
+type Rollback struct {
+  Frame  core.StateFrame
+  Frames int
+}
+
+// Engines computed a different checksum than this one did for Frame, see
+// Engine.Desyncs.
+type DesyncSuspected struct {
+  Frame   core.StateFrame
+  Engines []core.EngineId
+}
+
+func (EngineJoined) notification()    {}
+func (EngineDropped) notification()   {}
+func (Stalled) notification()         {}
+func (Resumed) notification()         {}
+func (Rollback) notification()        {}
+func (DesyncSuspected) notification() {}
+
+// Collects what the Updater and the Auditor report about the game so that it
+// can be passed along to Engine.Events, as well as Engine.Desyncs and
+// Engine.Lags.
+type notifier struct {
+  desyncs        chan core.Desync
+  lags           chan core.Lag
+  engine_changes chan core.EngineChange
+  rollbacks      chan core.Rollback
+
+  // The notifier stops when shutdown is closed, and closes done once it has.
+  shutdown chan struct{}
+  done     chan struct{}
+}
+
+func newNotifier() *notifier {
+  return &notifier{
+    desyncs:        make(chan core.Desync, 100),
+    lags:           make(chan core.Lag, 100),
+    engine_changes: make(chan core.EngineChange, 100),
+    rollbacks:      make(chan core.Rollback, 100),
+    shutdown:       make(chan struct{}),
+    done:           make(chan struct{}),
+  }
+}
+
+// Reports notification on Events, unless nobody is keeping up with it.
+func (e *Engine) notify(notification Notification) {
+  select {
+  case e.events <- notification:
+  default:
+  }
+}
+
+func (e *Engine) notifyRoutine() {
+  n := e.notifier
+  defer close(n.done)
+  for {
+    select {
+    case desync := <-n.desyncs:
+      select {
+      case e.desyncs <- desync:
+      default:
+      }
+      e.notify(DesyncSuspected{Frame: desync.Frame, Engines: desync.Engines})
+
+    case lag := <-n.lags:
+      select {
+      case e.lags <- lag:
+      default:
+      }
+      if lag.Lagging {
+        e.notify(Stalled{Frame: lag.Frame, Engines: lag.Engines})
+      } else {
+        e.notify(Resumed{Frame: lag.Frame})
+      }
+
+    case change := <-n.engine_changes:
+      if change.Joined {
+        e.notify(EngineJoined{Id: change.Id, Frame: change.Frame})
+      } else {
+        e.notify(EngineDropped{Id: change.Id, Frame: change.Frame})
+      }
+
+    case rollback := <-n.rollbacks:
+      e.notify(Rollback{Frame: rollback.Frame, Frames: rollback.Frames})
+
+    case <-n.shutdown:
+      return
+    }
+  }
+}
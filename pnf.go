@@ -1,8 +1,13 @@
 package pnf
 
 import (
+  "context"
   "errors"
+  "fmt"
   "github.com/runningwild/pnf/core"
+  "os"
+  "sync"
+  "time"
 )
 
 type Game interface {
@@ -14,28 +19,507 @@ type Event interface {
 }
 
 type Engine struct {
-  bundler      *core.Bundler
-  updater      *core.Updater
-  communicator *core.Communicator
-  auditor      *core.Auditor
-  net          core.Network
-  local_event  chan<- core.Event
+  params             core.EngineParams
+  bundler            *core.Bundler
+  updater            *core.Updater
+  communicator       *core.Communicator
+  auditor            *core.Auditor
+  net                core.Network
+  local_event        chan<- core.Event
+  local_engine_event chan core.EngineEvent
+  desyncs            chan core.Desync
+  lags               chan core.Lag
+  events             chan Notification
+  notifier           *notifier
+  started            bool
+  replay_file        *os.File
+
+  // Set once Close has been called.  Close holds close_mutex until it is
+  // done, so that only one call to Close shuts the engine down.
+  closed      bool
+  close_mutex sync.Mutex
+
+  join_failed       func(core.FailedJoin)
+  join_failed_mutex sync.Mutex
+
+  // The functions passed to Host, and whether this engine is hosting right
+  // now, which it might not be even if they're set.  Host can be called while
+  // the engine is joining, so whether it joined is kept here too.
+  host_ping  func([]byte) ([]byte, error)
+  host_join  func([]byte) error
+  hosting    bool
+  joined     bool
+  host_mutex sync.Mutex
+}
+
+// A host found by FindHosts that can be passed to JoinHost.
+type RemoteHost struct {
+  // Whatever the host's ping function returned.
+  Data []byte
+
+  remote core.RemoteHost
 }
 
-type RemoteHost struct{}
+// Makes this engine available to other engines.  ping is called whenever
+// someone searches for hosts, its return value is sent back to them.  join is
+// called whenever someone tries to join, if it returns an error the join is
+// rejected.  Both may be called concurrently.  Calling Host with join == nil
+// stops hosting.  Returns an error if this engine can't listen for pings and
+// joins, for example because something else is using its port, in which case
+// it isn't hosting.
+//
+// An engine that joined a host can also call Host, in which case ping and
+// join are only used if this engine takes over as host when the host goes
+// away, and it only starts listening then.  If it takes over without having
+// called Host, or can't listen once it does, the game carries on but nobody
+// else can join it.
+func (e *Engine) Host(ping func([]byte) ([]byte, error), join func([]byte) error) error {
+  e.host_mutex.Lock()
+  e.host_ping = ping
+  e.host_join = join
+  if !e.joined {
+    e.hosting = join != nil
+  }
+  waiting := e.joined && !e.hosting
+  e.host_mutex.Unlock()
+  if waiting {
+    return nil
+  }
+  if join == nil {
+    return e.net.Host(nil, nil)
+  }
+  err := e.net.Host(e.hostPing, e.hostJoin)
+  if err != nil {
+    e.host_mutex.Lock()
+    e.hosting = false
+    e.host_mutex.Unlock()
+  }
+  return err
+}
+
+var errNotHosting = errors.New("This engine is not hosting.")
+
+// These are what the Network actually calls, they only pass things along to
+// the functions given to Host while we're hosting.
+func (e *Engine) hostPing(data []byte) ([]byte, error) {
+  e.host_mutex.Lock()
+  ping, hosting := e.host_ping, e.hosting
+  e.host_mutex.Unlock()
+  if !hosting || ping == nil {
+    return nil, errNotHosting
+  }
+  return ping(data)
+}
+func (e *Engine) hostJoin(data []byte) error {
+  e.host_mutex.Lock()
+  join, hosting := e.host_join, e.hosting
+  e.host_mutex.Unlock()
+  if !hosting || join == nil {
+    return errNotHosting
+  }
+  return join(data)
+}
 
-func (e *Engine) Host(ping, join func([]byte) []byte) {}
-func (e *Engine) FindHosts(data []byte) []RemoteHost {
+// Called by the Communicator when this engine takes over from a host that
+// went away.  The old host might have been on this machine, so we can only
+// start listening where other engines look for hosts now that it's gone.
+func (e *Engine) promoted() {
+  e.host_mutex.Lock()
+  e.hosting = true
+  join := e.host_join
+  e.host_mutex.Unlock()
+  if join != nil {
+    e.net.Host(e.hostPing, e.hostJoin)
+  }
+}
+
+// f is called whenever an engine that was joining this one fails to finish
+// bootstrapping, because it took too long, it gave up, or its connection died.
+// It is also called when this engine can't connect straight to another engine
+// in the game, with that engine's id, and when a spectator is disconnected for
+// sending events.  Only the most recent f is used, and f can be nil.
+func (e *Engine) OnJoinFailed(f func(core.FailedJoin)) {
+  e.join_failed_mutex.Lock()
+  defer e.join_failed_mutex.Unlock()
+  e.join_failed = f
+}
+
+func (e *Engine) joinFailed(failure core.FailedJoin) {
+  e.join_failed_mutex.Lock()
+  f := e.join_failed
+  e.join_failed_mutex.Unlock()
+  if f != nil {
+    f(failure)
+  }
+}
+
+// Searches for hosts, sending them data along with the ping.  Hosts whose
+// ping function returned an error are not included.
+func (e *Engine) FindHosts(data []byte) ([]RemoteHost, error) {
+  rhs, err := e.net.Ping(data)
+  if err != nil {
+    return nil, err
+  }
+  var hosts []RemoteHost
+  for _, rh := range rhs {
+    if rh.Error() != nil {
+      continue
+    }
+    hosts = append(hosts, RemoteHost{Data: rh.Data(), remote: rh})
+  }
+  return hosts, nil
+}
+
+// Joins a host found with FindHosts, data is passed to the host's join
+// function.  On success the engine is started and in sync with the host's
+// game, there is no need to call Start.
+func (e *Engine) JoinHost(host RemoteHost, data []byte) error {
+  return e.JoinHostContext(context.Background(), host, data)
+}
+
+// Like JoinHost, but gives up once ctx is done.  The errors that can be
+// returned if the host doesn't bootstrap us are listed with
+// core.Communicator.JoinContext.
+func (e *Engine) JoinHostContext(ctx context.Context, host RemoteHost, data []byte) error {
+  return e.join(ctx, host, data, false)
+}
+
+// Like JoinHost, but only to watch.  The engine gets every frame of the host's
+// game, but it is never added to the game, so nobody waits on it and events
+// applied to it are ignored.
+func (e *Engine) SpectateHost(host RemoteHost, data []byte) error {
+  return e.SpectateHostContext(context.Background(), host, data)
+}
+
+// Like SpectateHost, but gives up once ctx is done.
+func (e *Engine) SpectateHostContext(ctx context.Context, host RemoteHost, data []byte) error {
+  return e.join(ctx, host, data, true)
+}
+
+func (e *Engine) join(ctx context.Context, host RemoteHost, data []byte, spectate bool) error {
+  if e.started {
+    return errors.New("Cannot join a host with an engine that has already been started.")
+  }
+  if pn, ok := e.net.(core.PeerNetwork); ok && !spectate {
+    // The other engines in the game connect straight to us, in case one of
+    // us has to take over as host.  Whoever we join finds out where we're
+    // listening when we join them.
+    err := pn.ListenForPeers()
+    if err != nil {
+      return err
+    }
+  }
+  conn, err := e.net.Join(host.remote, data)
+  if err != nil {
+    return err
+  }
+  var boot *core.BootstrapFrame
+  var id core.EngineId
+  if spectate {
+    boot, id, err = e.communicator.SpectateContext(ctx, conn)
+  } else {
+    boot, id, err = e.communicator.JoinContext(ctx, conn)
+  }
+  if err != nil {
+    return err
+  }
+  e.updater.Spectating = spectate
+  e.started = true
+  e.host_mutex.Lock()
+  e.joined = true
+  e.host_mutex.Unlock()
+  e.params.Id = id
+  e.params.Delay = boot.Info.Delay
+  e.bundler.Params = e.params
+  e.updater.Params = e.params
+  e.communicator.Params = e.params
+  e.auditor.Params = e.params
+  if spectate {
+    // Only the host gets to drop engines, and spectators never take over.
+    e.auditor.Local_engine_event = nil
+  } else {
+    promotions := make(chan struct{})
+    e.communicator.Promotions = promotions
+    e.communicator.Promoted = e.promoted
+    e.auditor.Promotions = promotions
+  }
+  e.bundler.Current_ms = e.params.Frame_ms * (int64(boot.Frame))
+  go e.notifyRoutine()
+  e.bundler.Start()
+  e.updater.Bootstrap(boot)
+  e.communicator.Start()
+  e.auditor.Start()
   return nil
 }
-func (e *Engine) JoinHost(data []byte) {}
 
-func (e *Engine) Start(game Game) {}
+// Starts a new game with game as the initial state.  Engines that want to
+// host should call Start before Host.
+func (e *Engine) Start(game Game) {
+  if e.started {
+    panic("Started an already started Engine.")
+  }
+  e.started = true
+  data := core.FrameData{
+    Bundle: make(core.EventBundle),
+    Game:   game,
+    Info: core.EngineInfo{
+      Engines: map[core.EngineId]bool{e.params.Id: true},
+      Delay:   e.params.Delay,
+    },
+  }
+  e.bundler.Current_ms = e.params.Frame_ms + 1
+  go e.notifyRoutine()
+  e.bundler.Start()
+  e.updater.Start(0, data)
+  e.communicator.Start()
+  e.auditor.Start()
+}
+
+// Makes an unstarted Engine as specified by params, which is a config string
+// of the form "frame_ms=17,max_frames=50,delay=1,port=20007".  Any
+// unspecified values take on their defaults.  The returned Engine must either
+// Start a game or join one with JoinHost.
+func NewEngine(params string) (*Engine, error) {
+  conf, err := parseConfig(params)
+  if err != nil {
+    return nil, err
+  }
+  conf.params.Id = core.EngineId(core.RandomId())
+  var net core.Network
+  if conf.udp_redundancy > 0 {
+    net, err = core.MakeUdpBundleNetwork(conf.port, conf.udp_redundancy)
+  } else {
+    net, err = core.MakeTcpUdpNetwork(conf.port)
+  }
+  if err != nil {
+    return nil, err
+  }
+  engine := newEngine(conf.params, net, core.NewBasicTicker())
+  engine.auditor.Max_slew_ms = conf.max_slew_ms
+  engine.communicator.Empty_batch = conf.empty_batch
+  engine.updater.Snapshot_interval = conf.snapshots
+  return engine, nil
+}
+
+func newEngine(params core.EngineParams, net core.Network, ticker core.Ticker) *Engine {
+  local_event, local_engine_event, bundler, updater, communicator, auditor := makeUnstarted(params, net, ticker)
+  notifier := newNotifier()
+  auditor.Desyncs = notifier.desyncs
+  updater.Lags = notifier.lags
+  updater.Engine_changes = notifier.engine_changes
+  updater.Rollbacks = notifier.rollbacks
+  engine := &Engine{
+    params:             params,
+    bundler:            bundler,
+    updater:            updater,
+    communicator:       communicator,
+    auditor:            auditor,
+    local_event:        local_event,
+    local_engine_event: local_engine_event,
+    desyncs:            make(chan core.Desync, 100),
+    lags:               make(chan core.Lag, 100),
+    events:             make(chan Notification, 100),
+    notifier:           notifier,
+    net:                net,
+  }
+  communicator.Join_failed = engine.joinFailed
+  return engine
+}
+
+// If the Game implements core.Checksummer then every finalized frame is
+// checked against the other engines in the game, and any engines that
+// disagree with this one are reported here.  Desyncs are dropped if they
+// aren't received promptly.
+func (e *Engine) Desyncs() <-chan core.Desync {
+  return e.desyncs
+}
 
-func NewEngine(params string) *Engine {
-  // var n core.Network
+// Whenever this engine gets so far ahead of the slowest engines in the game
+// that it has to stop and wait for them a Lag is reported here, and another
+// one once it starts up again.  Lags are dropped if they aren't received
+// promptly.
+func (e *Engine) Lags() <-chan core.Lag {
+  return e.lags
+}
+
+// Reports what happens to the game as it runs: engines joining and leaving,
+// this engine stalling and resuming, rollbacks, and suspected desyncs.  Engines
+// joining and leaving are reported once the frame it happened on is final, so
+// every engine in the game reports them on the same frame.  Desyncs and Lags
+// are still reported on their own channels as well.  Notifications are
+// dropped if they aren't received promptly.
+func (e *Engine) Events() <-chan Notification {
+  return e.events
+}
+
+// Records the game to a replay file at path, which can be played back with
+// NewReplayEngine.  This must be called before Start or JoinHost.
+func (e *Engine) Record(path string) error {
+  if e.started {
+    return errors.New("Cannot start recording an engine that has already been started.")
+  }
+  if e.replay_file != nil {
+    return errors.New("This engine is already being recorded.")
+  }
+  file, err := os.Create(path)
+  if err != nil {
+    return err
+  }
+  writer, err := core.NewReplayWriter(file, e.params)
+  if err != nil {
+    file.Close()
+    return err
+  }
+  e.replay_file = file
+  e.updater.Recorder = writer
+  return nil
+}
+
+// Sets the codec used to send bundles to other engines, every engine in a game
+// has to use the same kind of codec, set up the same way.  If this is never
+// called bundles are sent as gobs.  Replays are always written as gobs no
+// matter what codec is used.  This must be called before Start or JoinHost.
+func (e *Engine) SetCodec(codec core.Codec) error {
+  if e.started {
+    return errors.New("Cannot change the codec of an engine that has already been started.")
+  }
+  cn, ok := e.net.(core.CodecNetwork)
+  if !ok {
+    return errors.New("This engine's network doesn't support codecs.")
+  }
+  cn.SetCodec(codec)
+  return nil
+}
+
+// Throws away this engine's copy of the game and replaces it with a fresh one
+// from the host, without anyone having to leave the game.  This is how to
+// recover after a Desync is reported.  Only engines that joined with JoinHost
+// can resync.
+func (e *Engine) Resync() error {
+  e.host_mutex.Lock()
+  joined := e.joined
+  e.host_mutex.Unlock()
+  if !joined {
+    return errors.New("Only engines that joined a host can resync.")
+  }
+  e.updater.Resync()
+  return nil
+}
+
+// Leaves the game and shuts down the engine.  Every other engine in the game
+// is told that this one is leaving so that nobody waits on it.  Returns once
+// every goroutine that the engine started has exited, after that the engine
+// can't be used for anything.
+func (e *Engine) Close() error {
+  e.close_mutex.Lock()
+  defer e.close_mutex.Unlock()
+  if e.closed {
+    return errors.New("This engine has already been closed.")
+  }
+  e.closed = true
+  if e.started && e.net != nil {
+    e.local_engine_event <- core.EngineDropped{Id: e.params.Id}
+
+    // Nothing reads engine events once the Bundler stops, but the Communicator
+    // and the Auditor can still send them until they stop.
+    drained := make(chan struct{})
+    go func() {
+      for _ = range e.local_engine_event {
+      }
+      close(drained)
+    }()
+
+    // Each of these stops once the one before it has, so this just waits for
+    // all of them.
+    e.bundler.Shutdown()
+    e.updater.Shutdown()
+    e.communicator.Shutdown()
+    e.auditor.Shutdown()
+    close(e.local_engine_event)
+    <-drained
+  } else if e.started {
+    e.bundler.Shutdown()
+    e.updater.Shutdown()
+  }
+  if e.started && e.notifier != nil {
+    close(e.notifier.shutdown)
+    <-e.notifier.done
+  }
+  if e.net != nil {
+    e.net.Shutdown()
+  }
+  if e.replay_file != nil {
+    return e.replay_file.Close()
+  }
+  return nil
+}
+
+// Changes the number of frames that every engine in the game waits before
+// applying its local events.  A longer delay means fewer rollbacks but less
+// responsive input, Latency is a good guide to what it should be.  The change
+// is made at the same frame on every engine, so this returns before it takes
+// effect.
+func (e *Engine) SetDelay(delay core.StateFrame) error {
+  err := e.checkPlaying()
+  if err != nil {
+    return err
+  }
+  if delay < 0 || int(delay) >= e.params.Max_frames {
+    return errors.New(fmt.Sprintf("Delay must be between 0 and max_frames - 1, not %d.", delay))
+  }
+  e.local_engine_event <- core.EngineDelayChanged{Delay: delay}
+  return nil
+}
+
+// Pauses the game on every engine.  Events are still applied while the game
+// is paused, but the Game doesn't Think.  Shortly after the game pauses every
+// engine stops advancing frames, until any engine calls Resume.
+func (e *Engine) Pause() error {
+  err := e.checkPlaying()
+  if err != nil {
+    return err
+  }
+  e.local_engine_event <- core.EnginePaused{}
+  return nil
+}
+
+// Resumes a game paused by any engine.
+func (e *Engine) Resume() error {
+  err := e.checkPlaying()
+  if err != nil {
+    return err
+  }
+  e.local_engine_event <- core.EngineResumed{}
+  return nil
+}
+
+// Returns an error unless this engine is running a networked game that it
+// is taking part in, since otherwise it can't send EngineEvents to anyone.
+func (e *Engine) checkPlaying() error {
+  e.close_mutex.Lock()
+  closed := e.closed
+  e.close_mutex.Unlock()
+  if !e.started || closed || e.net == nil {
+    return errors.New("This engine is not running a networked game.")
+  }
+  if e.updater.Spectating {
+    return errors.New("Spectators cannot change the game.")
+  }
   return nil
 }
+
+// Returns how late bundles from the slowest engine in the game arrive, as
+// measured against this engine's clock.  A delay that covers this much time
+// means there are rarely any rollbacks.
+func (e *Engine) Latency() time.Duration {
+  if !e.started || e.auditor == nil {
+    return 0
+  }
+  frames := e.auditor.Latency()
+  return time.Duration(frames * float64(e.params.Frame_ms) * float64(time.Millisecond))
+}
+
+// Returns a copy of the game on the most recent final frame.
 func (e *Engine) GetState() Game {
   game, _ := e.updater.RequestFinalGameState(-1)
   return game
@@ -45,6 +529,8 @@ func (e *Engine) ApplyEvent(event Event) {
 }
 func NewLocalEngine(initial_state Game, frame_ms int64) *Engine {
   var engine Engine
+  engine.bundler = &core.Bundler{}
+  engine.updater = &core.Updater{}
   var params core.EngineParams
   params.Id = 1234
   params.Delay = 1
@@ -71,10 +557,12 @@ func NewLocalEngine(initial_state Game, frame_ms int64) *Engine {
     Game:   initial_state,
     Info: core.EngineInfo{
       Engines: map[core.EngineId]bool{params.Id: true},
+      Delay:   params.Delay,
     },
   }
   var start_frame core.StateFrame = 0
   engine.updater.Start(start_frame, data)
+  engine.started = true
   go func() {
     for _ = range broadcast_bundles {
     }
@@ -84,7 +572,7 @@ func NewLocalEngine(initial_state Game, frame_ms int64) *Engine {
 }
 
 func makeUnstarted(params core.EngineParams, net core.Network, ticker core.Ticker) (
-  chan<- core.Event, *core.Bundler, *core.Updater, *core.Communicator, *core.Auditor) {
+  chan<- core.Event, chan core.EngineEvent, *core.Bundler, *core.Updater, *core.Communicator, *core.Auditor) {
 
   var bundler core.Bundler
   local_bundles := make(chan core.FrameBundle)
@@ -95,7 +583,8 @@ func makeUnstarted(params core.EngineParams, net core.Network, ticker core.Ticke
   bundler.Local_event = local_event
   bundler.Local_engine_event = local_engine_event
   bundler.Ticker = ticker
-  bundler.Time_delta = nil
+  time_delta := make(chan int64)
+  bundler.Time_delta = time_delta
 
   bootstrap_frames := make(chan core.BootstrapFrame)
   broadcast_bundles := make(chan core.FrameBundle)
@@ -106,27 +595,62 @@ func makeUnstarted(params core.EngineParams, net core.Network, ticker core.Ticke
   updater.Broadcast_bundles = broadcast_bundles
   updater.Local_bundles = local_bundles
   updater.Remote_bundles = remote_bundles
+  local_checksums := make(chan core.FrameChecksum)
+  updater.Checksums = local_checksums
+  resync_requests := make(chan struct{})
+  resync_frames := make(chan core.BootstrapFrame)
+  updater.Resync_requests = resync_requests
+  updater.Resync_frames = resync_frames
+  delays := make(chan core.StateFrame)
+  updater.Delays = delays
+  bundler.Delays = delays
+  pause_changes := make(chan core.PauseChange)
+  updater.Pause_changes = pause_changes
+  bundler.Pause_changes = pause_changes
+  frame_limits := make(chan core.StateFrame)
+  updater.Frame_limits = frame_limits
+  bundler.Frame_limits = frame_limits
 
   var communicator core.Communicator
   raw_remote_bundles := make(chan core.FrameBundle)
   communicator.Bootstrap_frames = bootstrap_frames
   communicator.Broadcast_bundles = broadcast_bundles
+  communicator.Params = params
   communicator.Local_engine_event = local_engine_event
   // communicator.Host_conn=
   communicator.Net = net
   communicator.Raw_remote_bundles = raw_remote_bundles
+  local_frames := make(chan core.StateFrame)
+  dropped_engines := make(chan core.DroppedEngine)
+  communicator.Local_frames = local_frames
+  communicator.Dropped_engines = dropped_engines
+  checksums := make(chan core.FrameChecksum)
+  communicator.Local_checksums = local_checksums
+  communicator.Checksums = checksums
+  communicator.Resync_requests = resync_requests
+  communicator.Resync_frames = resync_frames
 
   var auditor core.Auditor
+  auditor.Params = params
   auditor.Raw_remote_bundles = raw_remote_bundles
   auditor.Remote_bundles = remote_bundles
+  auditor.Local_frames = local_frames
+  auditor.Dropped_engines = dropped_engines
+  auditor.Local_engine_event = local_engine_event
+  auditor.Time_delta = time_delta
+  auditor.Checksums = checksums
+  conflicts := make(chan core.BundleConflict)
+  updater.Conflicts = conflicts
+  auditor.Conflicts = conflicts
+  updater.Dropped_engines = dropped_engines
 
-  return local_event, &bundler, &updater, &communicator, &auditor
+  return local_event, local_engine_event, &bundler, &updater, &communicator, &auditor
 }
 
 func NewNetEngine(initial_state Game, frame_ms int64, max_frames, port int) (*Engine, error) {
   var params core.EngineParams
   params.Id = 1234
-  params.Delay = core.StateFrame(frame_ms) + 10
+  params.Delay = DefaultDelay
   params.Frame_ms = frame_ms
   params.Max_frames = max_frames
   net, err := core.MakeTcpUdpNetwork(port)
@@ -134,28 +658,8 @@ func NewNetEngine(initial_state Game, frame_ms int64, max_frames, port int) (*En
     return nil, err
   }
 
-  local_event, bundler, updater, communicator, auditor := makeUnstarted(params, net, core.NewBasicTicker())
-  engine := Engine{
-    bundler:      bundler,
-    updater:      updater,
-    communicator: communicator,
-    auditor:      auditor,
-    local_event:  local_event,
-    net:          net,
-  }
-  data := core.FrameData{
-    Bundle: make(core.EventBundle),
-    Game:   initial_state,
-    Info: core.EngineInfo{
-      Engines: map[core.EngineId]bool{params.Id: true},
-    },
-  }
-
-  bundler.Current_ms = frame_ms + 1
-  bundler.Start()
-  updater.Start(0, data)
-  communicator.Start()
-  auditor.Start()
+  engine := newEngine(params, net, core.NewBasicTicker())
+  engine.Start(initial_state)
 
   ping_func := func([]byte) ([]byte, error) {
     return []byte("I AM A HOST!!!"), nil
@@ -163,15 +667,19 @@ func NewNetEngine(initial_state Game, frame_ms int64, max_frames, port int) (*En
   join_func := func([]byte) error {
     return nil
   }
-  net.Host(ping_func, join_func)
+  err = engine.Host(ping_func, join_func)
+  if err != nil {
+    engine.Close()
+    return nil, err
+  }
 
-  return &engine, nil
+  return engine, nil
 }
 
 func NewNetClientEngine(frame_ms int64, max_frames, port int) (*Engine, error) {
   var params core.EngineParams
   params.Id = 1234
-  params.Delay = core.StateFrame(frame_ms) + 10
+  params.Delay = DefaultDelay
   params.Frame_ms = frame_ms
   params.Max_frames = max_frames
   net, err := core.MakeTcpUdpNetwork(port)
@@ -179,42 +687,18 @@ func NewNetClientEngine(frame_ms int64, max_frames, port int) (*Engine, error) {
     return nil, err
   }
 
-  ticker := core.NewBasicTicker()
-  local_event, bundler, updater, communicator, auditor := makeUnstarted(params, net, ticker)
-  engine := Engine{
-    bundler:      bundler,
-    updater:      updater,
-    communicator: communicator,
-    auditor:      auditor,
-    local_event:  local_event,
-    net:          net,
-  }
-  // ticker.Start()
-
-  rhs, err := net.Ping([]byte("ASDFADSFADSF"))
+  engine := newEngine(params, net, core.NewBasicTicker())
+  hosts, err := engine.FindHosts([]byte("ASDFADSFADSF"))
   if err != nil {
     return nil, err
   }
-  if len(rhs) == 0 {
+  if len(hosts) == 0 {
     return nil, errors.New("Didn't find any remote hosts.")
   }
-  conn, err := net.Join(rhs[0], []byte("I am joinng"))
+  err = engine.JoinHost(hosts[0], []byte("I am joinng"))
   if err != nil {
     return nil, err
   }
 
-  boot, id, err := communicator.Join(conn)
-  if err != nil {
-    return nil, err
-  }
-
-  bundler.Params.Id = id
-  updater.Params.Id = id
-  bundler.Current_ms = params.Frame_ms * (int64(boot.Frame))
-  bundler.Start()
-  updater.Bootstrap(boot)
-  communicator.Start()
-  auditor.Start()
-
-  return &engine, nil
+  return engine, nil
 }
@@ -0,0 +1,411 @@
+package pnf_test
+
+import (
+  "fmt"
+  "github.com/orfjackal/gospec/src/gospec"
+  . "github.com/orfjackal/gospec/src/gospec"
+  "github.com/runningwild/pnf"
+  "github.com/runningwild/pnf/core"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "time"
+)
+
+// Waits a little while for the number of goroutines to drop to n, returns
+// whether it did.
+func goroutinesDropTo(n int) bool {
+  timeout := time.After(time.Second * 2)
+  for runtime.NumGoroutine() > n {
+    select {
+    case <-timeout:
+      return false
+    case <-time.After(time.Millisecond * 10):
+    }
+  }
+  return true
+}
+
+// Adds a random port to config, so that the engines in a spec don't run into
+// the ones from other specs.
+func withPort(config string) string {
+  port := int(core.RandomId()%10000 + 1000)
+  return fmt.Sprintf("%s,port=%d", config, port)
+}
+
+// Makes an engine from config, calling setup on it, and returns it once it is
+// running and hosting.
+func startHost(c gospec.Context, config string, setup ...func(*pnf.Engine)) *pnf.Engine {
+  host, err := pnf.NewEngine(config)
+  c.Assume(err, Equals, error(nil))
+  for _, f := range setup {
+    f(host)
+  }
+  host.Start(&TestGame{})
+  err = host.Host(func(data []byte) ([]byte, error) {
+    return data, nil
+  }, func([]byte) error {
+    return nil
+  })
+  c.Assume(err, Equals, error(nil))
+  time.Sleep(time.Millisecond * 100)
+  return host
+}
+
+// Makes an engine from config, calling setup on it, and finds the host started
+// with the same config.
+func findHost(c gospec.Context, config string, setup ...func(*pnf.Engine)) (*pnf.Engine, pnf.RemoteHost) {
+  engine, err := pnf.NewEngine(config)
+  c.Assume(err, Equals, error(nil))
+  for _, f := range setup {
+    f(engine)
+  }
+  hosts, err := engine.FindHosts([]byte("MONKEYS"))
+  c.Assume(len(hosts), Equals, 1)
+  return engine, hosts[0]
+}
+
+// Starts a host and joins a client to it, both made from config and set up
+// with setup before they start.
+func startHostAndClient(c gospec.Context, config string, setup ...func(*pnf.Engine)) (host, client *pnf.Engine) {
+  config = withPort(config)
+  host = startHost(c, config, setup...)
+  client, remote := findHost(c, config, setup...)
+  c.Assume(client.JoinHost(remote, []byte("MONKEYS")), Equals, error(nil))
+  time.Sleep(time.Millisecond * 100)
+  return host, client
+}
+
+func EngineConfigSpec(c gospec.Context) {
+  c.Specify("Bad config strings are rejected.", func() {
+    configs := []struct {
+      config string
+      err    string
+    }{
+      {"frame_ms", "Malformed config entry"},
+      {"frame_ms=5,,max_frames", "Malformed config entry"},
+      {"frame_ms=fast", "Unable to parse value"},
+      {"delay=-1", "must not be negative"},
+      {"colour=3", "Unknown config key"},
+      {"frame_ms=0", "frame_ms must be positive"},
+      {"max_frames=0", "max_frames must be positive"},
+      {"max_frames=5,delay=5", "delay must be less than max_frames"},
+      {"max_frames=5 batch=6", "batch must be less than max_frames"},
+    }
+    for _, config := range configs {
+      engine, err := pnf.NewEngine(config.config)
+      c.Expect(engine, Equals, (*pnf.Engine)(nil))
+      c.Assume(err, Not(Equals), error(nil))
+      c.Expect(strings.Contains(err.Error(), config.err), Equals, true)
+    }
+  })
+
+  c.Specify("Keys can be separated by commas or whitespace.", func() {
+    engine, err := pnf.NewEngine(withPort("frame_ms=5 max_frames=20\tdelay=2,batch=4"))
+    c.Assume(err, Equals, error(nil))
+    c.Expect(engine.Close(), Equals, error(nil))
+  })
+}
+
+func EngineHostSpec(c gospec.Context) {
+  config := withPort("frame_ms=5,max_frames=20")
+  host, err := pnf.NewEngine(config)
+  c.Assume(err, Equals, error(nil))
+  defer host.Close()
+  host.Start(&TestGame{})
+  err = host.Host(func(data []byte) ([]byte, error) {
+    return append([]byte("Hosting for "), data...), nil
+  }, func([]byte) error {
+    return nil
+  })
+  c.Assume(err, Equals, error(nil))
+  time.Sleep(time.Millisecond * 100)
+
+  c.Specify("FindHosts returns what the host's ping function returned.", func() {
+    client, err := pnf.NewEngine(config)
+    c.Assume(err, Equals, error(nil))
+    defer client.Close()
+    hosts, err := client.FindHosts([]byte("MONKEYS"))
+    c.Assume(err, Equals, error(nil))
+    c.Assume(len(hosts), Equals, 1)
+    c.Expect(string(hosts[0].Data), Equals, "Hosting for MONKEYS")
+  })
+
+  c.Specify("Hosting on a port that is already in use fails.", func() {
+    other, err := pnf.NewEngine(config)
+    c.Assume(err, Equals, error(nil))
+    defer other.Close()
+    other.Start(&TestGame{})
+    err = other.Host(func([]byte) ([]byte, error) {
+      return nil, nil
+    }, func([]byte) error {
+      return nil
+    })
+    c.Expect(err, Not(Equals), error(nil))
+  })
+}
+
+func EngineCloseSpec(c gospec.Context) {
+  c.Specify("Closing engines leaves no goroutines behind.", func() {
+    before := runtime.NumGoroutine()
+    host, client := startHostAndClient(c, "frame_ms=5,max_frames=20")
+    client.ApplyEvent(EventA{1})
+    time.Sleep(time.Millisecond * 200)
+    c.Expect(client.Close(), Equals, error(nil))
+
+    // The host carries on without the client.
+    thinks := host.GetState().(*TestGame).Thinks
+    time.Sleep(time.Millisecond * 200)
+    c.Expect(host.GetState().(*TestGame).Thinks > thinks, Equals, true)
+
+    c.Expect(host.Close(), Equals, error(nil))
+    c.Expect(host.Close(), Not(Equals), error(nil))
+    c.Expect(goroutinesDropTo(before), Equals, true)
+  })
+
+  c.Specify("Closing a local engine leaves no goroutines behind.", func() {
+    before := runtime.NumGoroutine()
+    engine := pnf.NewLocalEngine(&TestGame{}, 5)
+    engine.ApplyEvent(EventA{1})
+    time.Sleep(time.Millisecond * 50)
+    c.Expect(engine.Close(), Equals, error(nil))
+    c.Expect(goroutinesDropTo(before), Equals, true)
+  })
+
+  c.Specify("Only one of several concurrent Closes closes the engine.", func() {
+    engine := pnf.NewLocalEngine(&TestGame{}, 5)
+    errs := make(chan error, 3)
+    for i := 0; i < cap(errs); i++ {
+      go func() {
+        errs <- engine.Close()
+      }()
+    }
+    closes := 0
+    for i := 0; i < cap(errs); i++ {
+      if <-errs == nil {
+        closes++
+      }
+    }
+    c.Expect(closes, Equals, 1)
+  })
+}
+
+func ReplayEngineSpec(c gospec.Context) {
+  c.Specify("Replays can be paused, stepped through and seeked.", func() {
+    dir, err := ioutil.TempDir("", "pnf")
+    c.Assume(err, Equals, error(nil))
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "replay")
+
+    // Record ten frames of a game with a single event on the third frame.
+    var params core.EngineParams
+    params.Id = 1234
+    params.Frame_ms = 5
+    params.Max_frames = 20
+    file, err := os.Create(path)
+    c.Assume(err, Equals, error(nil))
+    writer, err := core.NewReplayWriter(file, params)
+    c.Assume(err, Equals, error(nil))
+    writer.Start(0, &TestGame{}, core.EngineInfo{
+      Engines: map[core.EngineId]bool{params.Id: true},
+    })
+    for frame := core.StateFrame(1); frame <= 10; frame++ {
+      var events core.AllEvents
+      if frame == 3 {
+        events.Game = []core.Event{EventA{1}}
+      }
+      writer.Frame(core.FrameBundle{
+        Frame:  frame,
+        Bundle: core.EventBundle{params.Id: events},
+      })
+    }
+    c.Assume(writer.Err(), Equals, error(nil))
+    c.Assume(file.Close(), Equals, error(nil))
+
+    before := runtime.NumGoroutine()
+    replay, err := pnf.NewReplayEngine(path)
+    c.Assume(err, Equals, error(nil))
+    c.Assume(replay.Last() > replay.First()+2, Equals, true)
+
+    replay.Pause()
+    replay.Advance(100)
+    _, frame := replay.GetState()
+    c.Expect(frame, Equals, replay.First())
+    c.Expect(replay.Step(), Equals, error(nil))
+    _, frame = replay.GetState()
+    c.Expect(frame, Equals, replay.First()+1)
+
+    c.Expect(replay.Seek(replay.Last()), Equals, error(nil))
+    game, frame := replay.GetState()
+    c.Expect(frame, Equals, replay.Last())
+    c.Expect(game.(*TestGame).A, Equals, 1)
+    c.Expect(replay.Step(), Not(Equals), error(nil))
+
+    c.Expect(replay.Seek(replay.First()), Equals, error(nil))
+    replay.Resume()
+    replay.Advance(10)
+    _, frame = replay.GetState()
+    c.Expect(frame, Equals, replay.First()+2)
+
+    // Time adds up across calls, just like it does for an engine's ticker.
+    replay.Advance(3)
+    _, frame = replay.GetState()
+    c.Expect(frame, Equals, replay.First()+2)
+    replay.Advance(2)
+    _, frame = replay.GetState()
+    c.Expect(frame, Equals, replay.First()+3)
+
+    c.Expect(replay.Close(), Equals, error(nil))
+    c.Expect(replay.Close(), Not(Equals), error(nil))
+    c.Expect(replay.Step(), Not(Equals), error(nil))
+    c.Expect(goroutinesDropTo(before), Equals, true)
+  })
+}
+
+func EngineSpectateSpec(c gospec.Context) {
+  c.Specify("Spectators watch the game without taking part in it.", func() {
+    config := withPort("frame_ms=5,max_frames=20")
+    host := startHost(c, config)
+    defer host.Close()
+    spectator, remote := findHost(c, config)
+    defer spectator.Close()
+    c.Assume(spectator.SpectateHost(remote, []byte("MONKEYS")), Equals, error(nil))
+    spectator.ApplyEvent(EventA{5})
+    host.ApplyEvent(EventA{1})
+    time.Sleep(time.Millisecond * 300)
+
+    c.Expect(host.GetState().(*TestGame).A, Equals, 1)
+    c.Expect(spectator.GetState().(*TestGame).A, Equals, 1)
+    c.Expect(spectator.GetState().(*TestGame).Thinks > 0, Equals, true)
+  })
+}
+
+func EngineDelaySpec(c gospec.Context) {
+  c.Specify("Changing the delay keeps every engine in sync.", func() {
+    host, client := startHostAndClient(c, "frame_ms=5,max_frames=20,delay=2")
+    defer host.Close()
+    defer client.Close()
+
+    c.Expect(host.SetDelay(20), Not(Equals), error(nil))
+    c.Expect(host.SetDelay(5), Equals, error(nil))
+    time.Sleep(time.Millisecond * 100)
+    client.ApplyEvent(EventA{1})
+    host.ApplyEvent(EventA{2})
+    c.Expect(client.SetDelay(1), Equals, error(nil))
+    time.Sleep(time.Millisecond * 200)
+
+    c.Expect(host.GetState().(*TestGame).A, Equals, 3)
+    c.Expect(client.GetState().(*TestGame).A, Equals, 3)
+    c.Expect(host.Latency() >= 0, Equals, true)
+  })
+}
+
+func EnginePauseSpec(c gospec.Context) {
+  c.Specify("Pausing stops the game on every engine until it is resumed.", func() {
+    host, client := startHostAndClient(c, "frame_ms=5,max_frames=20")
+    defer host.Close()
+    defer client.Close()
+
+    c.Expect(host.Pause(), Equals, error(nil))
+    time.Sleep(time.Millisecond * 300)
+    thinks := host.GetState().(*TestGame).Thinks
+    c.Expect(client.GetState().(*TestGame).Thinks, Equals, thinks)
+    time.Sleep(time.Millisecond * 100)
+    c.Expect(host.GetState().(*TestGame).Thinks, Equals, thinks)
+    c.Expect(client.GetState().(*TestGame).Thinks, Equals, thinks)
+
+    c.Expect(client.Resume(), Equals, error(nil))
+    time.Sleep(time.Millisecond * 200)
+    c.Expect(host.GetState().(*TestGame).Thinks > thinks, Equals, true)
+    c.Expect(client.GetState().(*TestGame).Thinks > thinks, Equals, true)
+  })
+}
+
+func EngineCodecSpec(c gospec.Context) {
+  c.Specify("Engines can send bundles with a BinaryCodec.", func() {
+    setCodec := func(engine *pnf.Engine) {
+      codec := core.NewBinaryCodec()
+      c.Assume(codec.Register(core.FirstEventTag, EventA{}), Equals, error(nil))
+      c.Assume(engine.SetCodec(codec), Equals, error(nil))
+    }
+    host, client := startHostAndClient(c, "frame_ms=5,max_frames=20", setCodec)
+    defer host.Close()
+    defer client.Close()
+    c.Expect(host.SetCodec(core.NewBinaryCodec()), Not(Equals), error(nil))
+    client.ApplyEvent(EventA{1})
+    host.ApplyEvent(EventA{2})
+    time.Sleep(time.Millisecond * 200)
+
+    c.Expect(host.GetState().(*TestGame).A, Equals, 3)
+    c.Expect(client.GetState().(*TestGame).A, Equals, 3)
+  })
+}
+
+func EngineBatchSpec(c gospec.Context) {
+  c.Specify("Engines that batch empty frames stay in sync.", func() {
+    host, client := startHostAndClient(c, "frame_ms=5,max_frames=20,batch=4")
+    defer host.Close()
+    defer client.Close()
+    client.ApplyEvent(EventA{1})
+    time.Sleep(time.Millisecond * 100)
+    host.ApplyEvent(EventA{2})
+    time.Sleep(time.Millisecond * 200)
+
+    c.Expect(host.GetState().(*TestGame).A, Equals, 3)
+    c.Expect(client.GetState().(*TestGame).A, Equals, 3)
+    thinks := client.GetState().(*TestGame).Thinks
+    time.Sleep(time.Millisecond * 100)
+    c.Expect(client.GetState().(*TestGame).Thinks > thinks, Equals, true)
+  })
+
+  c.Specify("Batches must be shorter than max_frames.", func() {
+    _, err := pnf.NewEngine("max_frames=20,batch=20")
+    c.Expect(err, Not(Equals), error(nil))
+  })
+}
+
+func EngineSnapshotSpec(c gospec.Context) {
+  c.Specify("Engines that only keep snapshots stay in sync.", func() {
+    host, client := startHostAndClient(c, "frame_ms=5,max_frames=20,snapshot=4")
+    defer host.Close()
+    defer client.Close()
+    client.ApplyEvent(EventA{1})
+    host.ApplyEvent(EventA{2})
+    time.Sleep(time.Millisecond * 200)
+
+    c.Expect(host.GetState().(*TestGame).A, Equals, 3)
+    c.Expect(client.GetState().(*TestGame).A, Equals, 3)
+  })
+}
+
+func EngineEventsSpec(c gospec.Context) {
+  c.Specify("Engines report other engines joining and leaving.", func() {
+    host, client := startHostAndClient(c, "frame_ms=5,max_frames=20")
+    defer host.Close()
+    time.Sleep(time.Millisecond * 100)
+    c.Expect(client.Close(), Equals, error(nil))
+
+    // Waits for the next notification of the same type as want.
+    next := func(want pnf.Notification) pnf.Notification {
+      timeout := time.After(time.Second * 2)
+      for {
+        select {
+        case n := <-host.Events():
+          if fmt.Sprintf("%T", n) == fmt.Sprintf("%T", want) {
+            return n
+          }
+        case <-timeout:
+          return nil
+        }
+      }
+    }
+    joined, ok := next(pnf.EngineJoined{}).(pnf.EngineJoined)
+    c.Assume(ok, Equals, true)
+    dropped, ok := next(pnf.EngineDropped{}).(pnf.EngineDropped)
+    c.Assume(ok, Equals, true)
+    c.Expect(dropped.Id, Equals, joined.Id)
+    c.Expect(dropped.Frame > joined.Frame, Equals, true)
+  })
+}
@@ -0,0 +1,202 @@
+package pnf
+
+import (
+  "errors"
+  "github.com/runningwild/pnf/core"
+  "os"
+  "sync"
+)
+
+var errReplayClosed = errors.New("This replay has already been closed.")
+
+// Plays back a replay file recorded with Engine.Record.  Playback is driven by
+// a FakeTicker, so time only passes when Advance is called and playback is
+// entirely deterministic.
+type ReplayEngine struct {
+  replayer *core.Replayer
+  ticker   *core.FakeTicker
+  requests chan interface{}
+
+  // The routine stops when shutdown is closed, and closes done once it has.
+  // After that requests are refused rather than waiting on it forever, and
+  // nothing can be sent on the ticker.
+  shutdown    chan struct{}
+  done        chan struct{}
+  closed      bool
+  close_mutex sync.Mutex
+}
+
+type replayPause struct {
+  paused bool
+}
+
+type replayStep struct {
+  response chan error
+}
+
+type replaySeek struct {
+  frame    core.StateFrame
+  response chan error
+}
+
+type replayState struct {
+  response chan replayStateResponse
+}
+type replayStateResponse struct {
+  game  Game
+  frame core.StateFrame
+}
+
+// Loads the replay at path.  Playback starts on the first frame of the replay
+// and is not paused.
+func NewReplayEngine(path string) (*ReplayEngine, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  replayer, err := core.ReadReplay(file)
+  if err != nil {
+    return nil, err
+  }
+  if replayer.Params.Frame_ms <= 0 {
+    return nil, errors.New("Replay has an invalid frame_ms.")
+  }
+  re := &ReplayEngine{
+    replayer: replayer,
+    ticker:   &core.FakeTicker{},
+    requests: make(chan interface{}),
+    shutdown: make(chan struct{}),
+    done:     make(chan struct{}),
+  }
+  re.ticker.Start()
+  go re.routine()
+  return re, nil
+}
+
+func (re *ReplayEngine) routine() {
+  defer close(re.done)
+  paused := false
+  var ms int64
+  for {
+    select {
+    case <-re.ticker.Chan():
+      if paused {
+        break
+      }
+      ms++
+      if ms < re.replayer.Params.Frame_ms {
+        break
+      }
+      ms = 0
+      if re.replayer.Step() != nil {
+        // Once we run out of replay, or hit a problem with it, there's
+        // nothing more to play.
+        paused = true
+      }
+
+    case _req := <-re.requests:
+      switch req := _req.(type) {
+      case replayPause:
+        paused = req.paused
+        ms = 0
+
+      case replayStep:
+        req.response <- re.replayer.Step()
+
+      case replaySeek:
+        ms = 0
+        req.response <- re.replayer.Seek(req.frame)
+
+      case replayState:
+        req.response <- replayStateResponse{
+          game:  re.replayer.Game().Copy().(Game),
+          frame: re.replayer.Frame(),
+        }
+      }
+
+    case <-re.shutdown:
+      return
+    }
+  }
+}
+
+// Sends req to the routine, returns false if it has already stopped.
+func (re *ReplayEngine) request(req interface{}) bool {
+  select {
+  case re.requests <- req:
+    return true
+  case <-re.done:
+    return false
+  }
+}
+
+// Plays back ms milliseconds of the replay, unless it is paused.
+func (re *ReplayEngine) Advance(ms int) {
+  // Close stops the ticker, so it can't happen in the middle of this.
+  re.close_mutex.Lock()
+  defer re.close_mutex.Unlock()
+  if re.closed {
+    return
+  }
+  re.ticker.Inc(ms)
+}
+
+func (re *ReplayEngine) Pause() {
+  re.request(replayPause{true})
+}
+
+func (re *ReplayEngine) Resume() {
+  re.request(replayPause{false})
+}
+
+// Moves forward exactly one frame, whether or not playback is paused.
+func (re *ReplayEngine) Step() error {
+  response := make(chan error)
+  if !re.request(replayStep{response}) {
+    return errReplayClosed
+  }
+  return <-response
+}
+
+// Moves to frame, which can be anywhere between First() and Last().
+func (re *ReplayEngine) Seek(frame core.StateFrame) error {
+  response := make(chan error)
+  if !re.request(replaySeek{frame, response}) {
+    return errReplayClosed
+  }
+  return <-response
+}
+
+// Returns a copy of the game on the current frame, and the current frame.
+// Once the ReplayEngine has been closed this returns nil.
+func (re *ReplayEngine) GetState() (Game, core.StateFrame) {
+  response := make(chan replayStateResponse)
+  if !re.request(replayState{response}) {
+    return nil, 0
+  }
+  state := <-response
+  return state.game, state.frame
+}
+
+// Stops playback and returns once the ReplayEngine's goroutine has exited.
+func (re *ReplayEngine) Close() error {
+  re.close_mutex.Lock()
+  defer re.close_mutex.Unlock()
+  if re.closed {
+    return errReplayClosed
+  }
+  re.closed = true
+  close(re.shutdown)
+  <-re.done
+  re.ticker.Stop()
+  return nil
+}
+
+func (re *ReplayEngine) First() core.StateFrame {
+  return re.replayer.First()
+}
+
+func (re *ReplayEngine) Last() core.StateFrame {
+  return re.replayer.Last()
+}